@@ -3,9 +3,12 @@ package yafw
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/google/nftables"
 )
@@ -20,12 +23,37 @@ const (
 
 	// a reference to one of commonly defined IPSets
 	AddressIPSet
+
+	// a domain name, resolved in background into a dynamic IPSet
+	AddressFQDN
+
+	// a country, loaded from GeoIP database files into a dynamic IPSet
+	AddressGeo
+
+	// the addresses configured on an interface, followed in a dynamic IPSet
+	AddressInterface
+
+	// the connected subnets of an interface, followed in a dynamic IPSet
+	AddressInterfaceNet
+)
+
+const (
+	addressFQDNPrefix         = "fqdn:"
+	addressGeoPrefix          = "geo:"
+	addressInterfacePrefix    = "iface:"
+	addressInterfaceNetPrefix = "iface-net:"
 )
 
 type Address struct {
 	t         AddressType
 	Immediate []*IPRange `json:"immediate"`
 	IPSet     string     `json:"ipset"`
+	FQDN      string     `json:"fqdn"`
+	Country   string     `json:"country"`
+	Interface string     `json:"interface"`
+
+	// match anything except the address
+	Negate bool `json:"negate"`
 }
 
 func NewAddressImmediate(immediate []*IPRange) *Address {
@@ -42,11 +70,62 @@ func NewAddressIPSet(ipset string) *Address {
 	}
 }
 
+func NewAddressFQDN(fqdn string) *Address {
+	return &Address{
+		t:    AddressFQDN,
+		FQDN: fqdn,
+	}
+}
+
+func NewAddressGeo(country string) *Address {
+	return &Address{
+		t:       AddressGeo,
+		Country: country,
+	}
+}
+
+func NewAddressInterface(iface string) *Address {
+	return &Address{
+		t:         AddressInterface,
+		Interface: iface,
+	}
+}
+
+func NewAddressInterfaceNet(iface string) *Address {
+	return &Address{
+		t:         AddressInterfaceNet,
+		Interface: iface,
+	}
+}
+
 func (ad *Address) Type() AddressType {
 	return ad.t
 }
 
+// The JSON form of a negated address, e.g.
+//
+//	{"negate": true, "address": ["10.0.0.0/8"]}
+type negatedAddressJSON struct {
+	Negate  bool            `json:"negate"`
+	Address json.RawMessage `json:"address"`
+}
+
 func (r *Address) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		negated := negatedAddressJSON{}
+		if err := json.Unmarshal(trimmed, &negated); err != nil {
+			return err
+		}
+		if len(negated.Address) == 0 || negated.Address[0] == '{' {
+			return fmt.Errorf("cannot convert to address")
+		}
+		if err := r.UnmarshalJSON(negated.Address); err != nil {
+			return err
+		}
+		r.Negate = negated.Negate
+		return nil
+	}
+
 	ipranges := []string{}
 	err := json.Unmarshal(data, &ipranges)
 	if err != nil {
@@ -56,6 +135,30 @@ func (r *Address) UnmarshalJSON(data []byte) error {
 			return fmt.Errorf("cannot convert to addresss")
 		}
 
+		if strings.HasPrefix(ipset, addressFQDNPrefix) {
+			r.t = AddressFQDN
+			r.FQDN = strings.TrimPrefix(ipset, addressFQDNPrefix)
+			return nil
+		}
+
+		if strings.HasPrefix(ipset, addressGeoPrefix) {
+			r.t = AddressGeo
+			r.Country = strings.TrimPrefix(ipset, addressGeoPrefix)
+			return nil
+		}
+
+		if strings.HasPrefix(ipset, addressInterfacePrefix) {
+			r.t = AddressInterface
+			r.Interface = strings.TrimPrefix(ipset, addressInterfacePrefix)
+			return nil
+		}
+
+		if strings.HasPrefix(ipset, addressInterfaceNetPrefix) {
+			r.t = AddressInterfaceNet
+			r.Interface = strings.TrimPrefix(ipset, addressInterfaceNetPrefix)
+			return nil
+		}
+
 		r.t = AddressIPSet
 		r.IPSet = ipset
 		return nil
@@ -63,51 +166,148 @@ func (r *Address) UnmarshalJSON(data []byte) error {
 
 	r.t = AddressImmediate
 	for _, iprange := range ipranges {
-		r.Immediate = append(r.Immediate, NewIPRangeString(iprange))
+		parsed := NewIPRangeString(iprange)
+		if parsed == nil {
+			return fmt.Errorf("cannot convert %s to address", iprange)
+		}
+		r.Immediate = append(r.Immediate, parsed)
 	}
 
 	return nil
 }
 
 func (r *Address) MarshalJSON() ([]byte, error) {
+	var data []byte
+	var err error
+
 	switch r.Type() {
 	case AddressIPSet:
-		return json.Marshal(r.IPSet)
+		data, err = json.Marshal(r.IPSet)
+	case AddressFQDN:
+		data, err = json.Marshal(addressFQDNPrefix + r.FQDN)
+	case AddressGeo:
+		data, err = json.Marshal(addressGeoPrefix + r.Country)
+	case AddressInterface:
+		data, err = json.Marshal(addressInterfacePrefix + r.Interface)
+	case AddressInterfaceNet:
+		data, err = json.Marshal(addressInterfaceNetPrefix + r.Interface)
 	case AddressImmediate:
 		ipranges := []string{}
 		for _, iprange := range r.Immediate {
 			ipranges = append(ipranges, iprange.String())
 		}
-		return json.Marshal(ipranges)
+		data, err = json.Marshal(ipranges)
 	default:
 		return nil, fmt.Errorf("unknown address type")
 	}
+
+	if err != nil || !r.Negate {
+		return data, err
+	}
+
+	return json.Marshal(negatedAddressJSON{
+		Negate:  true,
+		Address: data,
+	})
 }
 
 func (r *Address) String() string {
+	negate := ""
+	if r.Negate {
+		negate = "!"
+	}
+
 	switch r.Type() {
 	case AddressIPSet:
-		return fmt.Sprintf("ipset:%s", r.IPSet)
+		return fmt.Sprintf("%sipset:%s", negate, r.IPSet)
+	case AddressFQDN:
+		return negate + addressFQDNPrefix + r.FQDN
+	case AddressGeo:
+		return negate + addressGeoPrefix + r.Country
+	case AddressInterface:
+		return negate + addressInterfacePrefix + r.Interface
+	case AddressInterfaceNet:
+		return negate + addressInterfaceNetPrefix + r.Interface
 	case AddressImmediate:
 		ipranges := []string{}
 		for _, iprange := range r.Immediate {
 			ipranges = append(ipranges, iprange.String())
 		}
-		return fmt.Sprintf("[%s]", strings.Join(ipranges, ","))
+		return fmt.Sprintf("%s[%s]", negate, strings.Join(ipranges, ","))
 	default:
 		return "(unknown)"
 	}
 }
 
+var (
+	ErrIPSetNameDuplicated = errors.New("ipset name duplicated")
+	ErrIPSetNameInvalid    = errors.New("invalid ipset name")
+	ErrIPSetNotFound       = errors.New("ipset not found")
+	ErrIPSetDynamic        = errors.New("ipset is managed by yafw")
+	ErrIPSetCycle          = errors.New("ipset references form a cycle")
+	ErrIPSetReferred       = errors.New("ipset is referred")
+	ErrIPSetNoTimeout      = errors.New("ipset does not support timeout")
+)
+
 type IPSet struct {
-	set *nftables.Set
+	set *AddressSet
 
-	// incremental update
-	willAdd    []*IPRange
-	willDelete []*IPRange
+	// incremental update, keyed by ipRangeKey
+	willAdd    map[string]*IPRange
+	willDelete map[string]*IPRange
 
 	name    string
 	members []*IPRange
+
+	// keys of members, see ipRangeKey
+	memberKeys map[string]bool
+
+	// members normalized into non-overlapping intervals, as they are in the
+	// kernel set
+	elements []*IPRange
+
+	// names of other IPSets whose members are included in this one
+	refs []string
+
+	// incremental update of refs
+	willAddRef    []string
+	willDeleteRef []string
+
+	// members are maintained by yafw rather than the user, e.g. addresses
+	// resolved from a domain name
+	dynamic bool
+
+	// elements can be added with a TTL, which are expired by the kernel and
+	// kept apart from the members
+	timeout bool
+	timed   map[string]*TimedIPRange
+}
+
+// An element added to an IPSet with a TTL.
+type TimedIPRange struct {
+	*IPRange
+	Expires time.Time
+}
+
+// Get the remaining time before the kernel expires the element.
+func (e *TimedIPRange) Remaining() time.Duration {
+	remaining := time.Until(e.Expires)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+func (e *TimedIPRange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Address   *IPRange  `json:"address"`
+		Expires   time.Time `json:"expires"`
+		Remaining float64   `json:"remaining"`
+	}{
+		Address:   e.IPRange,
+		Expires:   e.Expires,
+		Remaining: e.Remaining().Seconds(),
+	})
 }
 
 func IPMaskedLast(ip net.IP, mask net.IPMask) net.IP {
@@ -119,39 +319,10 @@ func IPMaskedLast(ip net.IP, mask net.IPMask) net.IP {
 	return out
 }
 
+// Get the IP after the last one masked by mask, which wraps around to the
+// first IP of the family for the whole address space.
 func IPMaskedEnd(ip net.IP, mask net.IPMask) net.IP {
-	n := len(ip)
-	out := make(net.IP, n)
-	copy(out, ip)
-
-	// Get the lowbit in a byte. lowbit(x) = the lowest non-zero bit mask
-	//
-	// e.g. lowbit(11100100b) = 00000100b
-	//                  ^ lowest non-zero bit
-	lowbit := func(x byte) byte { return x & (x ^ (x - 1)) }
-
-	previousLowbit := byte(0)
-	for i := n - 1; i >= 0; i-- {
-		if mask[i] == 0 {
-			continue
-		}
-		currentLowbit := lowbit(mask[i])
-		if previousLowbit == 0 {
-			// We are now at the last non-zero segment of mask.
-			//
-			// e.g. 255.255.224.0
-			//               ^ we are here
-
-			out[i] += currentLowbit
-		} else if previousLowbit > out[i+1] {
-			// Indicates a carry at the previous segment.
-
-			out[i] += currentLowbit
-		}
-
-		previousLowbit = currentLowbit
-	}
-	return out
+	return IPNext(IPMaskedLast(ip, mask))
 }
 
 // Get the last IP in a range represented by IPNet.
@@ -196,6 +367,98 @@ func IPNext(ip net.IP) net.IP {
 	return out
 }
 
+// Check whether an IP is the last one of its family, e.g. 255.255.255.255.
+func isLastIP(ip net.IP) bool {
+	for _, b := range ip {
+		if b != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// Compare two IPs in the numeric order. IPv4 addresses go before IPv6 ones.
+func compareIP(a net.IP, b net.IP) int {
+	a, b = normalizeIP(a), normalizeIP(b)
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return bytes.Compare(a, b)
+}
+
+// Merge ranges into a minimal sorted slice of non-overlapping intervals.
+// Overlapping and adjacent ranges of the same family are merged together,
+// e.g. "192.168.233.1/32" and "192.168.233.0/24" give "192.168.233.0/24".
+func mergeIPRanges(ranges []*IPRange) []*IPRange {
+	sorted := make([]*IPRange, 0, len(ranges))
+	for _, r := range ranges {
+		if r != nil {
+			sorted = append(sorted, r)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return compareIP(sorted[i].First(), sorted[j].First()) < 0
+	})
+
+	ret := []*IPRange{}
+	first, last := net.IP(nil), net.IP(nil)
+	flush := func() {
+		if first == nil {
+			return
+		}
+		if first.Equal(last) {
+			ret = append(ret, NewIPRangeHost(first))
+		} else {
+			ret = append(ret, NewIPRange(first, last))
+		}
+	}
+
+	for _, r := range sorted {
+		rFirst, rLast := normalizeIP(r.First()), normalizeIP(r.Last())
+		if first != nil && len(rFirst) == len(last) &&
+			(compareIP(rFirst, last) <= 0 || (!isLastIP(last) && rFirst.Equal(IPNext(last)))) {
+			// overlapping or adjacent to the current interval
+			if compareIP(rLast, last) > 0 {
+				last = rLast
+			}
+			continue
+		}
+
+		flush()
+		first, last = rFirst, rLast
+	}
+	flush()
+
+	return ret
+}
+
+// Get the difference between two slices of normalized intervals, in terms of
+// the intervals to be added to and deleted from old to get new.
+func diffIPRanges(old []*IPRange, new []*IPRange) (added []*IPRange, deleted []*IPRange) {
+	key := func(r *IPRange) string {
+		return string(normalizeIP(r.First())) + string(normalizeIP(r.Last()))
+	}
+
+	oldKeys := make(map[string]bool, len(old))
+	for _, r := range old {
+		oldKeys[key(r)] = true
+	}
+	newKeys := make(map[string]bool, len(new))
+	for _, r := range new {
+		newKeys[key(r)] = true
+		if !oldKeys[key(r)] {
+			added = append(added, r)
+		}
+	}
+	for _, r := range old {
+		if !newKeys[key(r)] {
+			deleted = append(deleted, r)
+		}
+	}
+
+	return added, deleted
+}
+
 // func removeIPNet(nets []*net.IPNet, index int) []*net.IPNet {
 // 	return append(nets[:index], nets[index+1:]...)
 // }
@@ -210,6 +473,28 @@ func IPNext(ip net.IP) net.IP {
 // 	return ret
 // }
 
+// find in a slice of string
+func findString(strs []string, find string) int {
+	for i, str := range strs {
+		if str == find {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// remove a string from a slice of string, keeping the order
+func removeString(strs []string, remove string) []string {
+	ret := make([]string, 0, len(strs))
+	for _, str := range strs {
+		if str != remove {
+			ret = append(ret, str)
+		}
+	}
+	return ret
+}
+
 // remove specific index from a slice of IPRange
 func removeIPRange(ranges []*IPRange, index int) []*IPRange {
 	return append(ranges[:index], ranges[index+1:]...)
@@ -227,46 +512,208 @@ func findIPRange(ranges []*IPRange, find *IPRange) int {
 	return ret
 }
 
+// Convert non-overlapping intervals to elements of an interval set.
+//
+// Each interval is represented by an element at its first IP, and an element
+// flagged as interval end at its end IP. The end element is omitted if the
+// interval runs up to the last IP of the family.
 func setElementsFromIPRanges(nets []*IPRange) []nftables.SetElement {
 	ret := []nftables.SetElement{}
 	for _, member := range nets {
 		ret = append(ret, nftables.SetElement{
-			Key:    member.First(),
-			KeyEnd: member.End(),
+			Key: normalizeIP(member.First()),
 		})
+		if !isLastIP(normalizeIP(member.Last())) {
+			ret = append(ret, nftables.SetElement{
+				Key:         normalizeIP(member.End()),
+				IntervalEnd: true,
+			})
+		}
 	}
 	return ret
 }
 
-func (r *Router) MakeImmediateAddress(address *Address) (*nftables.Set, error) {
-	nft := r.nft
+// split a slice of IPRange into IPv4 and IPv6 ranges
+func splitIPRanges(ranges []*IPRange) (v4 []*IPRange, v6 []*IPRange) {
+	for _, r := range ranges {
+		if r.IsIPv6() {
+			v6 = append(v6, r)
+		} else {
+			v4 = append(v4, r)
+		}
+	}
+	return v4, v6
+}
+
+// The kernel representation of an Address.
+//
+// A set in nftables has a single key type, so an address spanning both
+// families is backed by one set per family. A nil set means the address has
+// no member in that family.
+type AddressSet struct {
+	V4 *nftables.Set
+	V6 *nftables.Set
+
+	// the sets are looked up inverted, matching anything except the members
+	Negate bool
+}
 
-	set := &nftables.Set{
-		Table:         r.table,
-		Concatenation: true,
-		Interval:      true,
-		Anonymous:     true,
-		Constant:      true,
-		KeyType:       nftables.TypeIPAddr,
+// Get the set of a specific family, which is either nftables.TableFamilyIPv4
+// or nftables.TableFamilyIPv6.
+func (s *AddressSet) Family(family nftables.TableFamily) *nftables.Set {
+	switch family {
+	case nftables.TableFamilyIPv4:
+		return s.V4
+	case nftables.TableFamilyIPv6:
+		return s.V6
+	default:
+		return nil
 	}
+}
 
-	if err := nft.AddSet(set, setElementsFromIPRanges(address.Immediate)); err != nil {
+// Get the families that a rule matching all of the given address sets has to
+// be compiled for. A nil AddressSet places no constraint on the family, and
+// if none of the sets constrain it, nftables.TableFamilyINet is returned
+// alone, meaning that a single family-agnostic rule is enough. A negated
+// AddressSet matches every family, but still needs a rule per family.
+func matchFamilies(sets ...*AddressSet) []nftables.TableFamily {
+	constrained := false
+	for _, set := range sets {
+		if set != nil {
+			constrained = true
+		}
+	}
+	if !constrained {
+		return []nftables.TableFamily{nftables.TableFamilyINet}
+	}
+
+	ret := []nftables.TableFamily{}
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		matched := true
+		for _, set := range sets {
+			if set != nil && !set.Negate && set.Family(family) == nil {
+				matched = false
+			}
+		}
+		if matched {
+			ret = append(ret, family)
+		}
+	}
+	return ret
+}
+
+// Replace nftables.TableFamilyINet in families with both IPv4 and IPv6, for
+// rules matching something of a single family, e.g. the TTL.
+func splitFamilies(families []nftables.TableFamily) []nftables.TableFamily {
+	ret := []nftables.TableFamily{}
+	for _, family := range families {
+		if family == nftables.TableFamilyINet {
+			ret = append(ret, nftables.TableFamilyIPv4, nftables.TableFamilyIPv6)
+		} else {
+			ret = append(ret, family)
+		}
+	}
+	return ret
+}
+
+func ipSetKeyType(family nftables.TableFamily) nftables.SetDatatype {
+	if family == nftables.TableFamilyIPv6 {
+		return nftables.TypeIP6Addr
+	}
+	return nftables.TypeIPAddr
+}
+
+func (r *Router) makeImmediateSet(family nftables.TableFamily, ranges []*IPRange) (*nftables.Set, error) {
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+
+	members := []string{}
+	for _, r := range ranges {
+		members = append(members, r.String())
+	}
+	key := fmt.Sprintf("ip%d:%s", family, strings.Join(members, ","))
+
+	return r.acquireSharedSet(key, ipSetKeyType(family), true, setElementsFromIPRanges(ranges))
+}
+
+// Get the sets holding immediate addresses, which are shared with other
+// entries having the same addresses. They are given back by
+// releaseSharedSets.
+func (r *Router) MakeImmediateAddress(address *Address) (*AddressSet, error) {
+	v4, v6 := splitIPRanges(mergeIPRanges(address.Immediate))
+
+	var err error
+	ret := &AddressSet{}
+	if ret.V4, err = r.makeImmediateSet(nftables.TableFamilyIPv4, v4); err != nil {
+		return nil, err
+	}
+	if ret.V6, err = r.makeImmediateSet(nftables.TableFamilyIPv6, v6); err != nil {
 		return nil, err
 	}
 
-	return set, nil
+	return ret, nil
 }
 
-func (r *Router) addressToSet(address *Address) (*nftables.Set, error) {
+func (r *Router) addressToSet(address *Address) (*AddressSet, error) {
+	var set *AddressSet
+
 	switch address.Type() {
 	case AddressIPSet:
 		ipset := r.FindIPSet(address.IPSet)
-		return ipset.set, nil
+		if ipset == nil {
+			return nil, fmt.Errorf("%w: %s", ErrIPSetNotFound, address.IPSet)
+		}
+		if ipset.set == nil {
+			// created but never updated, so it is not in the kernel yet
+			if err := r.UpdateIPSet(ipset); err != nil {
+				return nil, err
+			}
+		}
+		set = ipset.set
 	case AddressImmediate:
-		return r.MakeImmediateAddress(address)
+		immediate, err := r.MakeImmediateAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		set = immediate
+	case AddressFQDN:
+		ipset, err := r.fqdns.Track(address.FQDN)
+		if err != nil {
+			return nil, err
+		}
+		name := address.FQDN
+		r.acquireTrackedSet(ipset, func() { r.fqdns.untrack(name) })
+		set = ipset.set
+	case AddressGeo:
+		ipset, err := r.geo.Track(address.Country)
+		if err != nil {
+			return nil, err
+		}
+		country := address.Country
+		r.acquireTrackedSet(ipset, func() { r.geo.untrack(country) })
+		set = ipset.set
+	case AddressInterface, AddressInterfaceNet:
+		ipset, err := r.ifaddrs.Track(address.Interface, address.Type() == AddressInterfaceNet)
+		if err != nil {
+			return nil, err
+		}
+		r.acquireTrackedSet(ipset, func() { r.ifaddrs.untrack(ipset.name) })
+		set = ipset.set
 	default:
 		return nil, fmt.Errorf("unsupported address type")
 	}
+
+	if set == nil {
+		return nil, nil
+	}
+
+	// the sets of IPSets are shared, so the negation goes into a copy
+	return &AddressSet{
+		V4:     set.V4,
+		V6:     set.V6,
+		Negate: address.Negate,
+	}, nil
 }
 
 func (r *Router) NewIPSet(name string) *IPSet {
@@ -293,93 +740,688 @@ func (r *Router) FindIPSet(name string) *IPSet {
 	}
 }
 
+// Get all IPSets ordered by name.
+func (r *Router) IPSets() []*IPSet {
+	ret := make([]*IPSet, 0, len(r.ipsets))
+	for _, ipset := range r.ipsets {
+		ret = append(ret, ipset)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].name < ret[j].name })
+
+	return ret
+}
+
+// Rename an IPSet. The kernel sets are numbered rather than named after the
+// IPSet, so they are kept as is, and addresses of entries referring to the
+// old name are pointed to the new one.
+func (r *Router) RenameIPSet(name string, newName string) error {
+	ipset := r.FindIPSet(name)
+	if ipset == nil {
+		return ErrIPSetNotFound
+	}
+	if ipset.dynamic {
+		return ErrIPSetDynamic
+	}
+	if strings.TrimSpace(newName) == "" {
+		return fmt.Errorf("%w: %q", ErrIPSetNameInvalid, newName)
+	}
+	if name == newName {
+		return nil
+	}
+	if r.FindIPSet(newName) != nil {
+		return ErrIPSetNameDuplicated
+	}
+
+	r.stageIPSet(ipset)
+	delete(r.ipsets, name)
+	ipset.name = newName
+	r.ipsets[newName] = ipset
+
+	for _, parent := range r.ipsets {
+		if index := findString(parent.refs, name); index >= 0 {
+			r.stageIPSet(parent)
+			parent.refs[index] = newName
+		}
+	}
+
+	for _, address := range r.addresses() {
+		if address.Type() == AddressIPSet && address.IPSet == name {
+			address.IPSet = newName
+		}
+	}
+	r.refs.Rename(Object{Kind: ObjectIPSet, Name: name}, newName)
+
+	return nil
+}
+
+// Delete an IPSet along with its kernel sets. It is refused while entries or
+// other IPSets still refer to it, see DeleteIPSetCascade.
+func (r *Router) DeleteIPSet(name string) error {
+	ipset := r.FindIPSet(name)
+	if ipset == nil {
+		return ErrIPSetNotFound
+	}
+	if ipset.dynamic {
+		return ErrIPSetDynamic
+	}
+	if refs := r.IPSetReferences(name); len(refs) > 0 {
+		return fmt.Errorf("%w: used by %s", ErrIPSetReferred, describeReferences(refs))
+	}
+
+	if ipset.set != nil {
+		r.nft.DelSet(ipset.set.V4)
+		r.nft.DelSet(ipset.set.V6)
+		if err := r.Update(); err != nil {
+			return err
+		}
+	}
+
+	delete(r.ipsets, name)
+
+	return nil
+}
+
+// Delete an IPSet, removing the entries referring to it first, and dropping
+// it from the IPSets which include it.
+func (r *Router) DeleteIPSetCascade(name string) error {
+	ipset := r.FindIPSet(name)
+	if ipset == nil {
+		return ErrIPSetNotFound
+	}
+	if ipset.dynamic {
+		return ErrIPSetDynamic
+	}
+
+	refs := r.IPSetReferences(name)
+	if err := r.removeReferences(refs); err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if ref.Kind == ObjectIPSet {
+			parent := r.FindIPSet(ref.Name)
+			if err := r.UpdateIPSet(parent.DeleteIPSetRef(name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return r.DeleteIPSet(name)
+}
+
+// Get addresses of all entries in the router.
+func (r *Router) addresses() []*Address {
+	ret := []*Address{}
+	appendAddress := func(addresses ...*Address) {
+		for _, address := range addresses {
+			if address != nil {
+				ret = append(ret, address)
+			}
+		}
+	}
+
+	for _, policy := range r.Policies() {
+		appendAddress(policy.Source, policy.Destination)
+	}
+	for _, snat := range r.SNATRules() {
+		appendAddress(snat.Source, snat.Destination, snat.TargetAddress)
+	}
+
+	return ret
+}
+
+// Apply the changes made to an IPSet, registering it if it is not yet. The
+// IPSet and its parents go into the kernel in a single batch, and an IPSet
+// failing to update is left as it was before the changes.
 func (r *Router) UpdateIPSet(ipset *IPSet) error {
-	defer func() {
-		ipset.willAdd = nil
-		ipset.willDelete = nil
-	}()
+	if ipset.set != nil && len(ipset.willAdd) == 0 && len(ipset.willDelete) == 0 &&
+		len(ipset.willAddRef) == 0 && len(ipset.willDeleteRef) == 0 {
+		// nothing changed
+		return nil
+	}
+
+	tx := r.Begin()
+	if err := r.updateIPSet(ipset); err != nil {
+		tx.Rollback()
+		// restored by the rollback, unless the transaction is joined
+		ipset.revertPending()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
 
+	for key := range ipset.willAdd {
+		delete(ipset.willAdd, key)
+	}
+	for key := range ipset.willDelete {
+		delete(ipset.willDelete, key)
+	}
+	ipset.willAddRef = nil
+	ipset.willDeleteRef = nil
+
+	return nil
+}
+
+func (r *Router) updateIPSet(ipset *IPSet) error {
+	r.stageIPSet(ipset)
+	if _, err := r.flattenIPSet(ipset, map[string]bool{}); err != nil {
+		return err
+	}
+	if err := r.syncIPSet(ipset); err != nil {
+		return err
+	}
+
+	if _, ok := r.ipsets[ipset.name]; !ok {
+		r.ipsets[ipset.name] = ipset
+	}
+
+	// propagate the change into every parent set that uses it
+	for _, parent := range r.ipSetParents(ipset.name) {
+		if err := r.syncIPSet(parent); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get the members of an IPSet along with the ones of every IPSet it refers,
+// directly or indirectly. path holds the names of the IPSets being flattened
+// to detect cycles.
+func (r *Router) flattenIPSet(ipset *IPSet, path map[string]bool) ([]*IPRange, error) {
+	if path[ipset.name] {
+		return nil, fmt.Errorf("%w: %s", ErrIPSetCycle, ipset.name)
+	}
+	path[ipset.name] = true
+	defer delete(path, ipset.name)
+
+	ret := append([]*IPRange(nil), ipset.members...)
+	for _, ref := range ipset.refs {
+		child := r.FindIPSet(ref)
+		if child == nil {
+			return nil, fmt.Errorf("%w: %s", ErrIPSetNotFound, ref)
+		}
+
+		members, err := r.flattenIPSet(child, path)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, members...)
+	}
+
+	return ret, nil
+}
+
+// Get the IPSets referring a specific one, directly or indirectly.
+func (r *Router) ipSetParents(name string) []*IPSet {
+	ret := []*IPSet{}
+	visited := map[string]bool{name: true}
+	queue := []string{name}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, ipset := range r.IPSets() {
+			if !visited[ipset.name] && findString(ipset.refs, current) >= 0 {
+				visited[ipset.name] = true
+				queue = append(queue, ipset.name)
+				ret = append(ret, ipset)
+			}
+		}
+	}
+
+	return ret
+}
+
+// Set elements sent per netlink message, whose attributes are limited to 64 KiB.
+const setElementsChunk = 1024
+
+func (r *Router) setAddElements(set *nftables.Set, elements []nftables.SetElement) error {
+	for start := 0; start < len(elements); start += setElementsChunk {
+		end := start + setElementsChunk
+		if end > len(elements) {
+			end = len(elements)
+		}
+		if err := r.nft.SetAddElements(set, elements[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Router) setDeleteElements(set *nftables.Set, elements []nftables.SetElement) error {
+	for start := 0; start < len(elements); start += setElementsChunk {
+		end := start + setElementsChunk
+		if end > len(elements) {
+			end = len(elements)
+		}
+		if err := r.nft.SetDeleteElements(set, elements[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bring the kernel sets of an IPSet in line with its flattened members,
+// creating them if they do not exist yet.
+func (r *Router) syncIPSet(ipset *IPSet) error {
+	r.stageIPSet(ipset)
 	nft := r.nft
 
+	members, err := r.flattenIPSet(ipset, map[string]bool{})
+	if err != nil {
+		return err
+	}
+	elements := mergeIPRanges(members)
+
 	if ipset.set != nil {
-		// incremental update
-		willAdd := setElementsFromIPRanges(ipset.willAdd)
-		willDelete := setElementsFromIPRanges(ipset.willDelete)
+		// incremental update, only the intervals changed after normalization
+		// are sent to the kernel
+		willAdd, willDelete := diffIPRanges(ipset.elements, elements)
+		if len(willAdd) == 0 && len(willDelete) == 0 {
+			return nil
+		}
 
-		if len(willAdd) > 0 {
-			err := nft.SetAddElements(ipset.set, willAdd)
-			if err != nil {
+		addV4, addV6 := splitIPRanges(willAdd)
+		deleteV4, deleteV6 := splitIPRanges(willDelete)
+
+		for _, update := range []struct {
+			set        *nftables.Set
+			willAdd    []nftables.SetElement
+			willDelete []nftables.SetElement
+		}{
+			{ipset.set.V4, setElementsFromIPRanges(addV4), setElementsFromIPRanges(deleteV4)},
+			{ipset.set.V6, setElementsFromIPRanges(addV6), setElementsFromIPRanges(deleteV6)},
+		} {
+			// deletion goes first, since a changed interval may share its
+			// first IP with the old one
+			if err := r.setDeleteElements(update.set, update.willDelete); err != nil {
 				return err
 			}
-		}
-		if len(willDelete) > 0 {
-			err := nft.SetDeleteElements(ipset.set, willDelete)
-			if err != nil {
+			if err := r.setAddElements(update.set, update.willAdd); err != nil {
 				return err
 			}
 		}
 	} else {
-		// create a new set
-		elements := setElementsFromIPRanges(ipset.members)
+		// create a new set per family, both of them are always present so
+		// that members of any family can be added later on
+		v4, v6 := splitIPRanges(elements)
+
+		r.ipsetCounter++
+		set := &AddressSet{
+			V4: &nftables.Set{
+				Table:      r.table,
+				Name:       fmt.Sprintf("ipset-%d", r.ipsetCounter),
+				Interval:   true,
+				HasTimeout: ipset.timeout,
+				KeyType:    nftables.TypeIPAddr,
+			},
+			V6: &nftables.Set{
+				Table:      r.table,
+				Name:       fmt.Sprintf("ipset6-%d", r.ipsetCounter),
+				Interval:   true,
+				HasTimeout: ipset.timeout,
+				KeyType:    nftables.TypeIP6Addr,
+			},
+		}
 
-		ipset.set = &nftables.Set{
-			Table:    r.table,
-			Name:     fmt.Sprintf("ipset-%s", ipset.name),
-			Interval: true,
-			KeyType:  nftables.TypeIPAddr,
+		if err := nft.AddSet(set.V4, nil); err != nil {
+			return err
+		}
+		if err := nft.AddSet(set.V6, nil); err != nil {
+			return err
+		}
+		if err := r.setAddElements(set.V4, setElementsFromIPRanges(v4)); err != nil {
+			return err
+		}
+		if err := r.setAddElements(set.V6, setElementsFromIPRanges(v6)); err != nil {
+			return err
 		}
 
-		err := nft.AddSet(ipset.set, elements)
-		if err != nil {
+		if err := r.Update(); err != nil {
 			return err
 		}
+
+		ipset.set = set
 	}
 
 	if err := r.Update(); err != nil {
 		return err
 	}
 
-	ipset, ok := r.ipsets[ipset.name]
-	if !ok {
-		r.ipsets[ipset.name] = ipset
+	ipset.elements = elements
+
+	return nil
+}
+
+// Add an element which the kernel expires after ttl, or a permanent member if
+// ttl is zero. Adding an element again refreshes its TTL.
+//
+// Timed elements are not normalized along with the members, so they must not
+// overlap with them, and they are not propagated into parent IPSets.
+func (r *Router) AddIPSetElement(ipset *IPSet, iprange *IPRange, ttl time.Duration) error {
+	if ttl <= 0 {
+		return r.UpdateIPSet(ipset.AddIPRange(iprange))
+	}
+	if !ipset.timeout {
+		return ErrIPSetNoTimeout
+	}
+	r.stageIPSet(ipset)
+	if ipset.set == nil {
+		if err := r.UpdateIPSet(ipset); err != nil {
+			return err
+		}
+	}
+
+	family := nftables.TableFamilyIPv4
+	if iprange.IsIPv6() {
+		family = nftables.TableFamilyIPv6
+	}
+	set := ipset.set.Family(family)
+
+	// only the first element of an interval carries the timeout, the
+	// kernel refuses it on interval ends
+	elements := setElementsFromIPRanges([]*IPRange{iprange})
+	elements[0].Timeout = ttl
+
+	key := iprange.String()
+	refresh := func(deleteFirst bool) error {
+		if deleteFirst {
+			if err := r.nft.SetDeleteElements(set, setElementsFromIPRanges([]*IPRange{iprange})); err != nil {
+				return err
+			}
+		}
+		if err := r.nft.SetAddElements(set, elements); err != nil {
+			return err
+		}
+		return r.Update()
+	}
+
+	ipset.pruneTimed()
+	if _, ok := ipset.timed[key]; ok {
+		// the element may have expired in the meantime, then it is only
+		// added again
+		if err := refresh(true); err != nil {
+			if err := refresh(false); err != nil {
+				return err
+			}
+		}
+	} else if err := refresh(false); err != nil {
+		return err
+	}
+
+	if ipset.timed == nil {
+		ipset.timed = make(map[string]*TimedIPRange)
+	}
+	ipset.timed[key] = &TimedIPRange{
+		IPRange: iprange,
+		Expires: time.Now().Add(ttl),
 	}
 
 	return nil
 }
 
+// Record the state of IPSets about to be changed, if a transaction is open.
+func (r *Router) stageIPSet(ipsets ...*IPSet) {
+	if r.tx == nil {
+		return
+	}
+	for _, ipset := range ipsets {
+		r.tx.ipset(ipset)
+	}
+}
+
+// Copy the state of an IPSet, which is restored once a transaction is rolled
+// back.
+func (s *IPSet) clone() *IPSet {
+	ret := *s
+	ret.members = append([]*IPRange(nil), s.members...)
+	ret.elements = append([]*IPRange(nil), s.elements...)
+	ret.refs = append([]string(nil), s.refs...)
+	ret.willAddRef = append([]string(nil), s.willAddRef...)
+	ret.willDeleteRef = append([]string(nil), s.willDeleteRef...)
+	// the maps are made once the first member is added, so nil ones are kept
+	if s.memberKeys != nil {
+		ret.memberKeys = make(map[string]bool, len(s.memberKeys))
+		for key := range s.memberKeys {
+			ret.memberKeys[key] = true
+		}
+	}
+	if s.willAdd != nil {
+		ret.willAdd = make(map[string]*IPRange, len(s.willAdd))
+		for key, r := range s.willAdd {
+			ret.willAdd[key] = r
+		}
+	}
+	if s.willDelete != nil {
+		ret.willDelete = make(map[string]*IPRange, len(s.willDelete))
+		for key, r := range s.willDelete {
+			ret.willDelete[key] = r
+		}
+	}
+	if s.timed != nil {
+		ret.timed = make(map[string]*TimedIPRange, len(s.timed))
+		for key, timed := range s.timed {
+			ret.timed[key] = timed
+		}
+	}
+	return &ret
+}
+
+// Undo the changes of members and references not updated yet.
+func (s *IPSet) revertPending() {
+	for key, r := range s.willAdd {
+		if index := findIPRange(s.members, r); index >= 0 {
+			s.members = removeIPRange(s.members, index)
+		}
+		delete(s.memberKeys, key)
+		delete(s.willAdd, key)
+	}
+	for key, r := range s.willDelete {
+		s.members = append(s.members, r)
+		s.memberKeys[key] = true
+		delete(s.willDelete, key)
+	}
+	for _, ref := range s.willAddRef {
+		s.refs = removeString(s.refs, ref)
+	}
+	s.refs = append(s.refs, s.willDeleteRef...)
+	s.willAddRef = nil
+	s.willDeleteRef = nil
+}
+
+// forget the timed elements expired by the kernel
+func (s *IPSet) pruneTimed() {
+	now := time.Now()
+	for key, element := range s.timed {
+		if !element.Expires.After(now) {
+			delete(s.timed, key)
+		}
+	}
+}
+
 func (s *IPSet) Name() string {
 	return s.name
 }
 
+// Enable elements with a TTL. It has no effect once the kernel sets are
+// created.
+func (s *IPSet) SetTimeout(timeout bool) *IPSet {
+	if s.set == nil {
+		s.timeout = timeout
+	}
+	return s
+}
+
+func (s *IPSet) Timeout() bool {
+	return s.timeout
+}
+
+// Get the elements added with a TTL which have not expired yet, ordered by
+// their expiry.
+func (s *IPSet) TimedElements() []*TimedIPRange {
+	s.pruneTimed()
+
+	ret := make([]*TimedIPRange, 0, len(s.timed))
+	for _, element := range s.timed {
+		ret = append(ret, element)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Expires.Before(ret[j].Expires) })
+
+	return ret
+}
+
+// Get the members as they are entered.
 func (s *IPSet) Members() []*IPRange {
 	return s.members
 }
 
-func (s *IPSet) AddIPRange(r *IPRange) *IPSet {
-	if r == nil {
+// Get the names of IPSets referred by this one.
+func (s *IPSet) Refs() []string {
+	return s.refs
+}
+
+// Include the members of another IPSet, which is resolved on the update.
+func (s *IPSet) AddIPSetRef(name string) *IPSet {
+	if name == "" || findString(s.refs, name) >= 0 {
 		return s
 	}
 
-	if findIPRange(s.willAdd, r) >= 0 {
-		// already in the incremental addition list, do nothing
+	s.refs = append(s.refs, name)
+	if findString(s.willDeleteRef, name) >= 0 {
+		s.willDeleteRef = removeString(s.willDeleteRef, name)
+	} else {
+		s.willAddRef = append(s.willAddRef, name)
+	}
+
+	return s
+}
+
+func (s *IPSet) DeleteIPSetRef(name string) *IPSet {
+	if findString(s.refs, name) < 0 {
 		return s
 	}
 
-	index := findIPRange(s.members, r)
+	s.refs = removeString(s.refs, name)
+	if findString(s.willAddRef, name) >= 0 {
+		s.willAddRef = removeString(s.willAddRef, name)
+	} else {
+		s.willDeleteRef = append(s.willDeleteRef, name)
+	}
+
+	return s
+}
+
+// Check whether the members are maintained by yafw rather than the user.
+func (s *IPSet) Dynamic() bool {
+	return s.dynamic
+}
+
+// Get the members normalized into non-overlapping intervals, as they were
+// sent to the kernel on the last update.
+func (s *IPSet) Elements() []*IPRange {
+	return s.elements
+}
+
+func (s *IPSet) MarshalJSON() ([]byte, error) {
+	members := s.members
+	if members == nil {
+		members = []*IPRange{}
+	}
+
+	refs := s.refs
+	if refs == nil {
+		refs = []string{}
+	}
+
+	return json.Marshal(struct {
+		Name    string          `json:"name"`
+		Members []*IPRange      `json:"members"`
+		IPSets  []string        `json:"ipsets"`
+		Dynamic bool            `json:"dynamic"`
+		Timeout bool            `json:"timeout"`
+		Timed   []*TimedIPRange `json:"timed"`
+	}{
+		Name:    s.name,
+		Members: members,
+		IPSets:  refs,
+		Dynamic: s.dynamic,
+		Timeout: s.timeout,
+		Timed:   s.TimedElements(),
+	})
+}
+
+// Get a key identifying an IPRange, two ranges have the same key if they are
+// Equal.
+func ipRangeKey(r *IPRange) string {
+	return fmt.Sprintf("%d:%s", r.Type(), r.String())
+}
+
+func (s *IPSet) AddIPRange(r *IPRange) *IPSet {
+	if r == nil {
+		return s
+	}
+	if s.memberKeys == nil {
+		s.memberKeys = make(map[string]bool)
+		s.willAdd = make(map[string]*IPRange)
+		s.willDelete = make(map[string]*IPRange)
+	}
+
+	key := ipRangeKey(r)
 
-	if index < 0 {
+	if !s.memberKeys[key] {
 		// not found in our members, add it
 		s.members = append(s.members, r)
+		s.memberKeys[key] = true
 
-		// append it in the incremental addition list
-		s.willAdd = append(s.willAdd, r)
+		// put it in the incremental addition list, and remove it from the
+		// incremental deletion list
+		s.willAdd[key] = r
+		delete(s.willDelete, key)
+	}
+
+	return s
+}
+
+// Replace all members with the given ranges, keeping track of the changes
+// for the incremental update.
+func (s *IPSet) ReplaceIPRanges(ranges []*IPRange) *IPSet {
+	if s.memberKeys == nil {
+		s.willAdd = make(map[string]*IPRange)
+		s.willDelete = make(map[string]*IPRange)
+	}
+
+	members := make([]*IPRange, 0, len(ranges))
+	memberKeys := make(map[string]bool, len(ranges))
+	for _, r := range ranges {
+		if r == nil {
+			continue
+		}
 
-		// lookup in the incremental deletion list, remove if found
-		if index := findIPRange(s.willDelete, r); index != -1 {
-			s.willDelete = removeIPRange(s.willDelete, index)
+		key := ipRangeKey(r)
+		if memberKeys[key] {
+			continue
+		}
+		members = append(members, r)
+		memberKeys[key] = true
+
+		if !s.memberKeys[key] {
+			s.willAdd[key] = r
+			delete(s.willDelete, key)
 		}
 	}
 
+	for _, member := range s.members {
+		key := ipRangeKey(member)
+		if !memberKeys[key] {
+			s.willDelete[key] = member
+			delete(s.willAdd, key)
+		}
+	}
+
+	s.members = members
+	s.memberKeys = memberKeys
+
 	return s
 }
 
@@ -388,24 +1430,19 @@ func (s *IPSet) DeleteIPRange(r *IPRange) *IPSet {
 		return s
 	}
 
-	if findIPRange(s.willDelete, r) >= 0 {
-		// already in the incremental deletion list, do nothing
-		return s
-	}
+	key := ipRangeKey(r)
 
-	index := findIPRange(s.members, r)
-
-	if index >= 0 {
+	if s.memberKeys[key] {
 		// found in our members, remove it
-		s.members = removeIPRange(s.members, index)
-
-		// append it in the incremental deletion list
-		s.willDelete = append(s.willDelete, r)
-
-		// lookup in the incremental addition list, remove if found
-		if index := findIPRange(s.willAdd, r); index != -1 {
-			s.willAdd = removeIPRange(s.willAdd, index)
+		if index := findIPRange(s.members, r); index >= 0 {
+			s.members = removeIPRange(s.members, index)
 		}
+		delete(s.memberKeys, key)
+
+		// put it in the incremental deletion list, and remove it from the
+		// incremental addition list
+		s.willDelete[key] = r
+		delete(s.willAdd, key)
 	}
 
 	return s
@@ -427,10 +1464,19 @@ type IPRange struct {
 	last  net.IP
 }
 
+// Normalize an IP to its canonical length: 4 bytes for IPv4 and 16 bytes for
+// IPv6. It returns nil if ip is not a valid IP.
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
 func NewIPRangeHost(host net.IP) *IPRange {
 	return &IPRange{
 		t:     IPRangeHost,
-		first: host,
+		first: normalizeIP(host),
 	}
 }
 
@@ -444,46 +1490,45 @@ func NewIPRangeNet(net *net.IPNet) *IPRange {
 func NewIPRange(first net.IP, last net.IP) *IPRange {
 	return &IPRange{
 		t:     IPRangeInterval,
-		first: first,
-		last:  last,
+		first: normalizeIP(first),
+		last:  normalizeIP(last),
 	}
 }
 
+// Parse an IPRange from a host ("192.168.1.1", "fd00::1"), a CIDR
+// ("192.168.1.0/24", "fd00::/64") or an interval ("192.168.1.1-192.168.1.10").
+// Both ends of an interval must be of the same family.
 func NewIPRangeString(ip string) *IPRange {
-	trial := net.ParseIP(ip).To4()
-	if trial != nil && trial.To4() != nil {
+	trial := normalizeIP(net.ParseIP(ip))
+	if trial != nil {
 		return &IPRange{
 			t:     IPRangeHost,
-			first: trial.To4(),
+			first: trial,
 		}
 	}
 
 	trial, trialNet, err := net.ParseCIDR(ip)
-	if trialNet != nil && trial.To4() != nil {
+	if trialNet != nil {
 		return &IPRange{
 			t:   IPRangeNet,
 			net: trialNet,
 
 			// unused
-			first: trial.To4(),
+			first: normalizeIP(trial),
 		}
 	}
 
 	if err != nil && strings.Contains(ip, "-") {
 		interval := strings.Split(ip, "-")
 		if len(interval) == 2 {
-			first := net.ParseIP(strings.TrimSpace(interval[0]))
-			last := net.ParseIP(strings.TrimSpace(interval[1]))
-
-			if first != nil && last != nil {
-				first = first.To4()
-				last = last.To4()
-				if first != nil && last != nil {
-					return &IPRange{
-						t:     IPRangeInterval,
-						first: first,
-						last:  last,
-					}
+			first := normalizeIP(net.ParseIP(strings.TrimSpace(interval[0])))
+			last := normalizeIP(net.ParseIP(strings.TrimSpace(interval[1])))
+
+			if first != nil && last != nil && len(first) == len(last) {
+				return &IPRange{
+					t:     IPRangeInterval,
+					first: first,
+					last:  last,
 				}
 			}
 		}
@@ -539,6 +1584,11 @@ func (r *IPRange) End() net.IP {
 	}
 }
 
+// IsIPv6 reports whether the range consists of IPv6 addresses.
+func (r *IPRange) IsIPv6() bool {
+	return r.First().To4() == nil
+}
+
 func (r *IPRange) Equal(e *IPRange) bool {
 	return r.Type() == e.Type() &&
 		r.First().Equal(e.First()) &&
@@ -566,7 +1616,7 @@ func (r *IPRange) UnmarshalJSON(data []byte) error {
 
 	temp := NewIPRangeString(s)
 
-	if temp != nil {
+	if temp == nil {
 		return fmt.Errorf("cannot unmarshal %s to IPRange", string(data))
 	}
 
@@ -1,9 +1,14 @@
 package yafw
 
 import (
+	"encoding/json"
+	"errors"
 	"net"
 	"os/exec"
 	"testing"
+	"time"
+
+	"github.com/google/nftables/expr"
 )
 
 func TestIPNetLast(t *testing.T) {
@@ -35,6 +40,10 @@ func TestIPNetEnd(t *testing.T) {
 		{"0.0.0.0/0", "0.0.0.0"},
 		{"192.168.1.0/24", "192.168.2.0"},
 		{"10.255.255.0/24", "11.0.0.0"},
+		{"10.0.1.0/24", "10.0.2.0"},
+		{"172.16.0.0/12", "172.32.0.0"},
+		{"fd00::/64", "fd00:0:0:1::"},
+		{"::/0", "::"},
 	}
 
 	for _, w := range want {
@@ -84,7 +93,7 @@ func TestIPSet(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	elements, err := router.nft.GetSetElements(ipset.set)
+	elements, err := router.query.GetSetElements(ipset.set.V4)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -93,9 +102,337 @@ func TestIPSet(t *testing.T) {
 		t.Logf("%v", element)
 	}
 
-	out, err := exec.Command("nft", "list", "set", "ip", "yafw", "ipset-test-ipset").CombinedOutput()
+	out, err := exec.Command("nft", "list", "set", "inet", "yafw", ipset.set.V4.Name).CombinedOutput()
 	t.Logf("NFT Output:\n%s\n", out)
 	if err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestNewIPRangeString(t *testing.T) {
+	want := []struct {
+		input string
+		first string
+		last  string
+		v6    bool
+	}{
+		{"192.168.1.1", "192.168.1.1", "192.168.1.1", false},
+		{"192.168.1.0/24", "192.168.1.0", "192.168.1.255", false},
+		{"192.168.6.0-192.168.6.120", "192.168.6.0", "192.168.6.120", false},
+		{"fd00::1", "fd00::1", "fd00::1", true},
+		{"fd00::/64", "fd00::", "fd00::ffff:ffff:ffff:ffff", true},
+		{"fd00::1-fd00::ff", "fd00::1", "fd00::ff", true},
+	}
+
+	for _, w := range want {
+		r := NewIPRangeString(w.input)
+		if r == nil {
+			t.Fatalf("test assert error: NewIPRangeString(%s) = nil", w.input)
+		}
+		if !r.First().Equal(net.ParseIP(w.first)) || !r.Last().Equal(net.ParseIP(w.last)) || r.IsIPv6() != w.v6 {
+			t.Fatalf("test assert error: NewIPRangeString(%s) = %v-%v (expecting %s-%s)", w.input, r.First(), r.Last(), w.first, w.last)
+		}
+	}
+
+	for _, invalid := range []string{"", "192.168.1.1-fd00::1", "not-an-ip", "192.168.1.0/33"} {
+		if r := NewIPRangeString(invalid); r != nil {
+			t.Fatalf("test assert error: NewIPRangeString(%s) = %v (expecting nil)", invalid, r)
+		}
+	}
+}
+
+func TestIPSetRename(t *testing.T) {
+	router := newTestRouter()
+
+	ipset := router.NewIPSet("servers")
+	if err := router.UpdateIPSet(ipset); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := &Policy{Source: NewAddressIPSet("servers")}
+	if err := router.PolicyTable().Append(policy); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := router.RenameIPSet("servers", " "); !errors.Is(err, ErrIPSetNameInvalid) {
+		t.Fatalf("test assert error: RenameIPSet = %v (expecting %v)", err, ErrIPSetNameInvalid)
+	}
+	if err := router.RenameIPSet("servers", "web-servers"); err != nil {
+		t.Fatal(err)
+	}
+	if router.FindIPSet("servers") != nil || router.FindIPSet("web-servers") != ipset {
+		t.Fatalf("test assert error: ipset not renamed")
+	}
+	if policy.Source.IPSet != "web-servers" {
+		t.Fatalf("test assert error: policy source = %s (expecting web-servers)", policy.Source.IPSet)
+	}
+
+	if err := router.DeleteIPSet("web-servers"); err == nil {
+		t.Fatalf("test assert error: ipset in use deleted")
+	}
+
+	// a new IPSet of the old name gets kernel sets of its own
+	ipset.AddIPRange(NewIPRangeString("10.0.0.1"))
+	if err := router.UpdateIPSet(ipset); err != nil {
+		t.Fatal(err)
+	}
+	servers := router.NewIPSet("servers").AddIPRange(NewIPRangeString("10.0.0.2"))
+	if err := router.UpdateIPSet(servers); err != nil {
+		t.Fatal(err)
+	}
+	if servers.set.V4.Name == ipset.set.V4.Name {
+		t.Fatalf("test assert error: kernel set %s shared after rename", servers.set.V4.Name)
+	}
+	if err := router.DeleteIPSet("servers"); err != nil {
+		t.Fatal(err)
+	}
+	elements, err := router.query.GetSetElements(ipset.set.V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elements) == 0 {
+		t.Fatalf("test assert error: kernel set of the renamed ipset emptied")
+	}
+	assertConsistent(t, router)
+}
+
+func TestMergeIPRanges(t *testing.T) {
+	want := []struct {
+		input  []string
+		merged []string
+	}{
+		{[]string{"192.168.233.1/32", "192.168.233.0/24"}, []string{"192.168.233.0-192.168.233.255"}},
+		{[]string{"192.168.1.0/24", "192.168.2.0/24", "192.168.4.1"}, []string{"192.168.1.0-192.168.2.255", "192.168.4.1"}},
+		{[]string{"10.0.0.5-10.0.0.20", "10.0.0.1-10.0.0.10", "fd00::/64", "fd00::1"}, []string{"10.0.0.1-10.0.0.20", "fd00::-fd00::ffff:ffff:ffff:ffff"}},
+		{[]string{"255.255.255.255", "255.255.255.0/24"}, []string{"255.255.255.0-255.255.255.255"}},
+	}
+
+	for _, w := range want {
+		ranges := []*IPRange{}
+		for _, input := range w.input {
+			ranges = append(ranges, NewIPRangeString(input))
+		}
+
+		merged := mergeIPRanges(ranges)
+		if len(merged) != len(w.merged) {
+			t.Fatalf("test assert error: mergeIPRanges(%v) = %v (expecting %v)", w.input, merged, w.merged)
+		}
+		for i := range merged {
+			if merged[i].String() != w.merged[i] {
+				t.Fatalf("test assert error: mergeIPRanges(%v) = %v (expecting %v)", w.input, merged, w.merged)
+			}
+		}
+	}
+}
+
+func TestIPSetIncremental(t *testing.T) {
+	router := newTestRouter()
+
+	ipset := router.NewIPSet("test-incremental")
+	ipset.AddIPRange(NewIPRangeString("192.168.233.0/24"))
+	ipset.AddIPRange(NewIPRangeString("192.168.233.1"))
+	ipset.AddIPRange(NewIPRangeString("fd00::/64"))
+	if err := router.UpdateIPSet(ipset); err != nil {
+		t.Fatal(err)
+	}
+
+	ipset.DeleteIPRange(NewIPRangeString("192.168.233.0/24"))
+	ipset.AddIPRange(NewIPRangeString("192.168.234.0/24"))
+	if err := router.UpdateIPSet(ipset); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ipset.Members()) != 3 || len(ipset.Elements()) != 3 {
+		t.Fatalf("test assert error: members %v, elements %v", ipset.Members(), ipset.Elements())
+	}
+
+	elements, err := router.query.GetSetElements(ipset.set.V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 192.168.233.1 and 192.168.234.0/24, each with an interval end
+	if len(elements) != 4 {
+		t.Fatalf("test assert error: %d elements in kernel (expecting 4)", len(elements))
+	}
+}
+
+func TestIPSetNested(t *testing.T) {
+	router := newTestRouter()
+
+	for _, name := range []string{"servers", "clients", "all"} {
+		if err := router.UpdateIPSet(router.NewIPSet(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	servers, clients, all := router.FindIPSet("servers"), router.FindIPSet("clients"), router.FindIPSet("all")
+	servers.AddIPRange(NewIPRangeString("192.168.234.0/24"))
+	if err := router.UpdateIPSet(servers); err != nil {
+		t.Fatal(err)
+	}
+	clients.AddIPSetRef("servers").AddIPRange(NewIPRangeString("192.168.235.0/24"))
+	if err := router.UpdateIPSet(clients); err != nil {
+		t.Fatal(err)
+	}
+	all.AddIPSetRef("clients").AddIPRange(NewIPRangeString("fd00::/64"))
+	if err := router.UpdateIPSet(all); err != nil {
+		t.Fatal(err)
+	}
+
+	// servers <- clients <- all, then 192.168.234.0/24 and 192.168.235.0/24
+	// are merged
+	if len(all.Elements()) != 2 {
+		t.Fatalf("test assert error: elements %v", all.Elements())
+	}
+
+	// a change of the child propagates into every parent
+	servers.AddIPRange(NewIPRangeString("10.0.0.1"))
+	if err := router.UpdateIPSet(servers); err != nil {
+		t.Fatal(err)
+	}
+	if len(clients.Elements()) != 2 || len(all.Elements()) != 3 {
+		t.Fatalf("test assert error: clients %v, all %v", clients.Elements(), all.Elements())
+	}
+
+	// a reference forming a cycle or missing is rejected along with the
+	// members changed with it, which are given again on a retry
+	servers.AddIPSetRef("all").AddIPRange(NewIPRangeString("10.0.0.9"))
+	if err := router.UpdateIPSet(servers); !errors.Is(err, ErrIPSetCycle) {
+		t.Fatalf("test assert error: UpdateIPSet = %v (expecting %v)", err, ErrIPSetCycle)
+	}
+	if len(servers.Refs()) != 0 || len(servers.Members()) != 2 {
+		t.Fatalf("test assert error: refs %v, members %v", servers.Refs(), servers.Members())
+	}
+	servers.AddIPSetRef("missing").DeleteIPRange(servers.Members()[0])
+	if err := router.UpdateIPSet(servers); !errors.Is(err, ErrIPSetNotFound) {
+		t.Fatalf("test assert error: UpdateIPSet = %v (expecting %v)", err, ErrIPSetNotFound)
+	}
+	if len(servers.Refs()) != 0 || len(servers.Members()) != 2 {
+		t.Fatalf("test assert error: refs %v, members %v", servers.Refs(), servers.Members())
+	}
+	if err := router.UpdateIPSet(servers.AddIPRange(NewIPRangeString("10.0.0.9"))); err != nil {
+		t.Fatal(err)
+	}
+	if len(servers.Elements()) != 3 || len(all.Elements()) != 4 {
+		t.Fatalf("test assert error: servers %v, all %v after retry", servers.Elements(), all.Elements())
+	}
+
+	// an IPSet not registered yet is registered by its update
+	if err := router.UpdateIPSet(&IPSet{name: "unregistered"}); err != nil {
+		t.Fatal(err)
+	}
+	if router.FindIPSet("unregistered") == nil {
+		t.Fatalf("test assert error: ipset not registered by its update")
+	}
+
+	if err := router.DeleteIPSet("servers"); !errors.Is(err, ErrIPSetReferred) {
+		t.Fatalf("test assert error: DeleteIPSet = %v (expecting %v)", err, ErrIPSetReferred)
+	}
+}
+
+func TestAddressJSON(t *testing.T) {
+	want := []struct {
+		json   string
+		t      AddressType
+		negate bool
+	}{
+		{`["192.168.1.0/24","fd00::1"]`, AddressImmediate, false},
+		{`"servers"`, AddressIPSet, false},
+		{`"fqdn:updates.example.com"`, AddressFQDN, false},
+		{`"iface:eth0"`, AddressInterface, false},
+		{`"iface-net:eth0"`, AddressInterfaceNet, false},
+		{`{"negate":true,"address":["192.168.1.0/24"]}`, AddressImmediate, true},
+		{`{"negate":true,"address":"servers"}`, AddressIPSet, true},
+	}
+
+	for _, w := range want {
+		address := &Address{}
+		if err := json.Unmarshal([]byte(w.json), address); err != nil {
+			t.Fatalf("error unmarshal %s: %v", w.json, err)
+		}
+		if address.Type() != w.t || address.Negate != w.negate {
+			t.Fatalf("test assert error: unmarshal %s = %v", w.json, address)
+		}
+
+		data, err := json.Marshal(address)
+		if err != nil {
+			t.Fatalf("error marshal %v: %v", address, err)
+		}
+		if string(data) != w.json {
+			t.Fatalf("test assert error: marshal %v = %s (expecting %s)", address, data, w.json)
+		}
+	}
+}
+
+func TestNegatedAddress(t *testing.T) {
+	router := newTestRouter()
+
+	policy := &Policy{
+		Source: &Address{
+			t:         AddressImmediate,
+			Immediate: []*IPRange{NewIPRangeString("192.168.1.0/24")},
+			Negate:    true,
+		},
+	}
+	if err := router.PolicyTable().Append(policy); err != nil {
+		t.Fatal(err)
+	}
+
+	// any IPv4 source except 192.168.1.0/24, and any IPv6 source
+	rules, err := policy.ToRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("test assert error: %d rules (expecting 2)", len(rules))
+	}
+
+	inverted := 0
+	for _, rule := range rules {
+		for _, e := range rule.Exprs {
+			if lookup, ok := e.(*expr.Lookup); ok && lookup.Invert {
+				inverted++
+			}
+		}
+	}
+	if inverted != 1 {
+		t.Fatalf("test assert error: %d inverted lookups (expecting 1)", inverted)
+	}
+}
+
+func TestIPSetTimeout(t *testing.T) {
+	router := newTestRouter()
+
+	ipset := router.NewIPSet("blocklist").SetTimeout(true)
+	if err := router.UpdateIPSet(ipset); err != nil {
+		t.Fatal(err)
+	}
+
+	attacker := NewIPRangeString("203.0.113.7")
+	if err := router.AddIPSetElement(ipset, attacker, 30*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// adding it again refreshes the TTL
+	if err := router.AddIPSetElement(ipset, attacker, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	timed := ipset.TimedElements()
+	if len(timed) != 1 || timed[0].Remaining() <= 30*time.Minute {
+		t.Fatalf("test assert error: timed elements %v", timed)
+	}
+
+	elements, err := router.query.GetSetElements(ipset.set.V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, element := range elements {
+		if !element.IntervalEnd && element.Timeout != time.Hour {
+			t.Fatalf("test assert error: element timeout %v (expecting 1h0m0s)", element.Timeout)
+		}
+	}
+
+	if err := router.AddIPSetElement(router.NewIPSet("permanent"), attacker, time.Minute); !errors.Is(err, ErrIPSetNoTimeout) {
+		t.Fatalf("test assert error: AddIPSetElement = %v (expecting %v)", err, ErrIPSetNoTimeout)
+	}
+}
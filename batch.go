@@ -0,0 +1,109 @@
+package yafw
+
+import (
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// The nftables library sends a batch as a single write, which the kernel
+// rejects once it is beyond the send buffer of the socket, e.g. for a feed
+// of 100k+ entries. So the connection of the router only records the batch
+// it is given, which the router sends through a socket of its own with a
+// buffer large enough, and the kernel state is read through another
+// connection.
+
+// The send buffer of the socket batches are sent through.
+const batchWriteBuffer = 256 << 20
+
+// A recorder of the batches flushed by an nftables connection.
+type batchRecorder struct {
+	messages []netlink.Message
+}
+
+// Record the messages sent by the connection, standing in for the socket it
+// dials, which replies nothing.
+func (b *batchRecorder) record(req []netlink.Message) ([]netlink.Message, error) {
+	b.messages = append(b.messages, req...)
+	return nil, nil
+}
+
+// Take the messages recorded so far.
+func (b *batchRecorder) take() []netlink.Message {
+	messages := b.messages
+	b.messages = nil
+	return messages
+}
+
+// Create a connection recording its batches, instead of sending them.
+func newBatchConn(recorder *batchRecorder) *nftables.Conn {
+	nft, _ := nftables.New(nftables.WithTestDial(recorder.record))
+	return nft
+}
+
+func (r *Router) dialNetfilter() (*netlink.Conn, error) {
+	return netlink.Dial(unix.NETLINK_NETFILTER, &netlink.Config{NetNS: int(r.ns)})
+}
+
+// Wrap messages into a batch, which is committed at once.
+func wrapBatch(messages []netlink.Message) []netlink.Message {
+	batch := []netlink.Message{{
+		Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_MSG_BATCH_BEGIN), Flags: netlink.Request},
+		Data:   nfgenHeader(0, unix.NFNL_SUBSYS_NFTABLES),
+	}}
+	batch = append(batch, messages...)
+	return append(batch, netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_MSG_BATCH_END), Flags: netlink.Request},
+		Data:   nfgenHeader(0, unix.NFNL_SUBSYS_NFTABLES),
+	})
+}
+
+// Raise the send buffer of a socket. The limit of the system is bypassed
+// when the process is allowed to, and caps the buffer otherwise.
+func setWriteBuffer(conn *netlink.Conn, bytes int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var forced error
+	if err := raw.Control(func(fd uintptr) {
+		forced = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUFFORCE, bytes)
+	}); err != nil {
+		return err
+	}
+	if forced != nil {
+		return conn.SetWriteBuffer(bytes)
+	}
+	return nil
+}
+
+// Send a batch, which is committed at once, and wait for the replies
+// acknowledging its messages.
+func (r *Router) sendBatch(batch []netlink.Message) error {
+	conn, err := r.dialNetfilter()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := setWriteBuffer(conn, batchWriteBuffer); err != nil {
+		return err
+	}
+
+	for i := range batch {
+		// recorded messages carry the port of the recorder
+		batch[i].Header.PID = 0
+	}
+	if _, err := conn.SendMessages(batch); err != nil {
+		return err
+	}
+	for _, message := range batch {
+		if message.Header.Flags&netlink.Acknowledge == 0 {
+			continue
+		}
+		if _, err := conn.Receive(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -1,17 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sigeryang/yafw"
@@ -54,10 +58,80 @@ func APIPutInterface(c *gin.Context) {
 	// TODO: ...
 }
 
+// A policy along with the nft rules it is compiled into, their counters and
+// the consumption of its quota.
+type PolicyView struct {
+	*yafw.Policy
+	*yafw.EntryCounters
+	QuotaUsage *yafw.QuotaUsage `json:"quota_usage,omitempty"`
+	CompiledAs []string         `json:"compiled_as"`
+}
+
 func APIGetPolicies(c *gin.Context) {
 	policies := router.Policies()
+	counters, err := router.PolicyTable().AllCounters()
+	if err != nil {
+		APIError(c, http.StatusInternalServerError, err)
+		return
+	}
 
-	c.JSON(http.StatusOK, policies)
+	views := make([]*PolicyView, 0, len(policies))
+	for _, policy := range policies {
+		view := &PolicyView{Policy: policy, EntryCounters: counters[policy.ID], CompiledAs: []string{}}
+		if policy.Quota != nil {
+			if view.QuotaUsage, err = router.QuotaTable().Usage(policy.ID); err != nil {
+				APIError(c, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		rules, err := router.PolicyTable().Compiled(policy.ID)
+		if err != nil {
+			APIError(c, http.StatusInternalServerError, err)
+			return
+		}
+		for _, rule := range rules {
+			view.CompiledAs = append(view.CompiledAs, rule.String())
+		}
+		views = append(views, view)
+	}
+
+	c.JSON(http.StatusOK, views)
+}
+
+// Get the decompiled rules of a policy, with their statements.
+func APIGetPolicyCompiled(c *gin.Context) {
+	index, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		APIError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	rules, err := router.PolicyTable().Compiled(index)
+	if err != nil {
+		APIError(c, http.StatusNotFound, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, rules)
+}
+
+// Compare the kernel rules of every entry with what it is compiled into.
+func APIVerify(c *gin.Context) {
+	verifications, err := router.VerifyEntries()
+	if err != nil {
+		APIError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	ok := true
+	for _, verification := range verifications {
+		ok = ok && verification.OK
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":      ok,
+		"entries": verifications,
+	})
 }
 
 func APIError(c *gin.Context, code int, err error) {
@@ -67,6 +141,21 @@ func APIError(c *gin.Context, code int, err error) {
 	})
 }
 
+// Get the HTTP status of an error about references between entries and
+// objects, or fallback for other errors.
+func referenceErrorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, yafw.ErrIPSetNotFound), errors.Is(err, yafw.ErrMACSetNotFound),
+		errors.Is(err, yafw.ErrZoneNotFound), errors.Is(err, yafw.ErrScheduleNotFound):
+		return http.StatusBadRequest
+	case errors.Is(err, yafw.ErrIPSetReferred), errors.Is(err, yafw.ErrMACSetReferred),
+		errors.Is(err, yafw.ErrZoneReferred), errors.Is(err, yafw.ErrScheduleReferred):
+		return http.StatusConflict
+	default:
+		return fallback
+	}
+}
+
 func APIPostPolicies(c *gin.Context) {
 	var p yafw.Policy
 	if err := c.BindJSON(&p); err != nil {
@@ -92,7 +181,7 @@ func APIPostPolicies(c *gin.Context) {
 		err = router.PolicyTable().Append(&p)
 	}
 	if err != nil {
-		APIError(c, http.StatusInternalServerError, err)
+		APIError(c, referenceErrorStatus(err, http.StatusInternalServerError), err)
 	} else {
 		c.JSON(http.StatusOK, gin.H{"ok": true})
 	}
@@ -123,7 +212,7 @@ func APIPutPolicy(c *gin.Context) {
 	p.SetIndex(index)
 
 	if err := router.PolicyTable().Update(&p, beforeIndex); err != nil {
-		APIError(c, http.StatusInternalServerError, err)
+		APIError(c, referenceErrorStatus(err, http.StatusInternalServerError), err)
 	} else {
 		c.JSON(http.StatusOK, gin.H{"ok": true})
 	}
@@ -142,22 +231,744 @@ func APIDeletePolicy(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
 
+// An SNAT rule along with its counters.
+type SNATRuleView struct {
+	*yafw.SNATRule
+	*yafw.EntryCounters
+}
+
 func APIGetNAT(c *gin.Context) {
-	c.JSON(http.StatusOK, router.SNATRules())
+	counters, err := router.SNATRuleTable().AllCounters()
+	if err != nil {
+		APIError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	views := []*SNATRuleView{}
+	for _, snat := range router.SNATRules() {
+		views = append(views, &SNATRuleView{SNATRule: snat, EntryCounters: counters[snat.ID]})
+	}
+
+	c.JSON(http.StatusOK, views)
+}
+
+// Count the hits of an entry from 0 again.
+func APIPostResetCounters(table func() *yafw.EntryTable) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		index, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			APIError(c, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := table().ResetCounters(index); err != nil {
+			if errors.Is(err, yafw.ErrEntryIndexNotFound) {
+				APIError(c, http.StatusNotFound, err)
+			} else {
+				APIError(c, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+// A move of entries, placing them before or after another entry, or at the
+// top or the bottom of their table. Exactly one of Before, After and To is
+// given.
+type MoveRequest struct {
+	// other entries moved along with the one in the path, placed after it in
+	// the order they are given
+	With   []int `json:"with"`
+	Before *int  `json:"before"`
+	After  *int  `json:"after"`
+	// "top" or "bottom"
+	To string `json:"to"`
+}
+
+func APIPostMove(table func() *yafw.EntryTable) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		index, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			APIError(c, http.StatusBadRequest, err)
+			return
+		}
+
+		var move MoveRequest
+		if err := c.BindJSON(&move); err != nil {
+			APIError(c, http.StatusBadRequest, err)
+			return
+		}
+		indexes := append([]int{index}, move.With...)
+
+		switch {
+		case move.Before != nil && move.After == nil && move.To == "":
+			err = table().MoveBefore(*move.Before, indexes...)
+		case move.After != nil && move.Before == nil && move.To == "":
+			err = table().MoveAfter(*move.After, indexes...)
+		case move.To == "top" && move.Before == nil && move.After == nil:
+			err = table().MoveToTop(indexes...)
+		case move.To == "bottom" && move.Before == nil && move.After == nil:
+			err = table().MoveToBottom(indexes...)
+		default:
+			err = fmt.Errorf("%w: one of before, after or to (top or bottom) is expected", yafw.ErrEntryMoveInvalid)
+		}
+
+		switch {
+		case err == nil:
+			c.JSON(http.StatusOK, gin.H{"ok": true})
+		case errors.Is(err, yafw.ErrEntryIndexNotFound):
+			APIError(c, http.StatusNotFound, err)
+		case errors.Is(err, yafw.ErrEntryMoveInvalid):
+			APIError(c, http.StatusBadRequest, err)
+		default:
+			APIError(c, http.StatusInternalServerError, err)
+		}
+	}
+}
+
+// Enable or disable an entry, which keeps its position and ID.
+func APIPostEnabled(table func() *yafw.EntryTable, enabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		index, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			APIError(c, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := table().SetEnabled(enabled, index); err != nil {
+			if errors.Is(err, yafw.ErrEntryIndexNotFound) {
+				APIError(c, http.StatusNotFound, err)
+			} else {
+				APIError(c, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+func APIGetQuotas(c *gin.Context) {
+	quotas, err := router.QuotaTable().All()
+	if err != nil {
+		APIError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, quotas)
+}
+
+// Reset the consumption of the quota of a policy, returning the consumption
+// before.
+func APIPostResetQuota(c *gin.Context) {
+	index, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		APIError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	usage, err := router.QuotaTable().Reset(index)
+	if err != nil {
+		if errors.Is(err, yafw.ErrQuotaNotFound) {
+			APIError(c, http.StatusNotFound, err)
+		} else {
+			APIError(c, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, usage)
+}
+
+type IPSetConfig struct {
+	Name    string          `json:"name"`
+	Members []*yafw.IPRange `json:"members"`
+	IPSets  []string        `json:"ipsets"`
+	Timeout bool            `json:"timeout"`
+}
+
+type IPSetElement struct {
+	Address *yafw.IPRange `json:"address"`
+	// seconds before the element expires, a permanent member is added if
+	// omitted
+	TTL uint64 `json:"ttl"`
+}
+
+type IPSetPatch struct {
+	Add          []*yafw.IPRange `json:"add"`
+	Delete       []*yafw.IPRange `json:"delete"`
+	AddIPSets    []string        `json:"add_ipsets"`
+	DeleteIPSets []string        `json:"delete_ipsets"`
+}
+
+func APIGetIPSets(c *gin.Context) {
+	c.JSON(http.StatusOK, router.IPSets())
+}
+
+func APIGetIPSet(c *gin.Context) {
+	ipset := router.FindIPSet(c.Param("name"))
+	if ipset == nil {
+		APIError(c, http.StatusNotFound, yafw.ErrIPSetNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, ipset)
+}
+
+func CreateIPSet(config *IPSetConfig) error {
+	if strings.TrimSpace(config.Name) == "" {
+		return fmt.Errorf("%w: %q", yafw.ErrIPSetNameInvalid, config.Name)
+	}
+	ipset := router.NewIPSet(config.Name)
+	if ipset == nil {
+		return yafw.ErrIPSetNameDuplicated
+	}
+	ipset.SetTimeout(config.Timeout)
+
+	for _, member := range config.Members {
+		ipset.AddIPRange(member)
+	}
+	for _, ref := range config.IPSets {
+		ipset.AddIPSetRef(ref)
+	}
+
+	if err := router.UpdateIPSet(ipset); err != nil {
+		router.DeleteIPSet(config.Name)
+		return err
+	}
+
+	return nil
+}
+
+// Get the status of an error creating, renaming or updating an IPSet.
+func ipSetErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, yafw.ErrIPSetNameDuplicated):
+		return http.StatusConflict
+	case errors.Is(err, yafw.ErrIPSetNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, yafw.ErrIPSetNameInvalid), errors.Is(err, yafw.ErrIPSetDynamic),
+		errors.Is(err, yafw.ErrIPSetCycle):
+		return http.StatusBadRequest
+	default:
+		return referenceErrorStatus(err, http.StatusInternalServerError)
+	}
+}
+
+func APIPostIPSets(c *gin.Context) {
+	var config IPSetConfig
+	if err := c.BindJSON(&config); err != nil {
+		APIError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := CreateIPSet(&config); err != nil {
+		APIError(c, ipSetErrorStatus(err), err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+func APIPutIPSet(c *gin.Context) {
+	if router.FindIPSet(c.Param("name")) == nil {
+		APIError(c, http.StatusNotFound, yafw.ErrIPSetNotFound)
+		return
+	}
+
+	var config IPSetConfig
+	if err := c.BindJSON(&config); err != nil {
+		APIError(c, http.StatusBadRequest, err)
+		return
+	}
+	// members are changed by PATCH, while the timeout is kept by the kernel
+	// sets for as long as they exist
+	if config.Members != nil || config.IPSets != nil || config.Timeout {
+		APIError(c, http.StatusBadRequest, fmt.Errorf("only the name of an ipset can be put"))
+		return
+	}
+
+	if err := router.RenameIPSet(c.Param("name"), config.Name); err != nil {
+		APIError(c, ipSetErrorStatus(err), err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+func APIPatchIPSet(c *gin.Context) {
+	ipset := router.FindIPSet(c.Param("name"))
+	if ipset == nil {
+		APIError(c, http.StatusNotFound, yafw.ErrIPSetNotFound)
+		return
+	}
+	if ipset.Dynamic() {
+		APIError(c, http.StatusBadRequest, yafw.ErrIPSetDynamic)
+		return
+	}
+
+	var patch IPSetPatch
+	if err := c.BindJSON(&patch); err != nil {
+		APIError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	for _, member := range patch.Delete {
+		ipset.DeleteIPRange(member)
+	}
+	for _, member := range patch.Add {
+		ipset.AddIPRange(member)
+	}
+	for _, ref := range patch.DeleteIPSets {
+		ipset.DeleteIPSetRef(ref)
+	}
+	for _, ref := range patch.AddIPSets {
+		ipset.AddIPSetRef(ref)
+	}
+
+	if err := router.UpdateIPSet(ipset); err != nil {
+		APIError(c, ipSetErrorStatus(err), err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+func APIPostIPSetElements(c *gin.Context) {
+	ipset := router.FindIPSet(c.Param("name"))
+	if ipset == nil {
+		APIError(c, http.StatusNotFound, yafw.ErrIPSetNotFound)
+		return
+	}
+	if ipset.Dynamic() {
+		APIError(c, http.StatusBadRequest, yafw.ErrIPSetDynamic)
+		return
+	}
+
+	var element IPSetElement
+	if err := c.BindJSON(&element); err != nil {
+		APIError(c, http.StatusBadRequest, err)
+		return
+	}
+	if element.Address == nil {
+		APIError(c, http.StatusBadRequest, fmt.Errorf("address required"))
+		return
+	}
+
+	// a ttl beyond the range of time.Duration would wrap around
+	if element.TTL > uint64(math.MaxInt64/time.Second) {
+		APIError(c, http.StatusBadRequest, fmt.Errorf("ttl %d out of range", element.TTL))
+		return
+	}
+
+	ttl := time.Duration(element.TTL) * time.Second
+	if err := router.AddIPSetElement(ipset, element.Address, ttl); errors.Is(err, yafw.ErrIPSetNoTimeout) {
+		APIError(c, http.StatusBadRequest, err)
+	} else if err != nil {
+		APIError(c, http.StatusInternalServerError, err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+// Delete an IPSet, which is refused while it is referred unless
+// "?cascade=true" is given to remove the referring entries as well.
+func APIDeleteIPSet(c *gin.Context) {
+	name := c.Param("name")
+	if router.FindIPSet(name) == nil {
+		APIError(c, http.StatusNotFound, yafw.ErrIPSetNotFound)
+		return
+	}
+
+	var err error
+	if c.Query("cascade") == "true" {
+		err = router.DeleteIPSetCascade(name)
+	} else {
+		err = router.DeleteIPSet(name)
+	}
+	if err != nil {
+		APIError(c, referenceErrorStatus(err, http.StatusInternalServerError), err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+func APIGetIPSetReferences(c *gin.Context) {
+	if router.FindIPSet(c.Param("name")) == nil {
+		APIError(c, http.StatusNotFound, yafw.ErrIPSetNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, router.IPSetReferences(c.Param("name")))
+}
+
+func APIGetZones(c *gin.Context) {
+	c.JSON(http.StatusOK, router.ZoneTable().All())
+}
+
+// Delete a zone, see APIDeleteIPSet for "?cascade=true".
+func APIDeleteZone(c *gin.Context) {
+	name := c.Param("name")
+	if router.ZoneTable().FindZone(name) == nil {
+		APIError(c, http.StatusNotFound, yafw.ErrZoneNotFound)
+		return
+	}
+
+	var err error
+	if c.Query("cascade") == "true" {
+		err = router.ZoneTable().DeleteZoneCascade(name)
+	} else {
+		err = router.ZoneTable().DeleteZone(name)
+	}
+	if err != nil {
+		APIError(c, referenceErrorStatus(err, http.StatusInternalServerError), err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
 }
 
+func APIGetZoneReferences(c *gin.Context) {
+	if router.ZoneTable().FindZone(c.Param("name")) == nil {
+		APIError(c, http.StatusNotFound, yafw.ErrZoneNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, router.ZoneReferences(c.Param("name")))
+}
+
+func APIGetSchedules(c *gin.Context) {
+	c.JSON(http.StatusOK, router.ScheduleTable().All())
+}
+
+func APIPostSchedules(c *gin.Context) {
+	var schedule yafw.Schedule
+	if err := c.BindJSON(&schedule); err != nil {
+		APIError(c, http.StatusBadRequest, err)
+		return
+	}
+	if router.ScheduleTable().Find(schedule.Name) != nil {
+		APIError(c, http.StatusConflict, fmt.Errorf("schedule %q exists", schedule.Name))
+		return
+	}
+
+	if err := router.ScheduleTable().Update(&schedule); errors.Is(err, yafw.ErrScheduleInvalid) {
+		APIError(c, http.StatusBadRequest, err)
+	} else if err != nil {
+		APIError(c, http.StatusInternalServerError, err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+// Replace a schedule, installing the rules of the policies following it
+// again.
+func APIPutSchedule(c *gin.Context) {
+	var schedule yafw.Schedule
+	if err := c.BindJSON(&schedule); err != nil {
+		APIError(c, http.StatusBadRequest, err)
+		return
+	}
+	schedule.Name = c.Param("name")
+	if router.ScheduleTable().Find(schedule.Name) == nil {
+		APIError(c, http.StatusNotFound, yafw.ErrScheduleNotFound)
+		return
+	}
+
+	if err := router.ScheduleTable().Update(&schedule); errors.Is(err, yafw.ErrScheduleInvalid) {
+		APIError(c, http.StatusBadRequest, err)
+	} else if err != nil {
+		APIError(c, http.StatusInternalServerError, err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+// Delete a schedule, see APIDeleteIPSet for "?cascade=true".
+func APIDeleteSchedule(c *gin.Context) {
+	name := c.Param("name")
+	if router.ScheduleTable().Find(name) == nil {
+		APIError(c, http.StatusNotFound, yafw.ErrScheduleNotFound)
+		return
+	}
+
+	var err error
+	if c.Query("cascade") == "true" {
+		err = router.ScheduleTable().DeleteCascade(name)
+	} else {
+		err = router.ScheduleTable().Delete(name)
+	}
+	if err != nil {
+		APIError(c, referenceErrorStatus(err, http.StatusInternalServerError), err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+func APIGetScheduleReferences(c *gin.Context) {
+	if router.ScheduleTable().Find(c.Param("name")) == nil {
+		APIError(c, http.StatusNotFound, yafw.ErrScheduleNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, router.ScheduleReferences(c.Param("name")))
+}
+
+type MACSetConfig struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+type MACSetPatch struct {
+	Add    []string `json:"add"`
+	Delete []string `json:"delete"`
+}
+
+func parseMACs(macs []string) ([]net.HardwareAddr, error) {
+	ret := []net.HardwareAddr{}
+	for _, s := range macs {
+		mac, err := yafw.ParseMAC(s)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, mac)
+	}
+	return ret, nil
+}
+
+func APIGetMACSets(c *gin.Context) {
+	c.JSON(http.StatusOK, router.MACSets())
+}
+
+func APIGetMACSet(c *gin.Context) {
+	macset := router.FindMACSet(c.Param("name"))
+	if macset == nil {
+		APIError(c, http.StatusNotFound, yafw.ErrMACSetNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, macset)
+}
+
+func CreateMACSet(config *MACSetConfig) error {
+	macs, err := parseMACs(config.Members)
+	if err != nil {
+		return err
+	}
+
+	macset := router.NewMACSet(config.Name)
+	if macset == nil {
+		return yafw.ErrMACSetNameDuplicated
+	}
+	macset.ReplaceMACs(macs)
+
+	if err := router.UpdateMACSet(macset); err != nil {
+		router.DeleteMACSet(config.Name)
+		return err
+	}
+
+	return nil
+}
+
+func APIPostMACSets(c *gin.Context) {
+	var config MACSetConfig
+	if err := c.BindJSON(&config); err != nil {
+		APIError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := CreateMACSet(&config); errors.Is(err, yafw.ErrMACInvalid) {
+		APIError(c, http.StatusBadRequest, err)
+	} else if err != nil {
+		APIError(c, http.StatusInternalServerError, err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+func APIPatchMACSet(c *gin.Context) {
+	macset := router.FindMACSet(c.Param("name"))
+	if macset == nil {
+		APIError(c, http.StatusNotFound, yafw.ErrMACSetNotFound)
+		return
+	}
+
+	var patch MACSetPatch
+	if err := c.BindJSON(&patch); err != nil {
+		APIError(c, http.StatusBadRequest, err)
+		return
+	}
+	add, err := parseMACs(patch.Add)
+	if err != nil {
+		APIError(c, http.StatusBadRequest, err)
+		return
+	}
+	del, err := parseMACs(patch.Delete)
+	if err != nil {
+		APIError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	for _, mac := range del {
+		macset.DeleteMAC(mac)
+	}
+	for _, mac := range add {
+		macset.AddMAC(mac)
+	}
+
+	if err := router.UpdateMACSet(macset); err != nil {
+		APIError(c, http.StatusInternalServerError, err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+// Delete a MACSet, see APIDeleteIPSet for "?cascade=true".
+func APIDeleteMACSet(c *gin.Context) {
+	name := c.Param("name")
+	if router.FindMACSet(name) == nil {
+		APIError(c, http.StatusNotFound, yafw.ErrMACSetNotFound)
+		return
+	}
+
+	var err error
+	if c.Query("cascade") == "true" {
+		err = router.DeleteMACSetCascade(name)
+	} else {
+		err = router.DeleteMACSet(name)
+	}
+	if err != nil {
+		APIError(c, referenceErrorStatus(err, http.StatusInternalServerError), err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+func APIGetMACSetReferences(c *gin.Context) {
+	if router.FindMACSet(c.Param("name")) == nil {
+		APIError(c, http.StatusNotFound, yafw.ErrMACSetNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, router.MACSetReferences(c.Param("name")))
+}
+
+func APIGetSetStats(c *gin.Context) {
+	stats, err := router.SetStats()
+	if err != nil {
+		APIError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+func APIGetFQDNs(c *gin.Context) {
+	c.JSON(http.StatusOK, router.FQDNTable().All())
+}
+
+func APIGetFQDN(c *gin.Context) {
+	fqdn := router.FQDNTable().Find(c.Param("name"))
+	if fqdn == nil {
+		APIError(c, http.StatusNotFound, fmt.Errorf("fqdn %s not found", c.Param("name")))
+		return
+	}
+
+	c.JSON(http.StatusOK, fqdn)
+}
+
+func APIGetInterfaceAddresses(c *gin.Context) {
+	c.JSON(http.StatusOK, router.InterfaceAddressTable())
+}
+
+func APIGetGeo(c *gin.Context) {
+	c.JSON(http.StatusOK, router.GeoTable())
+}
+
+type FeedConfig struct {
+	IPSet string `json:"ipset"`
+	Path  string `json:"path"`
+	// seconds between reloads of an unchanged file, only reloaded on changes
+	// if omitted
+	Interval uint64 `json:"interval"`
+}
+
+func APIGetFeeds(c *gin.Context) {
+	c.JSON(http.StatusOK, router.FeedTable().All())
+}
+
+func AttachFeed(config *FeedConfig) (*yafw.Feed, error) {
+	if config.Interval > uint64(math.MaxInt64/time.Second) {
+		return nil, fmt.Errorf("%w: interval %d out of range", yafw.ErrFeedInvalid, config.Interval)
+	}
+	interval := time.Duration(config.Interval) * time.Second
+	feed, err := router.FeedTable().Attach(config.IPSet, config.Path, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	// a feed failing to load stays attached, and is retried once it changes
+	return feed, router.FeedTable().Load(config.IPSet)
+}
+
+func feedErrorStatus(err error) int {
+	if errors.Is(err, yafw.ErrFeedInvalid) {
+		return http.StatusBadRequest
+	}
+	return ipSetErrorStatus(err)
+}
+
+func APIPostFeeds(c *gin.Context) {
+	var config FeedConfig
+	if err := c.BindJSON(&config); err != nil {
+		APIError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	feed, err := AttachFeed(&config)
+	if feed == nil {
+		APIError(c, feedErrorStatus(err), err)
+	} else {
+		c.JSON(http.StatusOK, feed)
+	}
+}
+
+func APIDeleteFeed(c *gin.Context) {
+	if err := router.FeedTable().Detach(c.Param("name")); err != nil {
+		APIError(c, http.StatusNotFound, err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+func APIPostFeedReload(c *gin.Context) {
+	feed := router.FeedTable().Find(c.Param("name"))
+	if feed == nil {
+		APIError(c, http.StatusNotFound, yafw.ErrFeedNotFound)
+		return
+	}
+
+	if err := router.FeedTable().Load(c.Param("name")); err != nil {
+		APIError(c, http.StatusInternalServerError, err)
+	} else {
+		c.JSON(http.StatusOK, feed)
+	}
+}
+
+// Export the table of yafw as JSON, or as nft text with "?format=text".
 func APIExport(c *gin.Context) {
-	cmd := exec.Command("nft", "--json", "list", "ruleset")
-	var message json.RawMessage
-	output, err := cmd.CombinedOutput()
+	ruleset, err := router.Export()
 	if err != nil {
-		c.String(http.StatusInternalServerError, "")
+		APIError(c, http.StatusInternalServerError, err)
+		return
 	}
-	if err := json.Unmarshal(output, &message); err != nil {
-		c.String(http.StatusInternalServerError, "")
+
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.JSON(http.StatusOK, ruleset)
+	case "text":
+		c.String(http.StatusOK, ruleset.String())
+	default:
+		APIError(c, http.StatusBadRequest, fmt.Errorf("unknown format %q", c.Query("format")))
 	}
-	c.JSON(http.StatusOK, message)
-	// router.AddPolicy(p)
 }
 
 func APIGetConnections(c *gin.Context) {
@@ -175,6 +986,11 @@ func StartHTTP(wg *sync.WaitGroup) {
 
 	syscall.Unlink(socket)
 	server := gin.Default()
+	server.Use(func(c *gin.Context) {
+		router.Lock()
+		defer router.Unlock()
+		c.Next()
+	})
 
 	api := server.Group("/api/v1")
 	{
@@ -183,7 +999,50 @@ func StartHTTP(wg *sync.WaitGroup) {
 		api.POST("/policies", APIPostPolicies)
 		api.PUT("/policies/:id", APIPutPolicy)
 		api.DELETE("/policies/:id", APIDeletePolicy)
+		api.GET("/policies/:id/compiled", APIGetPolicyCompiled)
+		api.POST("/policies/:id/counters/reset", APIPostResetCounters(router.PolicyTable))
+		api.POST("/policies/:id/quota/reset", APIPostResetQuota)
+		api.POST("/policies/:id/move", APIPostMove(router.PolicyTable))
+		api.POST("/policies/:id/enable", APIPostEnabled(router.PolicyTable, true))
+		api.POST("/policies/:id/disable", APIPostEnabled(router.PolicyTable, false))
+		api.GET("/quotas", APIGetQuotas)
+		api.GET("/verify", APIVerify)
+		api.GET("/ipsets", APIGetIPSets)
+		api.POST("/ipsets", APIPostIPSets)
+		api.GET("/ipsets/:name", APIGetIPSet)
+		api.PUT("/ipsets/:name", APIPutIPSet)
+		api.PATCH("/ipsets/:name", APIPatchIPSet)
+		api.DELETE("/ipsets/:name", APIDeleteIPSet)
+		api.POST("/ipsets/:name/elements", APIPostIPSetElements)
+		api.GET("/ipsets/:name/references", APIGetIPSetReferences)
+		api.GET("/macsets", APIGetMACSets)
+		api.POST("/macsets", APIPostMACSets)
+		api.GET("/macsets/:name", APIGetMACSet)
+		api.PATCH("/macsets/:name", APIPatchMACSet)
+		api.DELETE("/macsets/:name", APIDeleteMACSet)
+		api.GET("/macsets/:name/references", APIGetMACSetReferences)
+		api.GET("/sets", APIGetSetStats)
+		api.GET("/zones", APIGetZones)
+		api.DELETE("/zones/:name", APIDeleteZone)
+		api.GET("/zones/:name/references", APIGetZoneReferences)
+		api.GET("/schedules", APIGetSchedules)
+		api.POST("/schedules", APIPostSchedules)
+		api.PUT("/schedules/:name", APIPutSchedule)
+		api.DELETE("/schedules/:name", APIDeleteSchedule)
+		api.GET("/schedules/:name/references", APIGetScheduleReferences)
+		api.GET("/fqdns", APIGetFQDNs)
+		api.GET("/fqdns/:name", APIGetFQDN)
+		api.GET("/geo", APIGetGeo)
+		api.GET("/ifaddrs", APIGetInterfaceAddresses)
+		api.GET("/feeds", APIGetFeeds)
+		api.POST("/feeds", APIPostFeeds)
+		api.DELETE("/feeds/:name", APIDeleteFeed)
+		api.POST("/feeds/:name/reload", APIPostFeedReload)
 		api.GET("/nat", APIGetNAT)
+		api.POST("/nat/:id/counters/reset", APIPostResetCounters(router.SNATRuleTable))
+		api.POST("/nat/:id/move", APIPostMove(router.SNATRuleTable))
+		api.POST("/nat/:id/enable", APIPostEnabled(router.SNATRuleTable, true))
+		api.POST("/nat/:id/disable", APIPostEnabled(router.SNATRuleTable, false))
 		api.GET("/export", APIExport)
 		api.GET("/connections", APIGetConnections)
 	}
@@ -198,20 +1057,23 @@ func StartHTTP(wg *sync.WaitGroup) {
 var router *yafw.Router
 
 type Config struct {
-	Policies []*yafw.Policy   `json:"policies"`
-	NAT      []*yafw.SNATRule `json:"nat"`
+	IPSets    []*IPSetConfig   `json:"ipsets"`
+	MACSets   []*MACSetConfig  `json:"macsets"`
+	Feeds     []*FeedConfig    `json:"feeds"`
+	Schedules []*yafw.Schedule `json:"schedules"`
+	Policies  []*yafw.Policy   `json:"policies"`
+	NAT       []*yafw.SNATRule `json:"nat"`
 }
 
 var configFile = flag.String("config", "/app/config.json", "configuration file")
+var geoIPFiles = flag.String("geoip", "", "comma separated GeoIP database files for geo addresses")
+var toggleSchedules = flag.Bool("toggle-schedules", false, "toggle the rules of scheduled policies rather than matching the time in the kernel, e.g. if the time zone of the kernel is not utc")
+var dnsServer = flag.String("dns", "", "dns server resolving fqdn addresses, e.g. 127.0.0.1:53 (defaults to the one in /etc/resolv.conf)")
 
 func main() {
 	flag.Parse()
 
 	logger = log.New(os.Stdout, "yafwd", log.Ltime|log.Lmsgprefix)
-	wg := new(sync.WaitGroup)
-	wg.Add(1)
-	go StartHTTP(wg)
-
 	var err error
 	router, err = yafw.NewRouter()
 	if err != nil {
@@ -220,25 +1082,89 @@ func main() {
 	}
 	defer router.Stop()
 
-	// ipset := router.NewIPSet("servers")
-	// if ipset == nil {
-	// 	logger.Fatalf("error init ipset: %v", ipset)
-	// 	return
-	// }
-	// ipset.AddIPRange(yafw.NewIPRangeString("192.168.234.0/24"))
-	// router.UpdateIPSet(ipset)
+	if *dnsServer != "" {
+		router.FQDNTable().Resolver = &yafw.DNSResolver{Server: *dnsServer}
+	} else if resolver, err := yafw.NewDNSResolverFromFile("/etc/resolv.conf"); err == nil {
+		router.FQDNTable().Resolver = resolver
+	} else {
+		logger.Printf("no dns server for fqdn addresses: %v", err)
+	}
+
+	if *toggleSchedules {
+		router.ScheduleTable().InKernel = false
+	} else if !router.ScheduleTable().InKernel {
+		logger.Printf("time matches unsupported by the kernel, toggling the rules of scheduled policies")
+	}
+
+	// the config is loaded while the router is locked, since the http server
+	// and background workers share it
+	router.Lock()
+
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go StartHTTP(wg)
+
+	if *geoIPFiles != "" {
+		router.GeoTable().Files = strings.Split(*geoIPFiles, ",")
+		if err := router.GeoTable().Load(); err != nil {
+			logger.Printf("load geoip error: %v", err)
+		}
+	}
 
 	var config Config
 	data, err := os.ReadFile(*configFile)
 	if err != nil {
 		fmt.Printf("read config error: %v", err)
+		router.Unlock()
 		return
 	}
 	if err := json.Unmarshal(data, &config); err != nil {
 		fmt.Printf("read config error: %v", err)
+		router.Unlock()
 		return
 	}
 
+	// ipsets come first since they are referred by rules, and references
+	// between ipsets are added once all of them exist
+	for _, ipset := range config.IPSets {
+		if err := CreateIPSet(&IPSetConfig{Name: ipset.Name, Members: ipset.Members, Timeout: ipset.Timeout}); err != nil {
+			fmt.Println(err)
+		}
+	}
+	for _, ipsetConfig := range config.IPSets {
+		if ipset := router.FindIPSet(ipsetConfig.Name); ipset != nil && len(ipsetConfig.IPSets) > 0 {
+			for _, ref := range ipsetConfig.IPSets {
+				ipset.AddIPSetRef(ref)
+			}
+			if err := router.UpdateIPSet(ipset); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+
+	for _, macset := range config.MACSets {
+		if err := CreateMACSet(macset); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	for _, feed := range config.Feeds {
+		if _, err := AttachFeed(feed); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	// the sets above go into the kernel in a batch each as they are loaded,
+	// while the entries go in a single batch, entries failing to be staged
+	// are left out
+	tx := router.Begin()
+
+	for _, schedule := range config.Schedules {
+		if err := router.ScheduleTable().Update(schedule); err != nil {
+			fmt.Println(err)
+		}
+	}
+
 	for _, nat := range config.NAT {
 		err := router.SNATRuleTable().Append(nat)
 		if err != nil {
@@ -253,6 +1179,23 @@ func main() {
 		}
 	}
 
+	if err := tx.Commit(); err != nil {
+		logger.Printf("commit config error: %v", err)
+	}
+
+	router.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go router.FQDNTable().Run(ctx)
+	go router.GeoTable().Run(ctx)
+	go router.FeedTable().Run(ctx)
+	go router.InterfaceAddressTable().Run(ctx)
+	go router.PolicyTable().Run(ctx)
+	go router.SNATRuleTable().Run(ctx)
+	go router.QuotaTable().Run(ctx)
+	go router.ScheduleTable().Run(ctx)
+
 	// router.DeletePolicy(1)
 	// router.Update()
 
@@ -1,5 +1,135 @@
 package main
 
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+// yafwvty drives a running yafwd through its API, e.g.
+//
+//	yafwvty policy list
+//	yafwvty policy disable 3 4
+//	yafwvty nat enable 1
+
+var apiURL = flag.String("api", "http://127.0.0.1:9085/api/v1", "base url of the yafwd api")
+
+// API paths of the entry tables by their kinds.
+var tablePaths = map[string]string{
+	"policy": "policies",
+	"nat":    "nat",
+}
+
+// The fields of an entry shown by list. Policies are disabled by disabled,
+// and nat rules by enabled set to false.
+type entry struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Disabled    bool   `json:"disabled"`
+	Enabled     *bool  `json:"enabled"`
+}
+
+type apiError struct {
+	Message string `json:"message"`
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] policy|nat list|enable|disable [id...]\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+// Decode the body of a response into v, or the error of the api.
+func decode(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e apiError
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Message == "" {
+			return fmt.Errorf("api error: %s", resp.Status)
+		}
+		return fmt.Errorf("api error: %s", e.Message)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func list(path string) error {
+	resp, err := http.Get(fmt.Sprintf("%s/%s", *apiURL, path))
+	if err != nil {
+		return err
+	}
+	entries := []*entry{}
+	if err := decode(resp, &entries); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tNAME\tDESCRIPTION")
+	for _, e := range entries {
+		state := "enabled"
+		if e.Disabled || (e.Enabled != nil && !*e.Enabled) {
+			state = "disabled"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", e.ID, state, e.Name, e.Description)
+	}
+	return w.Flush()
+}
+
+// Enable or disable entries one by one, stopping at the first failure.
+func setEnabled(path string, command string, ids []string) error {
+	if len(ids) == 0 {
+		return fmt.Errorf("no entries to %s", command)
+	}
+
+	for _, id := range ids {
+		if _, err := strconv.Atoi(id); err != nil {
+			return fmt.Errorf("invalid id %q", id)
+		}
+		resp, err := http.Post(fmt.Sprintf("%s/%s/%s/%s", *apiURL, path, id, command), "application/json", nil)
+		if err != nil {
+			return err
+		}
+		if err := decode(resp, nil); err != nil {
+			return fmt.Errorf("%s %s: %w", command, id, err)
+		}
+	}
+	return nil
+}
+
 func main() {
-	// TODO: ...
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	path, ok := tablePaths[args[0]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch args[1] {
+	case "list":
+		err = list(path)
+	case "enable", "disable":
+		err = setEnabled(path, args[1], args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,156 @@
+package yafw
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/nftables/expr"
+)
+
+// Packets and bytes matched by the rules of an entry since it is created or
+// its counters are reset. The kernel keeps no time of the last match, so
+// LastHit is when the counts are first seen grown by a sample, which are
+// taken by Run and whenever the counters are read.
+type EntryCounters struct {
+	Hits    uint64     `json:"hits"`
+	Bytes   uint64     `json:"bytes"`
+	LastHit *time.Time `json:"last_hit"`
+	Since   time.Time  `json:"since"`
+}
+
+type entryCounter struct {
+	EntryCounters
+
+	// kernel counts of the rules at the last sample, which start over once
+	// the rules are replaced by an update
+	kernelPackets uint64
+	kernelBytes   uint64
+}
+
+// Sum the counter expressions of the kernel rules of the table by their
+// handles.
+func (t *EntryTable) kernelCounters() (map[uint64]*expr.Counter, error) {
+	rules, err := t.r.query.GetRules(t.r.table, t.chain)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[uint64]*expr.Counter, len(rules))
+	for _, rule := range rules {
+		sum := &expr.Counter{}
+		for _, e := range rule.Exprs {
+			if counter, ok := e.(*expr.Counter); ok {
+				sum.Packets += counter.Packets
+				sum.Bytes += counter.Bytes
+			}
+		}
+		ret[rule.Handle] = sum
+	}
+
+	return ret, nil
+}
+
+// Add the counts grown since the last sample to the counters of the entries.
+func (t *EntryTable) sampleCounters() error {
+	kernel, err := t.kernelCounters()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, entry := range t.list {
+		counter := t.entryCounter(entry.Index())
+
+		var packets, bytes uint64
+		for _, rule := range t.ruleMap[entry.Index()] {
+			if sum, ok := kernel[rule.Handle]; ok {
+				packets += sum.Packets
+				bytes += sum.Bytes
+			}
+		}
+
+		if packets < counter.kernelPackets || bytes < counter.kernelBytes {
+			// rules replaced behind the back of the table
+			counter.kernelPackets, counter.kernelBytes = 0, 0
+		}
+		if packets > counter.kernelPackets {
+			counter.Hits += packets - counter.kernelPackets
+			counter.Bytes += bytes - counter.kernelBytes
+			counter.LastHit = &now
+		}
+		counter.kernelPackets, counter.kernelBytes = packets, bytes
+	}
+
+	return nil
+}
+
+func (t *EntryTable) entryCounter(index int) *entryCounter {
+	counter, ok := t.counters[index]
+	if !ok {
+		counter = &entryCounter{EntryCounters: EntryCounters{Since: time.Now()}}
+		t.counters[index] = counter
+	}
+	return counter
+}
+
+// Get the counters of an entry.
+func (t *EntryTable) Counters(index int) (*EntryCounters, error) {
+	if t.Find(index) == nil {
+		return nil, ErrEntryIndexNotFound
+	}
+	if err := t.sampleCounters(); err != nil {
+		return nil, err
+	}
+
+	ret := t.entryCounter(index).EntryCounters
+	return &ret, nil
+}
+
+// Get the counters of every entry by their indexes.
+func (t *EntryTable) AllCounters() (map[int]*EntryCounters, error) {
+	if err := t.sampleCounters(); err != nil {
+		return nil, err
+	}
+
+	ret := make(map[int]*EntryCounters, len(t.list))
+	for _, entry := range t.list {
+		counters := t.entryCounter(entry.Index()).EntryCounters
+		ret[entry.Index()] = &counters
+	}
+	return ret, nil
+}
+
+// Count the packets and bytes of an entry from 0 again. The kernel counters
+// are left as they are.
+func (t *EntryTable) ResetCounters(index int) error {
+	if t.Find(index) == nil {
+		return ErrEntryIndexNotFound
+	}
+	if err := t.sampleCounters(); err != nil {
+		return err
+	}
+
+	counter := t.entryCounter(index)
+	counter.EntryCounters = EntryCounters{Since: time.Now()}
+	return nil
+}
+
+// Sample the counters periodically, so that the time of the last hit is kept
+// even if nobody reads them. It returns once ctx is done.
+func (t *EntryTable) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.SampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		t.r.Lock()
+		// a failed sample is taken again on the next tick
+		_ = t.sampleCounters()
+		t.r.Unlock()
+	}
+}
@@ -0,0 +1,95 @@
+package yafw
+
+import (
+	"testing"
+
+	"github.com/google/nftables/expr"
+)
+
+func TestEntryCounters(t *testing.T) {
+	router := newTestRouter()
+
+	policy := &Policy{Source: NewAddressImmediate(parseTestIPRanges("10.0.0.0/24"))}
+	if err := router.PolicyTable().Append(policy); err != nil {
+		t.Fatal(err)
+	}
+
+	// packets counted by the kernel, whose counters are set by replacing the
+	// rule in place
+	hit := func(packets, bytes uint64) {
+		rules, err := router.PolicyTable().findRulesByTag(policy.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range rules[0].Exprs {
+			if counter, ok := e.(*expr.Counter); ok {
+				counter.Packets, counter.Bytes = packets, bytes
+			}
+		}
+		router.nft.ReplaceRule(rules[0])
+		if err := router.Update(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counters, err := router.PolicyTable().Counters(policy.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counters.Hits != 0 || counters.LastHit != nil {
+		t.Fatalf("test assert error: counters %+v of a new policy", counters)
+	}
+
+	hit(3, 180)
+	counters, err = router.PolicyTable().Counters(policy.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counters.Hits != 3 || counters.Bytes != 180 || counters.LastHit == nil {
+		t.Fatalf("test assert error: counters %+v (expecting 3 hits)", counters)
+	}
+
+	if err := router.PolicyTable().ResetCounters(policy.ID); err != nil {
+		t.Fatal(err)
+	}
+	hit(5, 300)
+	counters, err = router.PolicyTable().Counters(policy.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counters.Hits != 2 || counters.Bytes != 120 {
+		t.Fatalf("test assert error: counters %+v after reset (expecting 2 hits)", counters)
+	}
+
+	// the counts are kept once the rules are replaced by an update
+	policy.Action = PolicyDrop
+	if err := router.PolicyTable().Update(policy, nil); err != nil {
+		t.Fatal(err)
+	}
+	all, err := router.PolicyTable().AllCounters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all[policy.ID].Hits != 2 {
+		t.Fatalf("test assert error: counters %+v after update (expecting 2 hits)", all[policy.ID])
+	}
+	hit(1, 60)
+	if counters, err = router.PolicyTable().Counters(policy.ID); err != nil || counters.Hits != 3 {
+		t.Fatalf("test assert error: counters %+v with %v after update (expecting 3 hits)", counters, err)
+	}
+
+	snat := &SNATRule{Source: NewAddressImmediate(parseTestIPRanges("10.0.0.0/24"))}
+	if err := router.SNATRuleTable().Append(snat); err != nil {
+		t.Fatal(err)
+	}
+	if counters, err := router.SNATRuleTable().Counters(snat.ID); err != nil || counters.Hits != 0 {
+		t.Fatalf("test assert error: snat counters %+v with %v", counters, err)
+	}
+
+	if err := router.PolicyTable().Remove(policy.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := router.PolicyTable().Counters(policy.ID); err != ErrEntryIndexNotFound {
+		t.Fatalf("test assert error: counters of a removed policy read with %v", err)
+	}
+}
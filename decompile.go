@@ -0,0 +1,836 @@
+package yafw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Kinds of decompiled statements.
+const (
+	// Field compared by Op with either Value or the set named Set
+	StatementMatch = "match"
+	// Name with its Args, e.g. "log" or "snat"
+	StatementAction = "action"
+	// Name of the verdict, e.g. "accept" or "jump"
+	StatementVerdict = "verdict"
+)
+
+// A statement of a rule decompiled from its expressions, e.g. the match
+// "ip saddr @ipset-1" or the action "log prefix \"yafw-policy\"".
+type Statement struct {
+	Kind string `json:"kind"`
+
+	// the expression loaded, e.g. "ip saddr"
+	Field string `json:"field,omitempty"`
+	// "==", "!=", "<", "<=", ">" or ">="
+	Op    string `json:"op,omitempty"`
+	Value string `json:"value,omitempty"`
+	Set   string `json:"set,omitempty"`
+
+	Name string `json:"name,omitempty"`
+	// arguments of the action in nft syntax
+	Args string `json:"args,omitempty"`
+}
+
+func (s *Statement) String() string {
+	switch s.Kind {
+	case StatementMatch:
+		value := s.Value
+		if s.Set != "" {
+			value = "@" + s.Set
+		}
+		if s.Op == "==" {
+			return fmt.Sprintf("%s %s", s.Field, value)
+		}
+		return fmt.Sprintf("%s %s %s", s.Field, s.Op, value)
+	default:
+		if s.Args != "" {
+			return s.Name + " " + s.Args
+		}
+		return s.Name
+	}
+}
+
+// A rule decompiled from its expressions. Statements are in the order of the
+// expressions, with the verdict, if any, at last.
+type DecompiledRule struct {
+	Statements []*Statement `json:"statements"`
+}
+
+// Render the rule in nft syntax.
+func (d *DecompiledRule) String() string {
+	statements := make([]string, 0, len(d.Statements))
+	for _, s := range d.Statements {
+		statements = append(statements, s.String())
+	}
+	return strings.Join(statements, " ")
+}
+
+// Get the verdict of the rule, or "" if it has none.
+func (d *DecompiledRule) Verdict() string {
+	for _, s := range d.Statements {
+		if s.Kind == StatementVerdict {
+			return s.String()
+		}
+	}
+	return ""
+}
+
+// Get the matches of the rule.
+func (d *DecompiledRule) Matches() []*Statement {
+	ret := []*Statement{}
+	for _, s := range d.Statements {
+		if s.Kind == StatementMatch {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// Write anonymous sets inline, as nft does, e.g. "ip saddr { 10.0.0.1 }".
+func (d *DecompiledRule) inlineSets(sets map[string]*ExportSet) {
+	for _, s := range d.Statements {
+		if set, ok := sets[s.Set]; ok && set.Anonymous {
+			s.Value = fmt.Sprintf("{ %s }", strings.Join(set.Elements, ", "))
+			s.Set = ""
+		}
+	}
+}
+
+// Check whether two rules do the same, regardless of the values of their
+// counters.
+func (d *DecompiledRule) equal(o *DecompiledRule) bool {
+	if len(d.Statements) != len(o.Statements) {
+		return false
+	}
+	for i, s := range d.Statements {
+		a, b := *s, *o.Statements[i]
+		if a.Name == "counter" && b.Name == "counter" {
+			a.Args, b.Args = "", ""
+		}
+		if a != b {
+			return false
+		}
+	}
+	return true
+}
+
+// Names of the protocols in nft syntax.
+var protocolNames = map[byte]string{
+	unix.IPPROTO_ICMP:   "icmp",
+	unix.IPPROTO_TCP:    "tcp",
+	unix.IPPROTO_UDP:    "udp",
+	unix.IPPROTO_GRE:    "gre",
+	unix.IPPROTO_ICMPV6: "ipv6-icmp",
+	unix.IPPROTO_SCTP:   "sctp",
+}
+
+// Names of the ICMP and ICMPv6 types in nft syntax.
+var icmpTypeNames = map[string]map[byte]string{
+	"icmp_type": {
+		0:  "echo-reply",
+		3:  "destination-unreachable",
+		5:  "redirect",
+		8:  "echo-request",
+		11: "time-exceeded",
+		12: "parameter-problem",
+	},
+	"icmpv6_type": {
+		1:   "destination-unreachable",
+		2:   "packet-too-big",
+		3:   "time-exceeded",
+		4:   "parameter-problem",
+		128: "echo-request",
+		129: "echo-reply",
+		133: "nd-router-solicit",
+		134: "nd-router-advert",
+		135: "nd-neighbor-solicit",
+		136: "nd-neighbor-advert",
+		137: "nd-redirect",
+	},
+}
+
+// Names of the conntrack state bits in nft syntax.
+var ctStateNames = []struct {
+	bit  uint32
+	name string
+}{
+	{expr.CtStateBitINVALID, "invalid"},
+	{expr.CtStateBitESTABLISHED, "established"},
+	{expr.CtStateBitRELATED, "related"},
+	{expr.CtStateBitNEW, "new"},
+	{expr.CtStateBitUNTRACKED, "untracked"},
+}
+
+// Format data of a type in nft syntax. The types are those of nft sets, along
+// with a few ones for register contents, e.g. "ct_state".
+func valueText(data []byte, t string) string {
+	switch t {
+	case "ipv4_addr", "ipv6_addr":
+		return net.IP(data).String()
+	case "ether_addr":
+		return net.HardwareAddr(data).String()
+	case "ifname":
+		return strconv.Quote(string(bytes.TrimRight(data, "\x00")))
+	case "inet_service":
+		if len(data) == 2 {
+			return strconv.Itoa(int(binary.BigEndian.Uint16(data)))
+		}
+	case "inet_proto":
+		if len(data) == 1 {
+			if name, ok := protocolNames[data[0]]; ok {
+				return name
+			}
+			return strconv.Itoa(int(data[0]))
+		}
+	case "nf_proto":
+		if len(data) == 1 {
+			switch data[0] {
+			case unix.NFPROTO_IPV4:
+				return "ipv4"
+			case unix.NFPROTO_IPV6:
+				return "ipv6"
+			}
+			return strconv.Itoa(int(data[0]))
+		}
+	case "iface_type":
+		if len(data) == 2 {
+			if binaryutil.NativeEndian.Uint16(data) == unix.ARPHRD_ETHER {
+				return "ether"
+			}
+			return strconv.Itoa(int(binaryutil.NativeEndian.Uint16(data)))
+		}
+	case "integer":
+		switch len(data) {
+		case 1:
+			return strconv.Itoa(int(data[0]))
+		case 2:
+			return strconv.Itoa(int(binary.BigEndian.Uint16(data)))
+		case 4:
+			return strconv.FormatUint(uint64(binary.BigEndian.Uint32(data)), 10)
+		}
+	case "icmp_type", "icmpv6_type":
+		if len(data) == 1 {
+			if name, ok := icmpTypeNames[t][data[0]]; ok {
+				return name
+			}
+			return strconv.Itoa(int(data[0]))
+		}
+	case "time":
+		if len(data) == 8 {
+			ns := int64(binary.BigEndian.Uint64(data))
+			return strconv.Quote(time.Unix(0, ns).UTC().Format("2006-01-02 15:04:05"))
+		}
+	case "day":
+		if len(data) == 1 && data[0] < 7 {
+			return strconv.Quote(time.Weekday(data[0]).String())
+		}
+	case "hour":
+		if len(data) == 4 {
+			seconds := binary.BigEndian.Uint32(data)
+			if seconds%60 != 0 {
+				return strconv.Quote(fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60))
+			}
+			return strconv.Quote(fmt.Sprintf("%02d:%02d", seconds/3600, seconds/60%60))
+		}
+	case "mark":
+		if len(data) == 4 {
+			return fmt.Sprintf("0x%08x", binaryutil.NativeEndian.Uint32(data))
+		}
+	case "tcp_flag":
+		if len(data) == 1 && data[0] != 0 {
+			return TCPFlags(data[0]).String()
+		}
+	case "ct_state":
+		if len(data) == 4 {
+			bits := binaryutil.NativeEndian.Uint32(data)
+			names := []string{}
+			for _, state := range ctStateNames {
+				if bits&state.bit != 0 {
+					names = append(names, state.name)
+				}
+			}
+			if len(names) > 0 {
+				return strings.Join(names, ",")
+			}
+		}
+	}
+
+	return "0x" + hex.EncodeToString(data)
+}
+
+// What a register holds while a rule is decompiled.
+type operand struct {
+	// the expression loaded, e.g. "ip saddr"
+	field string
+	// type of the data compared with it, see valueText
+	t string
+	// mask applied by a bitwise expression
+	mask []byte
+	// data of an immediate expression
+	data []byte
+	// length of the data, or 0 if it is unknown
+	length uint32
+	// whether an expression has read it
+	read bool
+}
+
+// What the registers hold while a rule is decompiled, keyed by the index of
+// their first 4-byte register.
+type decompileRegisters map[int]*operand
+
+func (regs decompileRegisters) index(register uint32) int {
+	if index, ok := registerIndex(register); ok {
+		return index
+	}
+	// invalid registers are kept apart from the valid ones
+	return -int(register) - 1
+}
+
+func (regs decompileRegisters) load(register uint32, o operand) {
+	index := regs.index(register)
+	for i := index + 1; i < index+registerCount(o.length); i++ {
+		delete(regs, i)
+	}
+	regs[index] = &o
+}
+
+// Get what a register holds, which is named "reg N" if nothing is loaded.
+func (regs decompileRegisters) read(register uint32) operand {
+	if o, ok := regs[regs.index(register)]; ok {
+		o.read = true
+		return *o
+	}
+	return operand{field: fmt.Sprintf("reg %d", register)}
+}
+
+// Get the field of a register, concatenated with the fields loaded into the
+// following registers and not read yet, e.g. "ip saddr . tcp dport".
+func (regs decompileRegisters) concat(register uint32) string {
+	o := regs.read(register)
+	fields := []string{o.field}
+
+	index := regs.index(register)
+	for index >= 0 && o.length != 0 {
+		index += registerCount(o.length)
+		next, ok := regs[index]
+		if !ok || next.read {
+			break
+		}
+		next.read = true
+		o = *next
+		fields = append(fields, o.field)
+	}
+
+	return strings.Join(fields, " . ")
+}
+
+var cmpOps = map[expr.CmpOp]string{
+	expr.CmpOpEq:  "==",
+	expr.CmpOpNeq: "!=",
+	expr.CmpOpLt:  "<",
+	expr.CmpOpLte: "<=",
+	expr.CmpOpGt:  ">",
+	expr.CmpOpGte: ">=",
+}
+
+// Load of a payload expression, e.g. "ip saddr" of type "ipv4_addr". The
+// network and transport headers are named after the family and the protocol
+// matched before, if any.
+func payloadOperand(p *expr.Payload, nfproto byte, l4proto byte) operand {
+	switch p.Base {
+	case expr.PayloadBaseLLHeader:
+		switch {
+		case p.Offset == 0 && p.Len == 6:
+			return operand{field: "ether daddr", t: "ether_addr"}
+		case p.Offset == 6 && p.Len == 6:
+			return operand{field: "ether saddr", t: "ether_addr"}
+		}
+		return operand{field: fmt.Sprintf("@ll,%d,%d", p.Offset*8, p.Len*8)}
+	case expr.PayloadBaseNetworkHeader:
+		switch {
+		case p.Offset == 12 && p.Len == 4:
+			return operand{field: "ip saddr", t: "ipv4_addr"}
+		case p.Offset == 16 && p.Len == 4:
+			return operand{field: "ip daddr", t: "ipv4_addr"}
+		case p.Offset == 8 && p.Len == 16:
+			return operand{field: "ip6 saddr", t: "ipv6_addr"}
+		case p.Offset == 24 && p.Len == 16:
+			return operand{field: "ip6 daddr", t: "ipv6_addr"}
+		case nfproto == unix.NFPROTO_IPV4 && p.Offset == 8 && p.Len == 1:
+			return operand{field: "ip ttl", t: "integer"}
+		case nfproto == unix.NFPROTO_IPV4 && p.Offset == 1 && p.Len == 1:
+			return operand{field: "ip dscp", t: "dscp"}
+		case nfproto == unix.NFPROTO_IPV6 && p.Offset == 7 && p.Len == 1:
+			return operand{field: "ip6 hoplimit", t: "integer"}
+		case nfproto == unix.NFPROTO_IPV6 && p.Offset == 0 && p.Len == 2:
+			return operand{field: "ip6 dscp", t: "dscp"}
+		}
+		return operand{field: fmt.Sprintf("@nh,%d,%d", p.Offset*8, p.Len*8)}
+	case expr.PayloadBaseTransportHeader:
+		proto := "th"
+		if l4proto == unix.IPPROTO_TCP || l4proto == unix.IPPROTO_UDP || l4proto == unix.IPPROTO_SCTP {
+			proto = protocolNames[l4proto]
+		}
+		switch {
+		case (l4proto == unix.IPPROTO_ICMP || l4proto == unix.IPPROTO_ICMPV6) && p.Offset == 0 && p.Len == 1:
+			if l4proto == unix.IPPROTO_ICMPV6 {
+				return operand{field: "icmpv6 type", t: "icmpv6_type"}
+			}
+			return operand{field: "icmp type", t: "icmp_type"}
+		case (l4proto == unix.IPPROTO_ICMP || l4proto == unix.IPPROTO_ICMPV6) && p.Offset == 1 && p.Len == 1:
+			if l4proto == unix.IPPROTO_ICMPV6 {
+				return operand{field: "icmpv6 code", t: "integer"}
+			}
+			return operand{field: "icmp code", t: "integer"}
+		case l4proto == unix.IPPROTO_TCP && p.Offset == 13 && p.Len == 1:
+			return operand{field: "tcp flags", t: "tcp_flag"}
+		case p.Offset == 0 && p.Len == 2:
+			return operand{field: proto + " sport", t: "inet_service"}
+		case p.Offset == 2 && p.Len == 2:
+			return operand{field: proto + " dport", t: "inet_service"}
+		}
+		return operand{field: fmt.Sprintf("@th,%d,%d", p.Offset*8, p.Len*8)}
+	}
+
+	return operand{field: fmt.Sprintf("@%d,%d,%d", p.Base, p.Offset*8, p.Len*8)}
+}
+
+func metaOperand(key expr.MetaKey) operand {
+	switch key {
+	case expr.MetaKeyIIFNAME:
+		return operand{field: "iifname", t: "ifname"}
+	case expr.MetaKeyOIFNAME:
+		return operand{field: "oifname", t: "ifname"}
+	case expr.MetaKeyL4PROTO:
+		return operand{field: "meta l4proto", t: "inet_proto"}
+	case expr.MetaKeyNFPROTO:
+		return operand{field: "meta nfproto", t: "nf_proto"}
+	case expr.MetaKeyIIFTYPE:
+		return operand{field: "iiftype", t: "iface_type"}
+	case expr.MetaKeyPROTOCOL:
+		return operand{field: "meta protocol"}
+	case expr.MetaKeyLEN:
+		return operand{field: "meta length", t: "integer"}
+	case metaKeyTimeNS:
+		return operand{field: "meta time", t: "time"}
+	case metaKeyTimeDay:
+		return operand{field: "meta day", t: "day"}
+	case metaKeyTimeHour:
+		return operand{field: "meta hour", t: "hour"}
+	}
+	return operand{field: fmt.Sprintf("meta %d", key)}
+}
+
+// Get the DSCP out of the masked byte of IPv4 or the masked 2 bytes of IPv6.
+func ctOperand(key expr.CtKey) operand {
+	switch key {
+	case expr.CtKeySTATE:
+		return operand{field: "ct state", t: "ct_state"}
+	case expr.CtKeyMARK:
+		return operand{field: "ct mark", t: "mark"}
+	}
+	return operand{}
+}
+
+func dscpValue(data []byte) byte {
+	if len(data) == 2 {
+		return byte(binary.BigEndian.Uint16(data) >> 6)
+	}
+	if len(data) == 1 {
+		return data[0] >> 2
+	}
+	return 0
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Decompile the expressions of a rule, as built by ExprBuilder, into
+// statements. A register read before anything is loaded into it is named
+// "reg N", and expressions which cannot be told in nft syntax are kept as
+// actions named after their Go type.
+func Decompile(exprs []expr.Any) *DecompiledRule {
+	regs := decompileRegisters{}
+	load := regs.read
+
+	ret := &DecompiledRule{Statements: []*Statement{}}
+	add := func(s *Statement) {
+		ret.Statements = append(ret.Statements, s)
+	}
+	var nfproto, l4proto byte
+
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Meta:
+			if e.SourceRegister {
+				add(&Statement{Kind: StatementAction, Name: "meta", Args: fmt.Sprintf("%d set %s", e.Key, load(e.Register).field)})
+				continue
+			}
+			o := metaOperand(e.Key)
+			o.length = metaLength(e.Key)
+			regs.load(e.Register, o)
+		case *expr.Payload:
+			o := payloadOperand(e, nfproto, l4proto)
+			o.length = e.Len
+			regs.load(e.DestRegister, o)
+		case *expr.Ct:
+			if e.SourceRegister {
+				o := load(e.Register)
+				add(&Statement{Kind: StatementAction, Name: ctOperand(e.Key).field + " set", Args: valueText(o.data, ctOperand(e.Key).t)})
+				continue
+			}
+			if o := ctOperand(e.Key); o.field != "" {
+				o.length = ctLength(e.Key)
+				regs.load(e.Register, o)
+			} else {
+				regs.load(e.Register, operand{field: fmt.Sprintf("ct %d", e.Key), length: ctLength(e.Key)})
+			}
+		case *expr.Bitwise:
+			o := load(e.SourceRegister)
+			o.mask = e.Mask
+			regs.load(e.DestRegister, o)
+		case *expr.Byteorder:
+			// integers are always shown in network byte order
+			o := load(e.SourceRegister)
+			o.length = e.Len
+			regs.load(e.DestRegister, o)
+		case *expr.Immediate:
+			regs.load(e.Register, operand{data: e.Data, length: uint32(len(e.Data))})
+		case *expr.Cmp:
+			o := load(e.Register)
+			if o.field == "meta l4proto" && e.Op == expr.CmpOpEq && len(e.Data) == 1 {
+				l4proto = e.Data[0]
+			}
+			if o.field == "meta nfproto" && e.Op == expr.CmpOpEq && len(e.Data) == 1 {
+				nfproto = e.Data[0]
+			}
+			s := &Statement{Kind: StatementMatch, Field: o.field, Op: cmpOps[e.Op], Value: valueText(e.Data, o.t)}
+			if o.mask != nil {
+				if e.Op == expr.CmpOpNeq && isZero(e.Data) && o.t == "ct_state" {
+					// a flag test, e.g. "ct state established,related"
+					s.Op = "=="
+					s.Value = valueText(o.mask, o.t)
+				} else if o.t == "dscp" {
+					// the DSCP is the upper 6 bits of the traffic class
+					s.Value = strconv.Itoa(int(dscpValue(e.Data)))
+				} else if o.t == "tcp_flag" && len(o.mask) == 1 {
+					s.Field = fmt.Sprintf("%s & (%s)", o.field, valueText(o.mask, o.t))
+				} else {
+					s.Field = fmt.Sprintf("%s & %s", o.field, valueText(o.mask, ""))
+				}
+			}
+			add(s)
+		case *expr.Range:
+			o := load(e.Register)
+			add(&Statement{
+				Kind:  StatementMatch,
+				Field: o.field,
+				Op:    cmpOps[e.Op],
+				Value: valueText(e.FromData, o.t) + "-" + valueText(e.ToData, o.t),
+			})
+		case *expr.Lookup:
+			s := &Statement{Kind: StatementMatch, Field: regs.concat(e.SourceRegister), Op: "==", Set: e.SetName}
+			if e.Invert {
+				s.Op = "!="
+			}
+			add(s)
+		case *expr.Limit:
+			add(&Statement{Kind: StatementAction, Name: "limit", Args: limitArgs(e)})
+		case *expr.Objref:
+			if e.Type == nftObjectQuota {
+				add(&Statement{Kind: StatementAction, Name: "quota", Args: "name " + strconv.Quote(e.Name)})
+			} else {
+				add(&Statement{Kind: StatementAction, Name: "objref", Args: fmt.Sprintf("%d %s", e.Type, strconv.Quote(e.Name))})
+			}
+		case *expr.Connlimit:
+			add(&Statement{Kind: StatementAction, Name: "ct count", Args: connlimitArgs(e)})
+		case *expr.Dynset:
+			add(dynsetStatement(e, regs.concat(e.SrcRegKey)))
+		case *expr.Counter:
+			add(&Statement{Kind: StatementAction, Name: "counter", Args: fmt.Sprintf("packets %d bytes %d", e.Packets, e.Bytes)})
+		case *expr.Log:
+			add(&Statement{Kind: StatementAction, Name: "log", Args: logArgs(e)})
+		case *expr.Masq:
+			add(&Statement{Kind: StatementAction, Name: "masquerade"})
+		case *expr.NAT:
+			add(natStatement(e, load))
+		case *expr.Verdict:
+			add(verdictStatement(e))
+		default:
+			add(&Statement{Kind: StatementAction, Name: fmt.Sprintf("%T", e)})
+		}
+	}
+
+	return ret
+}
+
+// Arguments of a log expression, which only has the prefix and the flags
+// flagged in its key, as the others are not sent to the kernel.
+func logArgs(e *expr.Log) string {
+	args := []string{}
+	if e.Key&(1<<unix.NFTA_LOG_PREFIX) != 0 {
+		args = append(args, fmt.Sprintf("prefix %q", string(e.Data)))
+	}
+	if e.Key&(1<<unix.NFTA_LOG_GROUP) != 0 {
+		args = append(args, fmt.Sprintf("group %d", e.Group))
+	}
+	if e.Key&(1<<unix.NFTA_LOG_FLAGS) != 0 {
+		for _, flag := range []struct {
+			flag expr.LogFlags
+			name string
+		}{
+			{expr.LogFlagsTCPSeq, "tcp sequence"},
+			{expr.LogFlagsTCPOpt, "tcp options"},
+			{expr.LogFlagsIPOpt, "ip options"},
+			{expr.LogFlagsUID, "skuid"},
+			{expr.LogFlagsMACDecode, "ether"},
+		} {
+			if e.Flags&flag.flag != 0 {
+				args = append(args, "flags "+flag.name)
+			}
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+var limitUnitNames = map[expr.LimitTime]string{
+	expr.LimitTimeSecond: "second",
+	expr.LimitTimeMinute: "minute",
+	expr.LimitTimeHour:   "hour",
+	expr.LimitTimeDay:    "day",
+	expr.LimitTimeWeek:   "week",
+}
+
+// Arguments of a limit expression, e.g. "rate over 10/second burst 5 packets".
+func limitArgs(e *expr.Limit) string {
+	args := "rate "
+	if e.Over {
+		args += "over "
+	}
+	unit := "packets"
+	if e.Type == expr.LimitTypePktBytes {
+		unit = "bytes"
+		args += fmt.Sprintf("%d bytes/%s", e.Rate, limitUnitNames[e.Unit])
+	} else {
+		args += fmt.Sprintf("%d/%s", e.Rate, limitUnitNames[e.Unit])
+	}
+	return args + fmt.Sprintf(" burst %d %s", e.Burst, unit)
+}
+
+func connlimitArgs(e *expr.Connlimit) string {
+	if e.Flags&expr.NFT_CONNLIMIT_F_INV != 0 {
+		return fmt.Sprintf("over %d", e.Count)
+	}
+	return strconv.Itoa(int(e.Count))
+}
+
+// An update of a dynamic set, e.g.
+// "update @meter { ip saddr limit rate over 10/second burst 5 packets }".
+func dynsetStatement(e *expr.Dynset, key string) *Statement {
+	ret := &Statement{Kind: StatementAction, Name: "update"}
+	if e.Operation == unix.NFT_DYNSET_OP_ADD {
+		ret.Name = "add"
+	}
+
+	args := []string{key}
+	if e.Timeout > 0 {
+		args = append(args, "timeout "+nftDuration(e.Timeout))
+	}
+	for _, inner := range e.Exprs {
+		switch inner := inner.(type) {
+		case *expr.Limit:
+			args = append(args, "limit "+limitArgs(inner))
+		case *expr.Connlimit:
+			args = append(args, "ct count "+connlimitArgs(inner))
+		default:
+			args = append(args, fmt.Sprintf("%T", inner))
+		}
+	}
+	ret.Args = fmt.Sprintf("@%s { %s }", e.SetName, strings.Join(args, " "))
+
+	return ret
+}
+
+func natStatement(e *expr.NAT, load func(uint32) operand) *Statement {
+	ret := &Statement{Kind: StatementAction, Name: "snat"}
+	if e.Type == expr.NATTypeDestNAT {
+		ret.Name = "dnat"
+	}
+
+	args := []string{}
+	switch e.Family {
+	case unix.NFPROTO_IPV4:
+		args = append(args, "ip")
+	case unix.NFPROTO_IPV6:
+		args = append(args, "ip6")
+	}
+
+	to := ""
+	if e.RegAddrMin != 0 {
+		to = net.IP(load(e.RegAddrMin).data).String()
+		if e.RegAddrMax != 0 && e.RegAddrMax != e.RegAddrMin {
+			to += "-" + net.IP(load(e.RegAddrMax).data).String()
+		}
+	}
+	if e.RegProtoMin != 0 {
+		to += ":" + valueText(load(e.RegProtoMin).data, "inet_service")
+		if e.RegProtoMax != 0 && e.RegProtoMax != e.RegProtoMin {
+			to += "-" + valueText(load(e.RegProtoMax).data, "inet_service")
+		}
+	}
+	if to != "" {
+		args = append(args, "to", to)
+	}
+	ret.Args = strings.Join(args, " ")
+
+	return ret
+}
+
+func verdictStatement(e *expr.Verdict) *Statement {
+	ret := &Statement{Kind: StatementVerdict}
+	switch e.Kind {
+	case expr.VerdictAccept:
+		ret.Name = "accept"
+	case expr.VerdictDrop:
+		ret.Name = "drop"
+	case expr.VerdictReturn:
+		ret.Name = "return"
+	case expr.VerdictContinue:
+		ret.Name = "continue"
+	case expr.VerdictJump:
+		ret.Name, ret.Args = "jump", e.Chain
+	case expr.VerdictGoto:
+		ret.Name, ret.Args = "goto", e.Chain
+	case expr.VerdictQueue:
+		ret.Name = "queue"
+	default:
+		ret.Name, ret.Args = "verdict", strconv.Itoa(int(e.Kind))
+	}
+	return ret
+}
+
+// Check whether the nftables library decodes an expression when it reads
+// rules from the kernel. Those it drops, e.g. masquerade, are left out when
+// rules are compared with the kernel.
+func decodable(e expr.Any) bool {
+	switch e := e.(type) {
+	case *expr.Ct:
+		// the source register of a ct statement is not decoded, which leaves
+		// a load of nothing
+		return !e.SourceRegister
+	case *expr.Masq, *expr.Reject, *expr.Fib, *expr.Hash, *expr.Numgen, *expr.Objref,
+		*expr.Queue, *expr.Rt, *expr.TProxy, *expr.Dup, *expr.Byteorder:
+		return false
+	}
+	return true
+}
+
+func decodableExprs(exprs []expr.Any) []expr.Any {
+	ret := make([]expr.Any, 0, len(exprs))
+	for _, e := range exprs {
+		if decodable(e) {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// Get what an entry is compiled into, a decompiled rule for each of its
+// kernel rules.
+func (t *EntryTable) Compiled(index int) ([]*DecompiledRule, error) {
+	entry := t.Find(index)
+	if entry == nil {
+		return nil, ErrEntryIndexNotFound
+	}
+
+	rules, err := entry.ToRules()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []*DecompiledRule{}
+	for _, rule := range rules {
+		ret = append(ret, Decompile(rule.Exprs))
+	}
+
+	return ret, nil
+}
+
+// The rules an entry is compiled into, compared with those in the kernel.
+type EntryVerification struct {
+	Kind     string   `json:"kind"`
+	ID       int      `json:"id"`
+	OK       bool     `json:"ok"`
+	Expected []string `json:"expected"`
+	Actual   []string `json:"actual"`
+}
+
+// Check whether the kernel rules of an entry still match what it is compiled
+// into.
+func (t *EntryTable) Verify(index int) (*EntryVerification, error) {
+	entry := t.Find(index)
+	if entry == nil {
+		return nil, ErrEntryIndexNotFound
+	}
+
+	rules, err := t.findRulesByTag(index)
+	if err != nil {
+		return nil, err
+	}
+	expected, err := installedRules(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &EntryVerification{
+		Kind:     t.kind,
+		ID:       index,
+		OK:       len(rules) == len(expected),
+		Expected: []string{},
+		Actual:   []string{},
+	}
+	for i, rule := range expected {
+		ret.Expected = append(ret.Expected, Decompile(rule.Exprs).String())
+		if ret.OK {
+			ret.OK = Decompile(decodableExprs(rule.Exprs)).equal(Decompile(rules[i].Exprs))
+		}
+	}
+	for _, rule := range rules {
+		ret.Actual = append(ret.Actual, Decompile(rule.Exprs).String())
+	}
+
+	return ret, nil
+}
+
+// Verify every entry of the router, see EntryTable.Verify.
+func (r *Router) VerifyEntries() ([]*EntryVerification, error) {
+	ret := []*EntryVerification{}
+	for _, table := range []*EntryTable{r.snatEntries, r.dnatEntries, r.policyEntries} {
+		for _, entry := range table.All() {
+			verification, err := table.Verify(entry.Index())
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, verification)
+		}
+	}
+
+	return ret, nil
+}
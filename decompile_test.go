@@ -0,0 +1,151 @@
+package yafw
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+func TestDecompile(t *testing.T) {
+	set := &nftables.Set{Name: "ipset-lan"}
+	ipset := &AddressSet{V4: set, Negate: true}
+	echoRequest, expedited := uint8(8), uint8(46)
+
+	for _, c := range []struct {
+		builder  *ExprBuilder
+		expected string
+	}{
+		{
+			(&ExprBuilder{}).ConntrackState(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED).VerdictAccept(),
+			"ct state established,related accept",
+		},
+		{
+			(&ExprBuilder{}).MatchEgressInterface("wan0").
+				MatchFamily(nftables.TableFamilyIPv4).
+				MatchSourceAddress(nftables.TableFamilyIPv4, ipset).
+				Log("yafw-snat", expr.LogFlagsIPOpt).
+				Masquerade(),
+			`oifname "wan0" meta nfproto ipv4 ip saddr != @ipset-lan log prefix "yafw-snat" flags ip options masquerade`,
+		},
+		{
+			(&ExprBuilder{}).MatchService(nftables.TableFamilyINet, &Service{Protocol: 17, SourcePortMin: 53, SourcePortMax: 53}).
+				Counter().VerdictDrop(),
+			"meta l4proto udp udp sport 53-53 counter packets 0 bytes 0 drop",
+		},
+		{
+			(&ExprBuilder{}).MatchSourceMAC(&nftables.Set{Name: "macset-1"}),
+			"iiftype ether ether saddr @macset-1",
+		},
+		{
+			(&ExprBuilder{}).PayloadIP6Destination(1).CompareIPRange(1, NewIPRangeString("fd00::/64")),
+			"ip6 daddr >= fd00:: ip6 daddr < fd00:0:0:1::",
+		},
+		{
+			(&ExprBuilder{}).MatchService(nftables.TableFamilyINet, &Service{Protocol: 1, ICMPType: &echoRequest}).VerdictAccept(),
+			"meta l4proto icmp icmp type echo-request accept",
+		},
+		{
+			(&ExprBuilder{}).MatchService(nftables.TableFamilyINet, &Service{
+				Protocol:     6,
+				TCPFlags:     TCPFlagFIN | TCPFlagPSH | TCPFlagURG,
+				TCPFlagsMask: TCPFlagFIN | TCPFlagSYN | TCPFlagRST | TCPFlagPSH | TCPFlagACK | TCPFlagURG,
+			}).VerdictDrop(),
+			"meta l4proto tcp tcp flags & (fin|syn|rst|psh|ack|urg) fin|psh|urg drop",
+		},
+		{
+			(&ExprBuilder{}).MatchFamily(nftables.TableFamilyIPv6).
+				MatchService(nftables.TableFamilyIPv6, &Service{Protocol: 17, LengthMin: 0, LengthMax: 512, TTLMin: 1, TTLMax: 1, DSCP: &expedited}),
+			"meta nfproto ipv6 meta l4proto udp meta length 0-512 ip6 hoplimit 1 ip6 dscp 46",
+		},
+		{
+			(&ExprBuilder{}).MatchFamily(nftables.TableFamilyIPv4).
+				MatchService(nftables.TableFamilyIPv4, &Service{Protocol: 6, TTLMin: 1, TTLMax: 64, DSCP: &expedited}),
+			"meta nfproto ipv4 meta l4proto tcp ip ttl 1-64 ip dscp 46",
+		},
+		{
+			(&ExprBuilder{}).MatchWeekday(time.Monday, time.Friday).MatchHour(17*3600, 21*3600-1).
+				MatchTime(time.Date(2024, 12, 24, 0, 0, 0, 0, time.UTC), time.Date(2024, 12, 26, 0, 0, 0, 0, time.UTC)),
+			`meta day "Monday"-"Friday" meta hour "17:00"-"20:59:59" meta time "2024-12-24 00:00:00"-"2024-12-26 00:00:00"`,
+		},
+		{
+			// a register compared before anything is loaded
+			(&ExprBuilder{}).CompareL4Protocol(2, 6),
+			"reg 2 0x06",
+		},
+	} {
+		decompiled := Decompile(c.builder.Exprs())
+		if text := decompiled.String(); text != c.expected {
+			t.Fatalf("test assert error: decompiled %q (expecting %q)", text, c.expected)
+		}
+	}
+
+	decompiled := Decompile((&ExprBuilder{}).MatchSourceAddress(nftables.TableFamilyIPv4, ipset).VerdictAccept().Exprs())
+	matches := decompiled.Matches()
+	if len(matches) != 1 || matches[0].Field != "ip saddr" || matches[0].Op != "!=" || matches[0].Set != "ipset-lan" {
+		t.Fatalf("test assert error: matches %+v", matches)
+	}
+	if verdict := decompiled.Verdict(); verdict != "accept" {
+		t.Fatalf("test assert error: verdict %q", verdict)
+	}
+}
+
+func TestVerifyEntries(t *testing.T) {
+	router := newTestRouter()
+
+	policy := &Policy{
+		Source: NewAddressImmediate(parseTestIPRanges("10.0.0.0/24", "fd00::/64")),
+		Log:    true,
+		Action: PolicyAccept,
+	}
+	if err := router.PolicyTable().Append(policy); err != nil {
+		t.Fatal(err)
+	}
+	snat := &SNATRule{Source: NewAddressImmediate(parseTestIPRanges("10.0.0.0/24"))}
+	if err := router.SNATRuleTable().Append(snat); err != nil {
+		t.Fatal(err)
+	}
+
+	compiled, err := router.PolicyTable().Compiled(policy.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `meta nfproto ipv4 ip saddr @immediate-1 counter packets 0 bytes 0 log prefix "yafw-policy" flags tcp options flags ip options accept`
+	if len(compiled) != 2 || compiled[0].String() != expected {
+		t.Fatalf("test assert error: compiled %v (expecting %q first)", compiled, expected)
+	}
+
+	verifications, err := router.VerifyEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifications) != 2 {
+		t.Fatalf("test assert error: %d verifications (expecting 2)", len(verifications))
+	}
+	for _, verification := range verifications {
+		if !verification.OK {
+			t.Fatalf("test assert error: %+v does not match the kernel", verification)
+		}
+	}
+
+	// a rule deleted behind the back of yafw
+	rules, err := router.PolicyTable().findRulesByTag(policy.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.nft.DelRule(rules[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Update(); err != nil {
+		t.Fatal(err)
+	}
+
+	verification, err := router.PolicyTable().Verify(policy.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verification.OK || len(verification.Actual) != 1 || verification.Actual[0] != expected {
+		t.Fatalf("test assert error: %+v matches the kernel", verification)
+	}
+}
@@ -0,0 +1,381 @@
+package yafw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+// The yafw table as it is in the kernel, read back over netlink. It is
+// rendered as nft text by String, or marshaled as JSON.
+type Ruleset struct {
+	Table  string         `json:"table"`
+	Family string         `json:"family"`
+	Sets   []*ExportSet   `json:"sets"`
+	Chains []*ExportChain `json:"chains"`
+}
+
+type ExportSet struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Flags     []string `json:"flags"`
+	Timeout   string   `json:"timeout,omitempty"`
+	Anonymous bool     `json:"anonymous"`
+	Elements  []string `json:"elements"`
+}
+
+type ExportChain struct {
+	Name     string        `json:"name"`
+	Type     string        `json:"type,omitempty"`
+	Hook     string        `json:"hook,omitempty"`
+	Priority *int32        `json:"priority,omitempty"`
+	Policy   string        `json:"policy,omitempty"`
+	Rules    []*ExportRule `json:"rules"`
+}
+
+type ExportRule struct {
+	Handle uint64 `json:"handle"`
+	// the entry the rule is compiled from, e.g. "policy" 3, which is empty for
+	// the rules of yafw itself
+	Kind  string `json:"kind,omitempty"`
+	Entry int    `json:"entry,omitempty"`
+	Text  string `json:"text"`
+
+	Statements []*Statement `json:"statements"`
+}
+
+// Get the entry ID tagged in the user data of a rule by EntryTable.
+func ruleTag(rule *nftables.Rule) (int, bool) {
+	if len(rule.UserData) != 8 {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint64(rule.UserData)), true
+}
+
+// Get the kind of the entries compiled into a chain, or "" if there is none.
+func (r *Router) chainKind(chain string) string {
+	for _, table := range []*EntryTable{r.snatEntries, r.dnatEntries, r.policyEntries} {
+		if table != nil && table.chain.Name == chain {
+			return table.kind
+		}
+	}
+	// the rules of the quota chain are tagged with their policies
+	if r.quotas != nil && r.quotas.chain != nil && r.quotas.chain.Name == chain {
+		return r.policyEntries.kind
+	}
+	return ""
+}
+
+// Read the table of the router from the kernel, with its sets, their
+// elements, its chains and their rules. Expressions which the nftables
+// library does not decode, e.g. masquerade, are missing from the rules.
+func (r *Router) Export() (*Ruleset, error) {
+	ret := &Ruleset{
+		Table:  r.table.Name,
+		Family: familyName(r.table.Family),
+		Sets:   []*ExportSet{},
+		Chains: []*ExportChain{},
+	}
+
+	sets, err := r.query.GetSets(r.table)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(sets, func(i, j int) bool { return sets[i].Name < sets[j].Name })
+
+	setMap := make(map[string]*ExportSet, len(sets))
+	for _, set := range sets {
+		elements, err := r.query.GetSetElements(set)
+		if err != nil {
+			return nil, fmt.Errorf("set %s: %w", set.Name, err)
+		}
+
+		exported := exportSet(set, elements)
+		setMap[set.Name] = exported
+		ret.Sets = append(ret.Sets, exported)
+	}
+
+	chains, err := r.query.ListChainsOfTableFamily(r.table.Family)
+	if err != nil {
+		return nil, err
+	}
+	for _, chain := range chains {
+		if chain.Table == nil || chain.Table.Name != r.table.Name {
+			continue
+		}
+
+		exported := &ExportChain{
+			Name:  chain.Name,
+			Type:  string(chain.Type),
+			Rules: []*ExportRule{},
+		}
+		if chain.Hooknum != nil {
+			exported.Hook = hookName(*chain.Hooknum)
+		}
+		if chain.Priority != nil {
+			priority := int32(*chain.Priority)
+			exported.Priority = &priority
+		}
+		if chain.Policy != nil {
+			exported.Policy = "accept"
+			if *chain.Policy == nftables.ChainPolicyDrop {
+				exported.Policy = "drop"
+			}
+		}
+
+		rules, err := r.query.GetRules(r.table, chain)
+		if err != nil {
+			return nil, fmt.Errorf("chain %s: %w", chain.Name, err)
+		}
+		kind := r.chainKind(chain.Name)
+		for _, rule := range rules {
+			decompiled := Decompile(rule.Exprs)
+			decompiled.inlineSets(setMap)
+			exportedRule := &ExportRule{
+				Handle:     rule.Handle,
+				Text:       decompiled.String(),
+				Statements: decompiled.Statements,
+			}
+			if id, ok := ruleTag(rule); ok && kind != "" {
+				exportedRule.Kind = kind
+				exportedRule.Entry = id
+			}
+			exported.Rules = append(exported.Rules, exportedRule)
+		}
+
+		ret.Chains = append(ret.Chains, exported)
+	}
+	sort.SliceStable(ret.Chains, func(i, j int) bool { return ret.Chains[i].Name < ret.Chains[j].Name })
+
+	return ret, nil
+}
+
+// Render the ruleset as nft text, which can be loaded by "nft -f". Anonymous
+// sets are written inline in the rules using them, and the entry of a rule
+// is written as its comment.
+func (rs *Ruleset) String() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "table %s %s {\n", rs.Family, rs.Table)
+
+	first := true
+	separate := func() {
+		if !first {
+			b.WriteString("\n")
+		}
+		first = false
+	}
+
+	for _, set := range rs.Sets {
+		if set.Anonymous {
+			continue
+		}
+		separate()
+		fmt.Fprintf(b, "\tset %s {\n", set.Name)
+		fmt.Fprintf(b, "\t\ttype %s\n", set.Type)
+		if len(set.Flags) > 0 {
+			fmt.Fprintf(b, "\t\tflags %s\n", strings.Join(set.Flags, ","))
+		}
+		if set.Timeout != "" {
+			fmt.Fprintf(b, "\t\ttimeout %s\n", set.Timeout)
+		}
+		if len(set.Elements) > 0 {
+			fmt.Fprintf(b, "\t\telements = { %s }\n", strings.Join(set.Elements, ", "))
+		}
+		b.WriteString("\t}\n")
+	}
+
+	for _, chain := range rs.Chains {
+		separate()
+		fmt.Fprintf(b, "\tchain %s {\n", chain.Name)
+		if chain.Hook != "" && chain.Priority != nil {
+			fmt.Fprintf(b, "\t\ttype %s hook %s priority %d;", chain.Type, chain.Hook, *chain.Priority)
+			if chain.Policy != "" {
+				fmt.Fprintf(b, " policy %s;", chain.Policy)
+			}
+			b.WriteString("\n")
+		}
+		for _, rule := range chain.Rules {
+			b.WriteString("\t\t" + rule.Text)
+			if rule.Kind != "" {
+				fmt.Fprintf(b, " comment %q", fmt.Sprintf("%s %d", rule.Kind, rule.Entry))
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("\t}\n")
+	}
+
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+func familyName(family nftables.TableFamily) string {
+	switch family {
+	case nftables.TableFamilyINet:
+		return "inet"
+	case nftables.TableFamilyIPv4:
+		return "ip"
+	case nftables.TableFamilyIPv6:
+		return "ip6"
+	case nftables.TableFamilyARP:
+		return "arp"
+	case nftables.TableFamilyNetdev:
+		return "netdev"
+	case nftables.TableFamilyBridge:
+		return "bridge"
+	default:
+		return strconv.Itoa(int(family))
+	}
+}
+
+func hookName(hook nftables.ChainHook) string {
+	switch hook {
+	case *nftables.ChainHookPrerouting:
+		return "prerouting"
+	case *nftables.ChainHookInput:
+		return "input"
+	case *nftables.ChainHookForward:
+		return "forward"
+	case *nftables.ChainHookOutput:
+		return "output"
+	case *nftables.ChainHookPostrouting:
+		return "postrouting"
+	case *nftables.ChainHookIngress:
+		return "ingress"
+	default:
+		return strconv.Itoa(int(hook))
+	}
+}
+
+// Format a duration the way nft does, e.g. "1h30m" or "500ms".
+func nftDuration(d time.Duration) string {
+	if d <= 0 {
+		return "0s"
+	}
+
+	ret := ""
+	for _, unit := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+		{"ms", time.Millisecond},
+	} {
+		if n := d / unit.d; n > 0 {
+			ret += fmt.Sprintf("%d%s", n, unit.name)
+			d -= n * unit.d
+		}
+	}
+
+	return ret
+}
+
+func exportSet(set *nftables.Set, elements []nftables.SetElement) *ExportSet {
+	ret := &ExportSet{
+		Name:      set.Name,
+		Type:      set.KeyType.Name,
+		Flags:     []string{},
+		Anonymous: set.Anonymous || strings.HasPrefix(set.Name, "__set"),
+		Elements:  []string{},
+	}
+
+	if set.Constant {
+		ret.Flags = append(ret.Flags, "constant")
+	}
+	if set.Interval {
+		ret.Flags = append(ret.Flags, "interval")
+	}
+	if set.HasTimeout {
+		ret.Flags = append(ret.Flags, "timeout")
+	}
+	if set.Dynamic {
+		ret.Flags = append(ret.Flags, "dynamic")
+	}
+	if set.Timeout > 0 {
+		ret.Timeout = nftDuration(set.Timeout)
+	}
+
+	sort.SliceStable(elements, func(i, j int) bool {
+		return bytes.Compare(elements[i].Key, elements[j].Key) < 0
+	})
+
+	if !set.Interval {
+		for _, element := range elements {
+			ret.Elements = append(ret.Elements, elementText(element.Key, set.KeyType.Name, element.Timeout))
+		}
+		return ret
+	}
+
+	// an interval runs from a start element up to the following end element,
+	// or up to the last key if there is none
+	var start *nftables.SetElement
+	for i := range elements {
+		element := &elements[i]
+		if !element.IntervalEnd {
+			if start != nil {
+				ret.Elements = append(ret.Elements, intervalText(start, nil, set.KeyType.Name))
+			}
+			start = element
+		} else if start != nil {
+			ret.Elements = append(ret.Elements, intervalText(start, element.Key, set.KeyType.Name))
+			start = nil
+		}
+	}
+	if start != nil {
+		ret.Elements = append(ret.Elements, intervalText(start, nil, set.KeyType.Name))
+	}
+
+	return ret
+}
+
+// Format an interval from start up to the exclusive end key, e.g. a host, a
+// CIDR or a range of addresses.
+func intervalText(start *nftables.SetElement, end []byte, keyType string) string {
+	var last []byte
+	if end == nil {
+		last = bytes.Repeat([]byte{0xff}, len(start.Key))
+	} else {
+		last = IPPrev(end)
+	}
+
+	text := ""
+	switch keyType {
+	case "ipv4_addr", "ipv6_addr":
+		iprange := newIPRangeFirstLast(net.IP(start.Key), net.IP(last))
+		if cidrs := iprange.CIDRs(); len(cidrs) == 1 && iprange.Type() != IPRangeHost {
+			text = cidrs[0].String()
+		} else {
+			text = iprange.String()
+		}
+	default:
+		if bytes.Equal(start.Key, last) {
+			text = valueText(start.Key, keyType)
+		} else {
+			text = valueText(start.Key, keyType) + "-" + valueText(last, keyType)
+		}
+	}
+
+	if start.Timeout > 0 {
+		text += " timeout " + nftDuration(start.Timeout)
+	}
+
+	return text
+}
+
+func elementText(key []byte, keyType string, timeout time.Duration) string {
+	text := valueText(key, keyType)
+	if timeout > 0 {
+		text += " timeout " + nftDuration(timeout)
+	}
+	return text
+}
@@ -0,0 +1,83 @@
+package yafw
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	router := newTestRouter()
+
+	ipset := router.NewIPSet("lan")
+	ipset.AddIPRange(NewIPRangeString("10.0.0.0/24"))
+	ipset.AddIPRange(NewIPRangeString("10.0.1.1-10.0.1.5"))
+	ipset.AddIPRange(NewIPRangeString("fd00::1"))
+	if err := router.UpdateIPSet(ipset); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := &Policy{
+		Source:      NewAddressIPSet("lan"),
+		Destination: NewAddressImmediate(parseTestIPRanges("192.168.1.1")),
+		Service: &Service{
+			Protocol:           6,
+			DestinationPortMin: 80,
+			DestinationPortMax: 443,
+		},
+		Action: PolicyDrop,
+	}
+	if err := router.PolicyTable().Append(policy); err != nil {
+		t.Fatal(err)
+	}
+
+	ruleset, err := router.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var forward *ExportChain
+	for _, chain := range ruleset.Chains {
+		if chain.Name == "forward" {
+			forward = chain
+		}
+	}
+	if forward == nil || forward.Hook != "forward" || forward.Policy != "drop" {
+		t.Fatalf("test assert error: forward chain %+v", forward)
+	}
+
+	// the rule of conntrack states, then the one of the policy
+	if len(forward.Rules) != 2 {
+		t.Fatalf("test assert error: %d rules in forward chain (expecting 2)", len(forward.Rules))
+	}
+	if text := forward.Rules[0].Text; text != "ct state established,related accept" || forward.Rules[0].Kind != "" {
+		t.Fatalf("test assert error: rule %+v", forward.Rules[0])
+	}
+	rule := forward.Rules[1]
+	expected := "meta nfproto ipv4 ip saddr @ipset-1 ip daddr @immediate-1 meta l4proto tcp tcp dport 80-443 counter packets 0 bytes 0 drop"
+	if rule.Kind != "policy" || rule.Entry != policy.ID || rule.Text != expected {
+		t.Fatalf("test assert error: rule %+v (expecting %q)", rule, expected)
+	}
+
+	var lan *ExportSet
+	for _, set := range ruleset.Sets {
+		if set.Name == "ipset-1" {
+			lan = set
+		}
+	}
+	if lan == nil || lan.Type != "ipv4_addr" || strings.Join(lan.Elements, ",") != "10.0.0.0/24,10.0.1.1-10.0.1.5" {
+		t.Fatalf("test assert error: set %+v", lan)
+	}
+
+	text := ruleset.String()
+	for _, line := range []string{
+		"table inet yafw {",
+		"\tset ipset-1 {",
+		"\t\telements = { 10.0.0.0/24, 10.0.1.1-10.0.1.5 }",
+		"\t\ttype filter hook forward priority 0; policy drop;",
+		"\t\t" + expected + ` comment "policy 1"`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Fatalf("test assert error: missing %q in\n%s", line, text)
+		}
+	}
+}
@@ -2,7 +2,10 @@ package yafw
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
@@ -10,14 +13,311 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+var (
+	ErrRegisterInvalid   = errors.New("invalid register")
+	ErrRegisterOverflow  = errors.New("data overflows the registers")
+	ErrRegisterUnloaded  = errors.New("register read before it is loaded")
+	ErrRegisterLength    = errors.New("register length mismatch")
+	ErrRegisterExhausted = errors.New("registers exhausted")
+	ErrExprAfterVerdict  = errors.New("expression after verdict")
+)
+
+// Registers of nftables hold 64 bytes of data, addressed in 16-byte
+// registers NFT_REG_1 to NFT_REG_4 or 4-byte registers NFT_REG32_00 to
+// NFT_REG32_15, which overlap each other. Data longer than a register runs
+// into the following ones, e.g. for concatenations.
+const (
+	registerSize = 4
+	registerMax  = 16
+)
+
+// Get the index of the first 4-byte register of a register.
+func registerIndex(register uint32) (int, bool) {
+	switch {
+	case register >= unix.NFT_REG_1 && register <= unix.NFT_REG_4:
+		return int(register-unix.NFT_REG_1) * 4, true
+	case register >= unix.NFT_REG32_00 && register <= unix.NFT_REG32_15:
+		return int(register - unix.NFT_REG32_00), true
+	default:
+		return 0, false
+	}
+}
+
+// Get the number of 4-byte registers taken by length bytes of data.
+func registerCount(length uint32) int {
+	return int((length + registerSize - 1) / registerSize)
+}
+
+// Builds the expressions of a rule. The builder keeps what every register
+// holds, so that an impossible sequence, e.g. comparing a register which is
+// never loaded or comparing a port with an address, is reported by Build
+// rather than by the kernel.
+//
+// Primitives like PayloadIPSource or ComparePort take the register to use,
+// while matches like MatchSourceAddress allocate their registers.
 type ExprBuilder struct {
 	expr []expr.Any
+
+	// length of the data loaded at each 4-byte register, where the data
+	// starts, and whether the register holds data at all
+	length [registerMax]uint32
+	loaded [registerMax]bool
+	// registers allocated by alloc
+	used [registerMax]bool
+
+	// a verdict ending the rule has been appended
+	final bool
+	err   error
 }
 
+// Get the expressions without checking them, see Build.
 func (eb *ExprBuilder) Exprs() []expr.Any {
 	return eb.expr
 }
 
+// Get the expressions, or the first error found in them.
+func (eb *ExprBuilder) Build() ([]expr.Any, error) {
+	if eb.err != nil {
+		return nil, eb.err
+	}
+	return eb.expr, nil
+}
+
+// Get the first error found in the expressions.
+func (eb *ExprBuilder) Err() error {
+	return eb.err
+}
+
+func (eb *ExprBuilder) fail(err error, format string, args ...any) {
+	if eb.err == nil {
+		eb.err = fmt.Errorf("%w: expression %d: %s", err, len(eb.expr), fmt.Sprintf(format, args...))
+	}
+}
+
+// Record length bytes of data loaded into a register.
+func (eb *ExprBuilder) load(register uint32, length uint32) {
+	index, ok := registerIndex(register)
+	if !ok {
+		eb.fail(ErrRegisterInvalid, "load into register %d", register)
+		return
+	}
+	if length == 0 || index+registerCount(length) > registerMax {
+		eb.fail(ErrRegisterOverflow, "load %d bytes into register %d", length, register)
+		return
+	}
+
+	for i := index; i < index+registerCount(length); i++ {
+		eb.loaded[i] = true
+		eb.length[i] = 0
+	}
+	eb.length[index] = length
+}
+
+// Record data of an unknown length, up to size bytes, loaded into a register.
+// Reading it is not checked against the length.
+func (eb *ExprBuilder) loadUnknown(register uint32, size uint32) {
+	eb.load(register, size)
+	if index, ok := registerIndex(register); ok {
+		eb.length[index] = 0
+	}
+}
+
+// Check that a register holds length bytes of data. If exact is set, the data
+// must have been loaded by a single expression of that length, otherwise it
+// may come from several ones, e.g. for a concatenation.
+func (eb *ExprBuilder) read(register uint32, length uint32, exact bool) {
+	index, ok := registerIndex(register)
+	if !ok {
+		eb.fail(ErrRegisterInvalid, "read register %d", register)
+		return
+	}
+	if length == 0 || index+registerCount(length) > registerMax {
+		eb.fail(ErrRegisterOverflow, "read %d bytes from register %d", length, register)
+		return
+	}
+
+	for i := index; i < index+registerCount(length); i++ {
+		if !eb.loaded[i] {
+			eb.fail(ErrRegisterUnloaded, "read register %d", register)
+			return
+		}
+	}
+	if exact && eb.length[index] != 0 && eb.length[index] != length {
+		eb.fail(ErrRegisterLength, "read %d bytes from register %d holding %d", length, register, eb.length[index])
+	}
+}
+
+// Allocate registers for length bytes of data, to be given back by release.
+// Data fitting in 16 bytes gets a 16-byte register, the first free one.
+func (eb *ExprBuilder) alloc(length uint32) uint32 {
+	count := registerCount(length)
+	step := 1
+	if length <= 16 {
+		count, step = 4, 4
+	}
+
+	for index := 0; index+count <= registerMax; index += step {
+		free := true
+		for i := index; i < index+count; i++ {
+			free = free && !eb.used[i]
+		}
+		if !free {
+			continue
+		}
+
+		for i := index; i < index+count; i++ {
+			eb.used[i] = true
+		}
+		if step == 4 {
+			return unix.NFT_REG_1 + uint32(index/4)
+		}
+		return unix.NFT_REG32_00 + uint32(index)
+	}
+
+	eb.fail(ErrRegisterExhausted, "allocate %d bytes", length)
+	return unix.NFT_REG_1
+}
+
+// Give back registers allocated for length bytes of data.
+func (eb *ExprBuilder) release(register uint32, length uint32) {
+	index, ok := registerIndex(register)
+	if !ok {
+		return
+	}
+	count := registerCount(length)
+	if length <= 16 {
+		count = 4
+	}
+	for i := index; i < index+count && i < registerMax; i++ {
+		eb.used[i] = false
+	}
+}
+
+// NFT_META_TIME_NS, NFT_META_TIME_DAY and NFT_META_TIME_HOUR, which are
+// missing from unix. They need Linux 5.4 or later.
+const (
+	metaKeyTimeNS   expr.MetaKey = 30
+	metaKeyTimeDay  expr.MetaKey = 31
+	metaKeyTimeHour expr.MetaKey = 32
+)
+
+// Length of the data loaded by a meta expression, or 0 if it is unknown.
+func metaLength(key expr.MetaKey) uint32 {
+	switch key {
+	case metaKeyTimeDay:
+		return 1
+	case metaKeyTimeNS:
+		return 8
+	case expr.MetaKeyIIFNAME, expr.MetaKeyOIFNAME:
+		return unix.IFNAMSIZ
+	case expr.MetaKeyL4PROTO, expr.MetaKeyNFPROTO:
+		return 1
+	case expr.MetaKeyIIFTYPE, expr.MetaKeyOIFTYPE, expr.MetaKeyPROTOCOL:
+		return 2
+	case expr.MetaKeyLEN, expr.MetaKeyMARK, expr.MetaKeyIIF, expr.MetaKeyOIF,
+		expr.MetaKeySKUID, expr.MetaKeySKGID, expr.MetaKeyPRIORITY, metaKeyTimeHour:
+		return 4
+	}
+	return 0
+}
+
+// Length of the data loaded by a ct expression, or 0 if it is unknown.
+func ctLength(key expr.CtKey) uint32 {
+	switch key {
+	case expr.CtKeySTATE, expr.CtKeySTATUS, expr.CtKeyMARK, expr.CtKeyEXPIRATION:
+		return 4
+	case expr.CtKeyDIRECTION, expr.CtKeyL3PROTOCOL, expr.CtKeyPROTOCOL:
+		return 1
+	}
+	return 0
+}
+
+// Check an expression against the registers and record what it loads.
+func (eb *ExprBuilder) check(e expr.Any) {
+	if eb.final {
+		eb.fail(ErrExprAfterVerdict, "%T", e)
+		return
+	}
+
+	switch e := e.(type) {
+	case *expr.Meta:
+		if e.SourceRegister {
+			eb.read(e.Register, 1, false)
+		} else if length := metaLength(e.Key); length != 0 {
+			eb.load(e.Register, length)
+		} else {
+			eb.loadUnknown(e.Register, registerSize)
+		}
+	case *expr.Payload:
+		if e.SourceRegister != 0 {
+			eb.read(e.SourceRegister, e.Len, true)
+		} else {
+			eb.load(e.DestRegister, e.Len)
+		}
+	case *expr.Ct:
+		if e.SourceRegister {
+			if length := ctLength(e.Key); length != 0 {
+				eb.read(e.Register, length, true)
+			} else {
+				eb.read(e.Register, 1, false)
+			}
+		} else if length := ctLength(e.Key); length != 0 {
+			eb.load(e.Register, length)
+		} else {
+			eb.loadUnknown(e.Register, 16)
+		}
+	case *expr.Immediate:
+		eb.load(e.Register, uint32(len(e.Data)))
+	case *expr.Bitwise:
+		if uint32(len(e.Mask)) != e.Len || uint32(len(e.Xor)) != e.Len {
+			eb.fail(ErrRegisterLength, "bitwise of %d bytes with a mask of %d", e.Len, len(e.Mask))
+		}
+		eb.read(e.SourceRegister, e.Len, true)
+		eb.load(e.DestRegister, e.Len)
+	case *expr.Byteorder:
+		if e.Size != 2 && e.Size != 4 && e.Size != 8 || e.Len%e.Size != 0 {
+			eb.fail(ErrRegisterLength, "byteorder of %d bytes in units of %d", e.Len, e.Size)
+		}
+		eb.read(e.SourceRegister, e.Len, true)
+		eb.load(e.DestRegister, e.Len)
+	case *expr.Cmp:
+		eb.read(e.Register, uint32(len(e.Data)), true)
+	case *expr.Range:
+		if len(e.FromData) != len(e.ToData) {
+			eb.fail(ErrRegisterLength, "range from %d bytes to %d", len(e.FromData), len(e.ToData))
+		}
+		eb.read(e.Register, uint32(len(e.FromData)), true)
+	case *expr.Lookup:
+		eb.read(e.SourceRegister, 1, false)
+	case *expr.Dynset:
+		eb.read(e.SrcRegKey, 1, false)
+	case *expr.NAT:
+		length := uint32(net.IPv4len)
+		if e.Family == unix.NFPROTO_IPV6 {
+			length = net.IPv6len
+		}
+		if e.RegAddrMax != 0 && e.RegAddrMin == 0 || e.RegProtoMax != 0 && e.RegProtoMin == 0 {
+			eb.fail(ErrRegisterInvalid, "nat with a maximum but no minimum")
+		}
+		for _, register := range []uint32{e.RegAddrMin, e.RegAddrMax} {
+			if register != 0 {
+				eb.read(register, length, true)
+			}
+		}
+		for _, register := range []uint32{e.RegProtoMin, e.RegProtoMax} {
+			if register != 0 {
+				eb.read(register, 2, true)
+			}
+		}
+	case *expr.Verdict:
+		switch e.Kind {
+		case expr.VerdictAccept, expr.VerdictDrop, expr.VerdictReturn, expr.VerdictJump,
+			expr.VerdictGoto, expr.VerdictQueue, expr.VerdictStop:
+			eb.final = true
+		}
+	}
+}
+
 func (eb *ExprBuilder) MetaEgressInterface(register uint32) *ExprBuilder {
 	return eb.Append(
 		&expr.Meta{
@@ -83,14 +383,13 @@ func (eb *ExprBuilder) ComparePort(register uint32, port uint16) *ExprBuilder {
 	return eb.Append(
 		&expr.Cmp{
 			Op:       expr.CmpOpEq,
-			Register: 1,
+			Register: register,
 			Data:     data,
 		},
 	)
 }
 
 func (eb *ExprBuilder) ComparePortRange(register uint32, min, max uint16) *ExprBuilder {
-
 	from := make([]byte, 2)
 	binary.BigEndian.PutUint16(from, min)
 	to := make([]byte, 2)
@@ -98,7 +397,7 @@ func (eb *ExprBuilder) ComparePortRange(register uint32, min, max uint16) *ExprB
 	return eb.Append(
 		&expr.Range{
 			Op:       expr.CmpOpEq,
-			Register: 1,
+			Register: register,
 			FromData: from,
 			ToData:   to,
 		},
@@ -108,7 +407,7 @@ func (eb *ExprBuilder) ComparePortRange(register uint32, min, max uint16) *ExprB
 func (eb *ExprBuilder) PayloadIPSource(register uint32) *ExprBuilder {
 	return eb.Append(
 		&expr.Payload{
-			DestRegister: 1,
+			DestRegister: register,
 			Base:         expr.PayloadBaseNetworkHeader,
 			Offset:       12,
 			Len:          4,
@@ -119,7 +418,7 @@ func (eb *ExprBuilder) PayloadIPSource(register uint32) *ExprBuilder {
 func (eb *ExprBuilder) PayloadIPDestination(register uint32) *ExprBuilder {
 	return eb.Append(
 		&expr.Payload{
-			DestRegister: 1,
+			DestRegister: register,
 			Base:         expr.PayloadBaseNetworkHeader,
 			Offset:       16,
 			Len:          4,
@@ -127,6 +426,76 @@ func (eb *ExprBuilder) PayloadIPDestination(register uint32) *ExprBuilder {
 	)
 }
 
+func (eb *ExprBuilder) PayloadIP6Source(register uint32) *ExprBuilder {
+	return eb.Append(
+		&expr.Payload{
+			DestRegister: register,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       8,
+			Len:          16,
+		},
+	)
+}
+
+func (eb *ExprBuilder) PayloadIP6Destination(register uint32) *ExprBuilder {
+	return eb.Append(
+		&expr.Payload{
+			DestRegister: register,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       24,
+			Len:          16,
+		},
+	)
+}
+
+// Load the source address of the given family, which is either
+// nftables.TableFamilyIPv4 or nftables.TableFamilyIPv6.
+func (eb *ExprBuilder) PayloadSource(register uint32, family nftables.TableFamily) *ExprBuilder {
+	if family == nftables.TableFamilyIPv6 {
+		return eb.PayloadIP6Source(register)
+	}
+	return eb.PayloadIPSource(register)
+}
+
+// Load the destination address of the given family, which is either
+// nftables.TableFamilyIPv4 or nftables.TableFamilyIPv6.
+func (eb *ExprBuilder) PayloadDestination(register uint32, family nftables.TableFamily) *ExprBuilder {
+	if family == nftables.TableFamilyIPv6 {
+		return eb.PayloadIP6Destination(register)
+	}
+	return eb.PayloadIPDestination(register)
+}
+
+func (eb *ExprBuilder) MetaNFProto(register uint32) *ExprBuilder {
+	return eb.Append(
+		&expr.Meta{
+			Key:      expr.MetaKeyNFPROTO,
+			Register: register,
+		},
+	)
+}
+
+func (eb *ExprBuilder) CompareNFProto(register uint32, family nftables.TableFamily) *ExprBuilder {
+	return eb.Append(
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: register,
+			Data:     []byte{byte(family)},
+		},
+	)
+}
+
+// Match the network layer family of the packet in an inet table. Nothing is
+// emitted for nftables.TableFamilyINet, which matches both families.
+func (eb *ExprBuilder) MatchFamily(family nftables.TableFamily) *ExprBuilder {
+	if family == nftables.TableFamilyINet {
+		return eb
+	}
+	register := eb.alloc(1)
+	defer eb.release(register, 1)
+	return eb.MetaNFProto(register).CompareNFProto(register, family)
+}
+
 func (eb *ExprBuilder) CompareInterfaceName(register uint32, name string) *ExprBuilder {
 	return eb.Append(
 		&expr.Cmp{
@@ -137,107 +506,674 @@ func (eb *ExprBuilder) CompareInterfaceName(register uint32, name string) *ExprB
 	)
 }
 
+// Match the egress interface by its name.
+func (eb *ExprBuilder) MatchEgressInterface(name string) *ExprBuilder {
+	register := eb.alloc(unix.IFNAMSIZ)
+	defer eb.release(register, unix.IFNAMSIZ)
+	return eb.MetaEgressInterface(register).CompareInterfaceName(register, name)
+}
+
+// Match the ingress interface against a set of nftables.TypeIFName, e.g. the
+// set of a zone.
+func (eb *ExprBuilder) MatchIngressInterfaceSet(set *nftables.Set) *ExprBuilder {
+	if set == nil {
+		return eb
+	}
+	register := eb.alloc(unix.IFNAMSIZ)
+	defer eb.release(register, unix.IFNAMSIZ)
+	return eb.MetaIngressInterface(register).LookupSet(register, set)
+}
+
+// Match the egress interface against a set of nftables.TypeIFName.
+func (eb *ExprBuilder) MatchEgressInterfaceSet(set *nftables.Set) *ExprBuilder {
+	if set == nil {
+		return eb
+	}
+	register := eb.alloc(unix.IFNAMSIZ)
+	defer eb.release(register, unix.IFNAMSIZ)
+	return eb.MetaEgressInterface(register).LookupSet(register, set)
+}
+
 func (eb *ExprBuilder) CompareIPRange(register uint32, iprange *IPRange) *ExprBuilder {
 	return eb.Append(
 		&expr.Cmp{
 			Op:       expr.CmpOpGte,
 			Register: register,
-			Data:     iprange.First().To4(),
+			Data:     normalizeIP(iprange.First()),
 		},
 		&expr.Cmp{
 			Op:       expr.CmpOpLt,
 			Register: register,
-			Data:     iprange.End().To4(),
+			Data:     normalizeIP(iprange.End()),
 		},
 	)
 }
 
 func (eb *ExprBuilder) LookupZone(register uint32, zone *Zone) *ExprBuilder {
+	return eb.LookupSet(register, zone.set)
+}
+
+// Check that a register holds a key of a set before looking it up.
+func (eb *ExprBuilder) readKey(register uint32, set *nftables.Set) {
+	if set.KeyType.Bytes != 0 {
+		eb.read(register, set.KeyType.Bytes, !set.Concatenation)
+	}
+}
+
+func (eb *ExprBuilder) LookupSet(register uint32, set *nftables.Set) *ExprBuilder {
+	eb.readKey(register, set)
 	return eb.Append(
 		&expr.Lookup{
 			SourceRegister: register,
-			SetID:          zone.set.ID,
-			SetName:        zone.set.Name,
+			SetName:        set.Name,
+			SetID:          set.ID,
 		},
 	)
 }
 
-func (eb *ExprBuilder) LookupSet(register uint32, set *nftables.Set) *ExprBuilder {
-	if set.Anonymous {
-		return eb.Append(
-			&expr.Lookup{
-				SourceRegister: register,
-				SetName:        set.Name,
-				SetID:          set.ID,
+func (eb *ExprBuilder) LookupSetInvert(register uint32, set *nftables.Set) *ExprBuilder {
+	eb.readKey(register, set)
+	return eb.Append(
+		&expr.Lookup{
+			SourceRegister: register,
+			SetName:        set.Name,
+			SetID:          set.ID,
+			Invert:         true,
+		},
+	)
+}
+
+// Match an address set, inverted if it is negated, in the given family.
+func (eb *ExprBuilder) lookupAddress(register uint32, family nftables.TableFamily, set *AddressSet) *ExprBuilder {
+	if set.Negate {
+		return eb.LookupSetInvert(register, set.Family(family))
+	}
+	return eb.LookupSet(register, set.Family(family))
+}
+
+func addressLength(family nftables.TableFamily) uint32 {
+	if family == nftables.TableFamilyIPv6 {
+		return net.IPv6len
+	}
+	return net.IPv4len
+}
+
+// Match the source address against an address set in the given family.
+// Nothing is emitted if the set has no member in the family.
+func (eb *ExprBuilder) MatchSourceAddress(family nftables.TableFamily, set *AddressSet) *ExprBuilder {
+	if set == nil || set.Family(family) == nil {
+		return eb
+	}
+	register := eb.alloc(addressLength(family))
+	defer eb.release(register, addressLength(family))
+	return eb.PayloadSource(register, family).lookupAddress(register, family, set)
+}
+
+// Match the destination address against an address set in the given family.
+// Nothing is emitted if the set has no member in the family.
+func (eb *ExprBuilder) MatchDestinationAddress(family nftables.TableFamily, set *AddressSet) *ExprBuilder {
+	if set == nil || set.Family(family) == nil {
+		return eb
+	}
+	register := eb.alloc(addressLength(family))
+	defer eb.release(register, addressLength(family))
+	return eb.PayloadDestination(register, family).lookupAddress(register, family, set)
+}
+
+// Match the protocol, the port ranges and the other fields of a service. The
+// TTL and DSCP are in the network header, so they cannot be matched in
+// nftables.TableFamilyINet.
+func (eb *ExprBuilder) MatchService(family nftables.TableFamily, s *Service) *ExprBuilder {
+	if s == nil {
+		return eb
+	}
+	if family == nftables.TableFamilyINet && s.familySpecific() {
+		eb.fail(ErrServiceFamily, "ttl or dscp in an inet rule")
+		return eb
+	}
+
+	register := eb.alloc(2)
+	defer eb.release(register, 2)
+
+	eb.MetaL4Protocol(register).CompareL4Protocol(register, s.Protocol)
+
+	if s.SourcePortMin != 0 && s.SourcePortMax != 0 {
+		eb.LoadSourcePort(register).ComparePortRange(register, s.SourcePortMin, s.SourcePortMax)
+	}
+
+	if s.DestinationPortMin != 0 && s.DestinationPortMax != 0 {
+		eb.LoadDestinationPort(register).ComparePortRange(register, s.DestinationPortMin, s.DestinationPortMax)
+	}
+
+	if s.isICMP() {
+		eb.MatchICMP(s.ICMPType, s.ICMPCode)
+	}
+
+	if s.Protocol == unix.IPPROTO_TCP && s.TCPFlags|s.TCPFlagsMask != 0 {
+		mask := s.TCPFlagsMask
+		if mask == 0 {
+			mask = s.TCPFlags
+		}
+		eb.MatchTCPFlags(s.TCPFlags, mask)
+	}
+
+	if s.LengthMax != 0 {
+		eb.MatchLength(s.LengthMin, s.LengthMax)
+	}
+
+	if s.TTLMax != 0 {
+		eb.MatchTTL(family, s.TTLMin, s.TTLMax)
+	}
+
+	if s.DSCP != nil {
+		eb.MatchDSCP(family, *s.DSCP)
+	}
+
+	return eb
+}
+
+func (eb *ExprBuilder) LoadICMPType(register uint32) *ExprBuilder {
+	return eb.Append(
+		&expr.Payload{
+			DestRegister: register,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       0,
+			Len:          1,
+		},
+	)
+}
+
+func (eb *ExprBuilder) LoadICMPCode(register uint32) *ExprBuilder {
+	return eb.Append(
+		&expr.Payload{
+			DestRegister: register,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       1,
+			Len:          1,
+		},
+	)
+}
+
+func (eb *ExprBuilder) CompareByte(register uint32, value uint8) *ExprBuilder {
+	return eb.Append(
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: register,
+			Data:     []byte{value},
+		},
+	)
+}
+
+func (eb *ExprBuilder) CompareByteRange(register uint32, min, max uint8) *ExprBuilder {
+	return eb.Append(
+		&expr.Range{
+			Op:       expr.CmpOpEq,
+			Register: register,
+			FromData: []byte{min},
+			ToData:   []byte{max},
+		},
+	)
+}
+
+// Match the type and the code of an ICMP or ICMPv6 packet, whichever is
+// matched before. A nil type or code is not matched.
+func (eb *ExprBuilder) MatchICMP(t *uint8, code *uint8) *ExprBuilder {
+	if t == nil && code == nil {
+		return eb
+	}
+	register := eb.alloc(1)
+	defer eb.release(register, 1)
+	if t != nil {
+		eb.LoadICMPType(register).CompareByte(register, *t)
+	}
+	if code != nil {
+		eb.LoadICMPCode(register).CompareByte(register, *code)
+	}
+	return eb
+}
+
+func (eb *ExprBuilder) LoadTCPFlags(register uint32) *ExprBuilder {
+	return eb.Append(
+		&expr.Payload{
+			DestRegister: register,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       13,
+			Len:          1,
+		},
+	)
+}
+
+// Keep the bits of a mask in a register, e.g. some of the TCP flags.
+func (eb *ExprBuilder) MaskBits(register uint32, mask []byte) *ExprBuilder {
+	return eb.Append(
+		&expr.Bitwise{
+			SourceRegister: register,
+			DestRegister:   register,
+			Len:            uint32(len(mask)),
+			Mask:           mask,
+			Xor:            make([]byte, len(mask)),
+		},
+	)
+}
+
+// Match the TCP flags in mask to be exactly the flags, e.g. TCPFlagSYN out of
+// TCPFlagSYN|TCPFlagACK.
+func (eb *ExprBuilder) MatchTCPFlags(flags TCPFlags, mask TCPFlags) *ExprBuilder {
+	register := eb.alloc(1)
+	defer eb.release(register, 1)
+	return eb.LoadTCPFlags(register).
+		MaskBits(register, []byte{byte(mask)}).
+		CompareByte(register, byte(flags))
+}
+
+func (eb *ExprBuilder) MetaLength(register uint32) *ExprBuilder {
+	return eb.Append(
+		&expr.Meta{
+			Key:      expr.MetaKeyLEN,
+			Register: register,
+		},
+	)
+}
+
+// Convert the integers of size bytes in a register from host to network byte
+// order, so that they can be compared with a range.
+func (eb *ExprBuilder) HostToNetwork(register uint32, length uint32, size uint32) *ExprBuilder {
+	return eb.Append(
+		&expr.Byteorder{
+			SourceRegister: register,
+			DestRegister:   register,
+			Op:             expr.ByteorderHton,
+			Len:            length,
+			Size:           size,
+		},
+	)
+}
+
+// Compare a 4-byte integer in network byte order with a range.
+func (eb *ExprBuilder) CompareIntegerRange(register uint32, min, max uint32) *ExprBuilder {
+	return eb.Append(
+		&expr.Range{
+			Op:       expr.CmpOpEq,
+			Register: register,
+			FromData: binaryutil.BigEndian.PutUint32(min),
+			ToData:   binaryutil.BigEndian.PutUint32(max),
+		},
+	)
+}
+
+// Match the length of the packet, which meta loads in host byte order.
+func (eb *ExprBuilder) MatchLength(min, max uint16) *ExprBuilder {
+	register := eb.alloc(4)
+	defer eb.release(register, 4)
+	return eb.MetaLength(register).
+		HostToNetwork(register, 4, 4).
+		CompareIntegerRange(register, uint32(min), uint32(max))
+}
+
+// Load the time a packet is seen, as nanoseconds since the epoch, the day of
+// the week or the seconds since midnight, by the key of meta.
+func (eb *ExprBuilder) MetaTime(register uint32, key expr.MetaKey) *ExprBuilder {
+	return eb.Append(
+		&expr.Meta{
+			Key:      key,
+			Register: register,
+		},
+	)
+}
+
+// Match the day of the week a packet is seen, Sunday being 0. The kernel
+// counts days in its own time zone, which is UTC unless set at boot.
+func (eb *ExprBuilder) MatchWeekday(min, max time.Weekday) *ExprBuilder {
+	register := eb.alloc(1)
+	defer eb.release(register, 1)
+	eb.MetaTime(register, metaKeyTimeDay)
+	if min == max {
+		return eb.CompareByte(register, uint8(min))
+	}
+	return eb.CompareByteRange(register, uint8(min), uint8(max))
+}
+
+// Match the seconds since midnight in UTC a packet is seen at, which meta
+// loads in host byte order.
+func (eb *ExprBuilder) MatchHour(min, max uint32) *ExprBuilder {
+	register := eb.alloc(4)
+	defer eb.release(register, 4)
+	return eb.MetaTime(register, metaKeyTimeHour).
+		HostToNetwork(register, 4, 4).
+		CompareIntegerRange(register, min, max)
+}
+
+// Match packets seen from one instant up to another one, both included.
+func (eb *ExprBuilder) MatchTime(from, to time.Time) *ExprBuilder {
+	register := eb.alloc(8)
+	defer eb.release(register, 8)
+	return eb.MetaTime(register, metaKeyTimeNS).
+		HostToNetwork(register, 8, 8).
+		Append(
+			&expr.Range{
+				Op:       expr.CmpOpEq,
+				Register: register,
+				FromData: binaryutil.BigEndian.PutUint64(uint64(from.UnixNano())),
+				ToData:   binaryutil.BigEndian.PutUint64(uint64(to.UnixNano())),
 			},
 		)
+}
+
+func (eb *ExprBuilder) PayloadIPTTL(register uint32) *ExprBuilder {
+	return eb.Append(
+		&expr.Payload{
+			DestRegister: register,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       8,
+			Len:          1,
+		},
+	)
+}
+
+func (eb *ExprBuilder) PayloadIP6HopLimit(register uint32) *ExprBuilder {
+	return eb.Append(
+		&expr.Payload{
+			DestRegister: register,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       7,
+			Len:          1,
+		},
+	)
+}
+
+// Match the TTL of IPv4 or the hop limit of IPv6.
+func (eb *ExprBuilder) MatchTTL(family nftables.TableFamily, min, max uint8) *ExprBuilder {
+	register := eb.alloc(1)
+	defer eb.release(register, 1)
+	if family == nftables.TableFamilyIPv6 {
+		eb.PayloadIP6HopLimit(register)
 	} else {
-		return eb.Append(
-			&expr.Lookup{
-				SourceRegister: register,
-				SetName:        set.Name,
-				SetID:          set.ID,
-			},
-		)
+		eb.PayloadIPTTL(register)
 	}
+	if min == max {
+		return eb.CompareByte(register, min)
+	}
+	return eb.CompareByteRange(register, min, max)
 }
 
-func (eb *ExprBuilder) Masquerade() *ExprBuilder {
-	return eb.Append(&expr.Masq{})
+// Load the byte of the IPv4 header holding the DSCP in its upper 6 bits.
+func (eb *ExprBuilder) PayloadIPDSCP(register uint32) *ExprBuilder {
+	return eb.Append(
+		&expr.Payload{
+			DestRegister: register,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       1,
+			Len:          1,
+		},
+	)
 }
 
-func (eb *ExprBuilder) SourceNATIP(first net.IP, last net.IP) *ExprBuilder {
+// Load the 2 bytes of the IPv6 header holding the DSCP in bits 4 to 9.
+func (eb *ExprBuilder) PayloadIP6DSCP(register uint32) *ExprBuilder {
 	return eb.Append(
-		&expr.Immediate{
-			Register: 1,
-			Data:     first.To4(),
+		&expr.Payload{
+			DestRegister: register,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       0,
+			Len:          2,
 		},
-		&expr.Immediate{
-			Register: 2,
-			Data:     last.To4(),
+	)
+}
+
+// Match the DSCP of the traffic class, which is not aligned to bytes.
+func (eb *ExprBuilder) MatchDSCP(family nftables.TableFamily, dscp uint8) *ExprBuilder {
+	register := eb.alloc(2)
+	defer eb.release(register, 2)
+	if family == nftables.TableFamilyIPv6 {
+		return eb.PayloadIP6DSCP(register).
+			MaskBits(register, []byte{0x0f, 0xc0}).
+			Append(&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: register,
+				Data:     binaryutil.BigEndian.PutUint16(uint16(dscp) << 6),
+			})
+	}
+	return eb.PayloadIPDSCP(register).
+		MaskBits(register, []byte{0xfc}).
+		CompareByte(register, dscp<<2)
+}
+
+// A primitive loading a field into a register, e.g.
+// (*ExprBuilder).PayloadIPSource.
+type Loader func(eb *ExprBuilder, register uint32) *ExprBuilder
+
+// Match a concatenation of fields against a set keyed by their
+// concatenation, e.g. "ip saddr . tcp dport". Each field is loaded into the
+// 4-byte registers following the previous one.
+func (eb *ExprBuilder) MatchConcat(set *nftables.Set, loaders ...Loader) *ExprBuilder {
+	if set == nil || len(loaders) == 0 {
+		return eb
+	}
+
+	length := set.KeyType.Bytes
+	register := eb.alloc(length)
+	defer eb.release(register, length)
+
+	// 16-byte registers are not used, so that the fields follow each other
+	index, _ := registerIndex(register)
+	next := unix.NFT_REG32_00 + uint32(index)
+	for _, loader := range loaders {
+		start := len(eb.expr)
+		loader(eb, next)
+		if len(eb.expr) == start {
+			eb.fail(ErrRegisterUnloaded, "field %d of concatenation loads nothing", len(loaders))
+			return eb
+		}
+		index, _ := registerIndex(next)
+		next += uint32(registerCount(eb.length[index]))
+	}
+
+	if loaded := (next - unix.NFT_REG32_00 - uint32(index)) * registerSize; loaded != length {
+		eb.fail(ErrRegisterLength, "concatenation of %d bytes for a key of %d", loaded, length)
+		return eb
+	}
+
+	return eb.LookupSet(unix.NFT_REG32_00+uint32(index), set)
+}
+
+func (eb *ExprBuilder) MetaIngressInterfaceType(register uint32) *ExprBuilder {
+	return eb.Append(
+		&expr.Meta{
+			Key:      expr.MetaKeyIIFTYPE,
+			Register: register,
 		},
-		&expr.NAT{
-			Type:        expr.NATTypeSourceNAT,
-			Family:      unix.NFPROTO_IPV4,
-			RegAddrMin:  1,
-			RegProtoMax: 2,
+	)
+}
+
+// Compare an interface type loaded by MetaIngressInterfaceType, e.g.
+// unix.ARPHRD_ETHER.
+func (eb *ExprBuilder) CompareInterfaceType(register uint32, t uint16) *ExprBuilder {
+	return eb.Append(
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: register,
+			Data:     binaryutil.NativeEndian.PutUint16(t),
 		},
 	)
 }
 
-func (eb *ExprBuilder) SourceNATIPRange(start net.IP, end net.IP) *ExprBuilder {
+func (eb *ExprBuilder) PayloadEtherSource(register uint32) *ExprBuilder {
+	return eb.Append(
+		&expr.Payload{
+			DestRegister: register,
+			Base:         expr.PayloadBaseLLHeader,
+			Offset:       6,
+			Len:          6,
+		},
+	)
+}
+
+// Match the ethernet source address against a set of nftables.TypeEtherAddr.
+// Packets from interfaces other than ethernet never match, since they have no
+// such header.
+func (eb *ExprBuilder) MatchSourceMAC(set *nftables.Set) *ExprBuilder {
+	if set == nil {
+		return eb
+	}
+	register := eb.alloc(6)
+	defer eb.release(register, 6)
+	return eb.MetaIngressInterfaceType(register).
+		CompareInterfaceType(register, unix.ARPHRD_ETHER).
+		PayloadEtherSource(register).
+		LookupSet(register, set)
+}
+
+func (eb *ExprBuilder) Masquerade() *ExprBuilder {
+	return eb.Append(&expr.Masq{})
+}
+
+// Get the netfilter protocol family of an IP.
+func natFamily(ip net.IP) uint32 {
+	if ip.To4() != nil {
+		return unix.NFPROTO_IPV4
+	}
+	return unix.NFPROTO_IPV6
+}
+
+// Translate the source address into one from first to last, which are of the
+// same family.
+func (eb *ExprBuilder) SourceNATIP(first net.IP, last net.IP) *ExprBuilder {
+	first, last = normalizeIP(first), normalizeIP(last)
+	if len(first) != len(last) {
+		eb.fail(ErrRegisterLength, "snat from %s to %s", first, last)
+		return eb
+	}
+
+	length := uint32(len(first))
+	min := eb.alloc(length)
+	max := eb.alloc(length)
+	defer eb.release(min, length)
+	defer eb.release(max, length)
+
 	return eb.Append(
 		&expr.Immediate{
-			Register: 1,
-			Data:     start.To4(),
+			Register: min,
+			Data:     first,
 		},
 		&expr.Immediate{
-			Register: 2,
-			Data:     end.To4(),
+			Register: max,
+			Data:     last,
 		},
 		&expr.NAT{
 			Type:       expr.NATTypeSourceNAT,
-			Family:     unix.NFPROTO_IPV4,
-			RegAddrMin: 1,
-			RegAddrMax: 2,
+			Family:     natFamily(first),
+			RegAddrMin: min,
+			RegAddrMax: max,
 		},
 	)
 }
 
+func (eb *ExprBuilder) SourceNATIPRange(start net.IP, end net.IP) *ExprBuilder {
+	return eb.SourceNATIP(start, end)
+}
+
 func (eb *ExprBuilder) ConntrackState(state uint32) *ExprBuilder {
+	register := eb.alloc(4)
+	defer eb.release(register, 4)
 	return eb.Append(
-		&expr.Ct{Register: 1, SourceRegister: false, Key: expr.CtKeySTATE},
+		&expr.Ct{Register: register, SourceRegister: false, Key: expr.CtKeySTATE},
 		&expr.Bitwise{
-			SourceRegister: 1,
-			DestRegister:   1,
+			SourceRegister: register,
+			DestRegister:   register,
 			Len:            4,
 			Mask:           binaryutil.NativeEndian.PutUint32(state),
 			Xor:            binaryutil.NativeEndian.PutUint32(0),
 		},
-		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: register, Data: binaryutil.NativeEndian.PutUint32(0)},
+	)
+}
+
+func (eb *ExprBuilder) MatchConntrackMark(mark uint32) *ExprBuilder {
+	register := eb.alloc(4)
+	defer eb.release(register, 4)
+	return eb.Append(
+		&expr.Ct{Register: register, Key: expr.CtKeyMARK},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: register, Data: binaryutil.NativeEndian.PutUint32(mark)},
 	)
 }
 
+// Set the mark of the connection of packets, which is kept by the packets
+// following them.
+func (eb *ExprBuilder) SetConntrackMark(mark uint32) *ExprBuilder {
+	register := eb.alloc(4)
+	defer eb.release(register, 4)
+	return eb.Append(
+		&expr.Immediate{Register: register, Data: binaryutil.NativeEndian.PutUint32(mark)},
+		&expr.Ct{Register: register, SourceRegister: true, Key: expr.CtKeyMARK},
+	)
+}
+
+// Charge packets to a named quota object, matching them as the object is
+// flagged, e.g. beyond the quota.
+func (eb *ExprBuilder) Quota(name string) *ExprBuilder {
+	return eb.Append(&expr.Objref{Type: nftObjectQuota, Name: name})
+}
+
+// Match packets within a rate, or beyond it if over is set.
+func (eb *ExprBuilder) Limit(l *RateLimit, over bool) *ExprBuilder {
+	return eb.Append(l.expr(over))
+}
+
+// Update the element keyed by a register in a dynamic set, adding it if it is
+// missing, and match the expressions of the element, e.g. a limit.
+func (eb *ExprBuilder) UpdateSet(register uint32, set *nftables.Set, exprs ...expr.Any) *ExprBuilder {
+	eb.readKey(register, set)
+	return eb.Append(
+		&expr.Dynset{
+			SrcRegKey: register,
+			SetName:   set.Name,
+			SetID:     set.ID,
+			Operation: unix.NFT_DYNSET_OP_UPDATE,
+			Timeout:   set.Timeout,
+			Exprs:     exprs,
+		},
+	)
+}
+
+// Add the element keyed by a register to a dynamic set, if it is missing, and
+// match the expressions of the element, e.g. a connection count.
+func (eb *ExprBuilder) AddToSet(register uint32, set *nftables.Set, exprs ...expr.Any) *ExprBuilder {
+	eb.readKey(register, set)
+	return eb.Append(
+		&expr.Dynset{
+			SrcRegKey: register,
+			SetName:   set.Name,
+			SetID:     set.ID,
+			Operation: unix.NFT_DYNSET_OP_ADD,
+			Timeout:   set.Timeout,
+			Exprs:     exprs,
+		},
+	)
+}
+
+// Match the rate of packets from each source address, kept in a meter of
+// dynamic sets, to be within the limit or beyond it if over is set.
+func (eb *ExprBuilder) MatchSourceRate(family nftables.TableFamily, meter *AddressSet, l *RateLimit, over bool) *ExprBuilder {
+	length := addressLength(family)
+	register := eb.alloc(length)
+	defer eb.release(register, length)
+	return eb.PayloadSource(register, family).UpdateSet(register, meter.Family(family), l.expr(over))
+}
+
+// Match the number of connections tracked from each source address, kept in
+// a meter of dynamic sets, to be at most count or beyond it if over is set.
+func (eb *ExprBuilder) MatchSourceConnections(family nftables.TableFamily, meter *AddressSet, count uint32, over bool) *ExprBuilder {
+	connlimit := &expr.Connlimit{Count: count}
+	if over {
+		connlimit.Flags = expr.NFT_CONNLIMIT_F_INV
+	}
+
+	length := addressLength(family)
+	register := eb.alloc(length)
+	defer eb.release(register, length)
+	return eb.PayloadSource(register, family).AddToSet(register, meter.Family(family), connlimit)
+}
+
 func (eb *ExprBuilder) VerdictDrop() *ExprBuilder {
 	return eb.Append(
 		&expr.Verdict{
@@ -254,30 +1190,52 @@ func (eb *ExprBuilder) VerdictAccept() *ExprBuilder {
 	)
 }
 
-func (eb *ExprBuilder) LogIPOptions(prefix string) *ExprBuilder {
+// Jump to a chain, going on with the rule following once it returns.
+func (eb *ExprBuilder) VerdictJump(chain string) *ExprBuilder {
+	return eb.Append(
+		&expr.Verdict{
+			Kind:  expr.VerdictJump,
+			Chain: chain,
+		},
+	)
+}
+
+// Log packets with a prefix and flags, e.g. expr.LogFlagsIPOpt. The key of
+// the expression flags both, as the attributes missing in the key are not
+// sent to the kernel.
+func (eb *ExprBuilder) Log(prefix string, flags expr.LogFlags) *ExprBuilder {
 	return eb.Append(
 		&expr.Log{
+			Key:   1<<unix.NFTA_LOG_PREFIX | 1<<unix.NFTA_LOG_FLAGS,
 			Data:  []byte(prefix),
-			Flags: expr.LogFlagsIPOpt,
+			Flags: flags,
 		},
 	)
 }
 
+func (eb *ExprBuilder) LogIPOptions(prefix string) *ExprBuilder {
+	return eb.Log(prefix, expr.LogFlagsIPOpt)
+}
+
 func (eb *ExprBuilder) Counter() *ExprBuilder {
 	return eb.Append(
 		&expr.Counter{},
 	)
 }
 
+// Append expressions, checking them against the registers.
 func (eb *ExprBuilder) Append(args ...expr.Any) *ExprBuilder {
-	eb.expr = append(eb.expr, args...)
+	for _, e := range args {
+		eb.check(e)
+		eb.expr = append(eb.expr, e)
+	}
 
 	return eb
 }
 
 func (eb *ExprBuilder) AppendGroup(args ...[]expr.Any) *ExprBuilder {
 	for _, group := range args {
-		eb.expr = append(eb.expr, group...)
+		eb.Append(group...)
 	}
 
 	return eb
@@ -0,0 +1,160 @@
+package yafw
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func TestExprBuilderGolden(t *testing.T) {
+	lan := &nftables.Set{Name: "ipset6-lan", KeyType: nftables.TypeIP6Addr}
+	concat, err := nftables.ConcatSetType(nftables.TypeIPAddr, nftables.TypeInetService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services := &nftables.Set{Name: "services", KeyType: concat, Concatenation: true}
+
+	for _, c := range []struct {
+		name     string
+		builder  *ExprBuilder
+		expected []expr.Any
+	}{
+		{
+			"explicit registers",
+			(&ExprBuilder{}).PayloadIPSource(3).PayloadIPDestination(4).
+				LoadDestinationPort(2).ComparePortRange(2, 80, 443).
+				LoadSourcePort(unix.NFT_REG32_00).ComparePort(unix.NFT_REG32_00, 53),
+			[]expr.Any{
+				&expr.Payload{DestRegister: 3, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+				&expr.Payload{DestRegister: 4, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+				&expr.Payload{DestRegister: 2, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+				&expr.Range{Op: expr.CmpOpEq, Register: 2, FromData: []byte{0, 80}, ToData: []byte{1, 187}},
+				&expr.Payload{DestRegister: unix.NFT_REG32_00, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 2},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: unix.NFT_REG32_00, Data: []byte{0, 53}},
+			},
+		},
+		{
+			"allocated address match",
+			(&ExprBuilder{}).MatchFamily(nftables.TableFamilyIPv6).
+				MatchSourceAddress(nftables.TableFamilyIPv6, &AddressSet{V6: lan}).
+				VerdictAccept(),
+			[]expr.Any{
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV6}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 16},
+				&expr.Lookup{SourceRegister: 1, SetName: "ipset6-lan"},
+				&expr.Verdict{Kind: expr.VerdictAccept},
+			},
+		},
+		{
+			"source nat to a range",
+			(&ExprBuilder{}).SourceNATIP(net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.8")),
+			[]expr.Any{
+				&expr.Immediate{Register: 1, Data: []byte{192, 0, 2, 1}},
+				&expr.Immediate{Register: 2, Data: []byte{192, 0, 2, 8}},
+				&expr.NAT{Type: expr.NATTypeSourceNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1, RegAddrMax: 2},
+			},
+		},
+		{
+			"concatenation",
+			(&ExprBuilder{}).MatchConcat(services, (*ExprBuilder).PayloadIPDestination, (*ExprBuilder).LoadDestinationPort),
+			[]expr.Any{
+				&expr.Payload{DestRegister: unix.NFT_REG32_00, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+				&expr.Payload{DestRegister: unix.NFT_REG32_01, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+				&expr.Lookup{SourceRegister: unix.NFT_REG32_00, SetName: "services"},
+			},
+		},
+	} {
+		exprs, err := c.builder.Build()
+		if err != nil {
+			t.Fatalf("test assert error: %s: %v", c.name, err)
+		}
+		if !reflect.DeepEqual(exprs, c.expected) {
+			t.Fatalf("test assert error: %s: built %q (expecting %q)", c.name, Decompile(exprs), Decompile(c.expected))
+		}
+	}
+
+	if text := Decompile((&ExprBuilder{}).MatchConcat(services, (*ExprBuilder).PayloadIPDestination, (*ExprBuilder).LoadDestinationPort).Exprs()).String(); text != "ip daddr . th dport @services" {
+		t.Fatalf("test assert error: concatenation decompiled as %q", text)
+	}
+}
+
+func TestExprBuilderInvalid(t *testing.T) {
+	exhausted := &ExprBuilder{}
+	for i := 0; i < 5; i++ {
+		exhausted.alloc(16)
+	}
+
+	for _, c := range []struct {
+		name     string
+		builder  *ExprBuilder
+		expected error
+	}{
+		{
+			"compare before load",
+			(&ExprBuilder{}).CompareL4Protocol(1, unix.IPPROTO_TCP),
+			ErrRegisterUnloaded,
+		},
+		{
+			"port compared with an address",
+			(&ExprBuilder{}).PayloadIPSource(1).ComparePort(1, 80),
+			ErrRegisterLength,
+		},
+		{
+			"address lookup in a set of another family",
+			(&ExprBuilder{}).PayloadIPSource(1).LookupSet(1, &nftables.Set{Name: "v6", KeyType: nftables.TypeIP6Addr}),
+			ErrRegisterUnloaded,
+		},
+		{
+			"nat address maximum without minimum",
+			(&ExprBuilder{}).Append(
+				&expr.Immediate{Register: 1, Data: []byte{192, 0, 2, 1}},
+				&expr.NAT{Type: expr.NATTypeSourceNAT, Family: unix.NFPROTO_IPV4, RegAddrMax: 1},
+			),
+			ErrRegisterInvalid,
+		},
+		{
+			"nat port register holding an address",
+			(&ExprBuilder{}).Append(
+				&expr.Immediate{Register: 1, Data: []byte{192, 0, 2, 1}},
+				&expr.Immediate{Register: 2, Data: []byte{192, 0, 2, 8}},
+				&expr.NAT{Type: expr.NATTypeSourceNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1, RegProtoMin: 2},
+			),
+			ErrRegisterLength,
+		},
+		{
+			"data into the verdict register",
+			(&ExprBuilder{}).Append(&expr.Immediate{Register: unix.NFT_REG_VERDICT, Data: []byte{1}}),
+			ErrRegisterInvalid,
+		},
+		{
+			"address beyond the last register",
+			(&ExprBuilder{}).PayloadIP6Source(unix.NFT_REG32_14),
+			ErrRegisterOverflow,
+		},
+		{
+			"expression after verdict",
+			(&ExprBuilder{}).VerdictDrop().Counter(),
+			ErrExprAfterVerdict,
+		},
+		{
+			"concatenation shorter than the key",
+			(&ExprBuilder{}).MatchConcat(&nftables.Set{Name: "s", KeyType: nftables.TypeIP6Addr}, (*ExprBuilder).PayloadIPSource),
+			ErrRegisterLength,
+		},
+		{
+			"no free register",
+			exhausted.MatchFamily(nftables.TableFamilyIPv4),
+			ErrRegisterExhausted,
+		},
+	} {
+		if _, err := c.builder.Build(); !errors.Is(err, c.expected) {
+			t.Fatalf("test assert error: %s: built with %v (expecting %v)", c.name, err, c.expected)
+		}
+	}
+}
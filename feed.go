@@ -0,0 +1,329 @@
+package yafw
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrFeedNotFound = errors.New("feed not found")
+	ErrFeedInvalid  = errors.New("invalid feed")
+)
+
+// The number of rejected lines kept for display by a feed.
+const feedRejectedMax = 100
+
+// A line of a feed which is not understood.
+type FeedRejected struct {
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+// Parse a blocklist feed into IP ranges, along with the lines rejected.
+//
+// Each line holds a host, a CIDR or an interval as accepted by
+// NewIPRangeString. Anything after "#" or ";" is a comment, and for CSV or
+// annotated lines only the first field, separated by a comma or spaces, is
+// used. Empty lines are ignored.
+func ParseFeed(reader io.Reader) ([]*IPRange, []FeedRejected, error) {
+	ranges := []*IPRange{}
+	rejected := []FeedRejected{}
+
+	scanner := bufio.NewScanner(reader)
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		text := scanner.Text()
+		if i := strings.IndexAny(text, "#;"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		field := text
+		if i := strings.Index(field, ","); i >= 0 {
+			field = strings.TrimSpace(field[:i])
+		}
+
+		// intervals may be written with spaces around the dash
+		iprange := NewIPRangeString(field)
+		if iprange == nil {
+			if fields := strings.Fields(field); len(fields) > 0 {
+				iprange = NewIPRangeString(fields[0])
+			}
+		}
+		if iprange == nil {
+			rejected = append(rejected, FeedRejected{Line: line, Text: text})
+			continue
+		}
+
+		ranges = append(ranges, iprange)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return ranges, rejected, nil
+}
+
+// Parse a feed file, see ParseFeed for the format.
+func ParseFeedFile(path string) ([]*IPRange, []FeedRejected, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	return ParseFeed(file)
+}
+
+// A feed file loaded into a named IPSet, which is managed by yafw while the
+// feed is attached.
+type Feed struct {
+	ipset *IPSet
+
+	Path string
+
+	// period of reloading the file even if it is not changed, or 0 to reload
+	// it only on changes
+	Interval time.Duration
+
+	state    fileState
+	loadedAt time.Time
+	entries  int
+	rejected []FeedRejected
+	// number of rejected lines, including those not kept
+	rejectedCount int
+	err           error
+}
+
+func (f *Feed) IPSet() *IPSet {
+	return f.ipset
+}
+
+// Get the lines rejected in the last load, up to feedRejectedMax of them.
+func (f *Feed) Rejected() []FeedRejected {
+	return f.rejected
+}
+
+func (f *Feed) LoadedAt() time.Time {
+	return f.loadedAt
+}
+
+func (f *Feed) Err() error {
+	return f.err
+}
+
+func (f *Feed) MarshalJSON() ([]byte, error) {
+	message := ""
+	if f.err != nil {
+		message = f.err.Error()
+	}
+
+	return json.Marshal(struct {
+		IPSet         string         `json:"ipset"`
+		Path          string         `json:"path"`
+		Interval      int64          `json:"interval"`
+		LoadedAt      time.Time      `json:"loaded_at"`
+		Entries       int            `json:"entries"`
+		Rejected      []FeedRejected `json:"rejected"`
+		RejectedCount int            `json:"rejected_count"`
+		Error         string         `json:"error"`
+	}{
+		IPSet:         f.ipset.name,
+		Path:          f.Path,
+		Interval:      int64(f.Interval / time.Second),
+		LoadedAt:      f.loadedAt,
+		Entries:       f.entries,
+		Rejected:      f.rejected,
+		RejectedCount: f.rejectedCount,
+		Error:         message,
+	})
+}
+
+// Check whether the feed has to be reloaded at the moment.
+func (f *Feed) due(now time.Time) (fileState, bool) {
+	state, err := statFile(f.Path)
+	if err != nil {
+		// reported on loading, unless it is already
+		return state, f.err == nil
+	}
+
+	if state != f.state {
+		return state, true
+	}
+
+	return state, f.Interval > 0 && now.Sub(f.loadedAt) >= f.Interval
+}
+
+type FeedTable struct {
+	r *Router
+
+	// IPSet names to their feeds
+	m map[string]*Feed
+
+	// interval of checking the feeds for changes
+	PollInterval time.Duration
+}
+
+func NewFeedTable(r *Router) *FeedTable {
+	return &FeedTable{
+		r:            r,
+		m:            make(map[string]*Feed),
+		PollInterval: 10 * time.Second,
+	}
+}
+
+// Attach a feed file to a named IPSet, which becomes dynamic until the feed is
+// detached. The feed is not loaded until Load or Run.
+func (t *FeedTable) Attach(name string, path string, interval time.Duration) (*Feed, error) {
+	if path == "" {
+		return nil, fmt.Errorf("%w: no file", ErrFeedInvalid)
+	}
+	if interval < 0 {
+		return nil, fmt.Errorf("%w: negative interval %v", ErrFeedInvalid, interval)
+	}
+
+	ipset := t.r.FindIPSet(name)
+	if ipset == nil {
+		return nil, ErrIPSetNotFound
+	}
+	if ipset.dynamic {
+		return nil, ErrIPSetDynamic
+	}
+
+	t.r.stageIPSet(ipset)
+	ipset.dynamic = true
+	feed := &Feed{
+		ipset:    ipset,
+		Path:     path,
+		Interval: interval,
+	}
+	t.m[name] = feed
+
+	return feed, nil
+}
+
+// Detach the feed of an IPSet. The IPSet keeps the members last loaded, and
+// can be edited again.
+func (t *FeedTable) Detach(name string) error {
+	feed, ok := t.m[name]
+	if !ok {
+		return ErrFeedNotFound
+	}
+
+	t.r.stageIPSet(feed.ipset)
+	feed.ipset.dynamic = false
+	delete(t.m, name)
+
+	return nil
+}
+
+func (t *FeedTable) Find(name string) *Feed {
+	return t.m[name]
+}
+
+// Get all the feeds, ordered by IPSet name.
+func (t *FeedTable) All() []*Feed {
+	ret := make([]*Feed, 0, len(t.m))
+	for _, feed := range t.m {
+		ret = append(ret, feed)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ipset.name < ret[j].ipset.name })
+
+	return ret
+}
+
+// Load the feed of an IPSet, pushing the changed elements into it. The router
+// has to be locked by the caller.
+func (t *FeedTable) Load(name string) error {
+	feed, ok := t.m[name]
+	if !ok {
+		return ErrFeedNotFound
+	}
+
+	state, _ := statFile(feed.Path)
+	ranges, rejected, err := ParseFeedFile(feed.Path)
+
+	return t.apply(feed, state, ranges, rejected, err)
+}
+
+func (t *FeedTable) apply(feed *Feed, state fileState, ranges []*IPRange, rejected []FeedRejected, err error) error {
+	feed.loadedAt = time.Now()
+	feed.err = err
+	if err != nil {
+		// the entries last loaded are kept
+		return err
+	}
+
+	feed.state = state
+	feed.entries = len(ranges)
+	feed.rejectedCount = len(rejected)
+	if len(rejected) > feedRejectedMax {
+		rejected = rejected[:feedRejectedMax]
+	}
+	feed.rejected = rejected
+
+	tx := t.r.Begin()
+	if feed.err = t.r.UpdateIPSet(feed.ipset.ReplaceIPRanges(ranges)); feed.err != nil {
+		tx.Rollback()
+	} else {
+		feed.err = tx.Commit()
+	}
+
+	return feed.err
+}
+
+// Reload the feeds whenever their files change on disk or their interval
+// passes, until ctx is done. The files are parsed without the router locked.
+func (t *FeedTable) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		type dueFeed struct {
+			feed  *Feed
+			path  string
+			state fileState
+		}
+
+		t.r.Lock()
+		now := time.Now()
+		feeds := []dueFeed{}
+		for _, feed := range t.m {
+			if state, due := feed.due(now); due {
+				feeds = append(feeds, dueFeed{feed: feed, path: feed.Path, state: state})
+			}
+		}
+		t.r.Unlock()
+
+		for _, due := range feeds {
+			ranges, rejected, err := ParseFeedFile(due.path)
+
+			t.r.Lock()
+			// the feed may be detached meanwhile
+			if t.m[due.feed.ipset.name] == due.feed {
+				t.apply(due.feed, due.state, ranges, rejected, err)
+			}
+			t.r.Unlock()
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package yafw
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+func TestParseFeed(t *testing.T) {
+	feed := `# blocklist
+192.0.2.1
+198.51.100.0/24 ; spam
+203.0.113.10 - 203.0.113.20
+2001:db8::/48,"scanner",2022-10-01
+
+not an address
+10.0.0.0/33
+`
+	ranges, rejected, err := ParseFeed(strings.NewReader(feed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ranges) != 4 {
+		t.Fatalf("test assert error: %v (expecting 4 ranges)", ranges)
+	}
+	if ranges[2].Type() != IPRangeInterval || !ranges[3].IsIPv6() {
+		t.Fatalf("test assert error: %v parsed incorrectly", ranges)
+	}
+	if len(rejected) != 2 || rejected[0].Line != 7 || rejected[1].Text != "10.0.0.0/33" {
+		t.Fatalf("test assert error: rejected %v", rejected)
+	}
+}
+
+func TestFeedLoad(t *testing.T) {
+	router := newTestRouter()
+
+	router.NewIPSet("blocklist")
+	if err := router.UpdateIPSet(router.FindIPSet("blocklist")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a large feed has to fit into a single netlink batch
+	var content strings.Builder
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&content, "10.%d.%d.%d\n", i>>14, (i>>6)&0xff, (i&0x3f)*4)
+	}
+	content.WriteString("invalid\n")
+	path := writeTestFile(t, "feed.txt", content.String())
+
+	feed, err := router.FeedTable().Attach("blocklist", path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.FeedTable().Load("blocklist"); err != nil {
+		t.Fatal(err)
+	}
+
+	ipset := feed.IPSet()
+	if !ipset.Dynamic() || len(ipset.Elements()) != 100000 || len(feed.Rejected()) != 1 {
+		t.Fatalf("test assert error: %d elements, rejected %v", len(ipset.Elements()), feed.Rejected())
+	}
+
+	set := ipset.set.V4
+	elements, err := router.query.GetSetElements(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elements) != 200000 {
+		t.Fatalf("test assert error: %d kernel elements (expecting 200000)", len(elements))
+	}
+
+	// only the changed lines are applied on reload
+	if err := os.WriteFile(path, []byte("10.0.0.0\n10.255.0.0/16\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if _, due := feed.due(time.Now()); !due {
+		t.Fatalf("test assert error: change not detected")
+	}
+	if err := router.FeedTable().Load("blocklist"); err != nil {
+		t.Fatal(err)
+	}
+	if len(ipset.Elements()) != 2 || len(feed.Rejected()) != 0 {
+		t.Fatalf("test assert error: elements %v", ipset.Elements())
+	}
+
+	if err := router.FeedTable().Detach("blocklist"); err != nil || ipset.Dynamic() {
+		t.Fatalf("test assert error: feed not detached")
+	}
+}
+
+func TestFeedLoadRejected(t *testing.T) {
+	router := newTestRouter()
+
+	router.NewIPSet("blocklist").AddIPRange(NewIPRangeString("192.0.2.1"))
+	if err := router.UpdateIPSet(router.FindIPSet("blocklist")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a feed in several messages is loaded in a single batch, so nothing of
+	// it is left once the kernel rejects the batch
+	var content strings.Builder
+	for i := 0; i < 4*setElementsChunk; i++ {
+		fmt.Fprintf(&content, "10.0.%d.%d\n", i>>6, (i&0x3f)*4)
+	}
+	path := writeTestFile(t, "feed.txt", content.String())
+
+	feed, err := router.FeedTable().Attach("blocklist", path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.nft.DelTable(&nftables.Table{Name: "missing", Family: nftables.TableFamilyINet})
+	if err := router.FeedTable().Load("blocklist"); err == nil || feed.Err() == nil {
+		t.Fatalf("test assert error: rejected feed loaded")
+	}
+
+	ipset := feed.IPSet()
+	if members := ipset.Members(); len(members) != 1 || len(ipset.Elements()) != 1 {
+		t.Fatalf("test assert error: members %v after the rejected batch", members)
+	}
+	elements, err := router.query.GetSetElements(ipset.set.V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elements) != 2 {
+		t.Fatalf("test assert error: %d kernel elements after the rejected batch (expecting 2)", len(elements))
+	}
+	assertConsistent(t, router)
+
+	// and is loaded as a whole on the next attempt
+	if err := router.FeedTable().Load("blocklist"); err != nil {
+		t.Fatal(err)
+	}
+	if len(ipset.Elements()) != 4*setElementsChunk {
+		t.Fatalf("test assert error: %d elements", len(ipset.Elements()))
+	}
+	assertConsistent(t, router)
+}
@@ -0,0 +1,385 @@
+package yafw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	ErrFQDNInvalid = errors.New("invalid domain name")
+	ErrDNSNoServer = errors.New("no dns server configured")
+)
+
+// A resolver looks up the addresses of a domain name along with the time they
+// are valid for.
+type Resolver interface {
+	Resolve(ctx context.Context, name string) ([]net.IP, time.Duration, error)
+}
+
+// A resolver querying A and AAAA records from a DNS server over UDP.
+type DNSResolver struct {
+	// address of the DNS server, e.g. "127.0.0.1:53"
+	Server  string
+	Timeout time.Duration
+}
+
+// Create a DNSResolver querying the first nameserver in a resolv.conf file.
+func NewDNSResolverFromFile(path string) (*DNSResolver, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return &DNSResolver{
+				Server: net.JoinHostPort(fields[1], "53"),
+			}, nil
+		}
+	}
+
+	return nil, ErrDNSNoServer
+}
+
+func (d *DNSResolver) Resolve(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	if d.Server == "" {
+		return nil, 0, ErrDNSNoServer
+	}
+
+	ret := []net.IP{}
+	ttl := time.Duration(0)
+	for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		ips, recordTTL, err := d.query(ctx, name, t)
+		if err != nil {
+			// the addresses of A records are kept if only AAAA fails
+			if t == dnsmessage.TypeAAAA && len(ret) > 0 {
+				break
+			}
+			return nil, 0, err
+		}
+		if len(ips) > 0 && (ttl == 0 || recordTTL < ttl) {
+			ttl = recordTTL
+		}
+		ret = append(ret, ips...)
+	}
+
+	return ret, ttl, nil
+}
+
+// Query records of a specific type, returning the addresses in the answer and
+// the lowest TTL among the records they are resolved through.
+func (d *DNSResolver) query(ctx context.Context, name string, t dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	fqdn, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, 0, ErrFQDNInvalid
+	}
+
+	id := uint16(rand.Uint32())
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: fqdn, Type: t, Class: dnsmessage.ClassINET},
+		},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "udp", d.Server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(packet); err != nil {
+		return nil, 0, err
+	}
+
+	buf := make([]byte, 65535)
+	var response dnsmessage.Message
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		// stray datagrams are skipped until the response or the deadline
+		if err := response.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		if response.Header.ID == id && response.Header.Response {
+			break
+		}
+	}
+
+	switch response.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, fmt.Errorf("%s: no such host", name)
+	default:
+		return nil, 0, fmt.Errorf("%s: dns error %v", name, response.Header.RCode)
+	}
+
+	ret := []net.IP{}
+	ttl := time.Duration(0)
+	for _, answer := range response.Answers {
+		recordTTL := time.Duration(answer.Header.TTL) * time.Second
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ret = append(ret, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ret = append(ret, net.IP(body.AAAA[:]))
+		case *dnsmessage.CNAMEResource:
+		default:
+			continue
+		}
+		if ttl == 0 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+
+	return ret, ttl, nil
+}
+
+// A domain name tracked by yafw, with its addresses kept in a dynamic IPSet.
+type FQDN struct {
+	name  string
+	ipset *IPSet
+
+	lastRefresh time.Time
+	nextRefresh time.Time
+	err         error
+}
+
+func (f *FQDN) Name() string {
+	return f.name
+}
+
+func (f *FQDN) IPSet() *IPSet {
+	return f.ipset
+}
+
+func (f *FQDN) LastRefresh() time.Time {
+	return f.lastRefresh
+}
+
+func (f *FQDN) MarshalJSON() ([]byte, error) {
+	message := ""
+	if f.err != nil {
+		message = f.err.Error()
+	}
+
+	addresses := f.ipset.Members()
+	if addresses == nil {
+		addresses = []*IPRange{}
+	}
+
+	return json.Marshal(struct {
+		Name        string     `json:"name"`
+		Addresses   []*IPRange `json:"addresses"`
+		LastRefresh time.Time  `json:"last_refresh"`
+		NextRefresh time.Time  `json:"next_refresh"`
+		Error       string     `json:"error"`
+	}{
+		Name:        f.name,
+		Addresses:   addresses,
+		LastRefresh: f.lastRefresh,
+		NextRefresh: f.nextRefresh,
+		Error:       message,
+	})
+}
+
+type FQDNTable struct {
+	r *Router
+	m map[string]*FQDN
+
+	// wakes up the refresh loop when a new domain name is tracked
+	wake chan struct{}
+
+	Resolver Resolver
+
+	// bounds of the refresh interval, the TTL of records is clamped into
+	MinRefresh time.Duration
+	MaxRefresh time.Duration
+}
+
+func NewFQDNTable(r *Router) *FQDNTable {
+	return &FQDNTable{
+		r:          r,
+		m:          make(map[string]*FQDN),
+		wake:       make(chan struct{}, 1),
+		MinRefresh: 30 * time.Second,
+		MaxRefresh: time.Hour,
+	}
+}
+
+// Get the IPSet name backing a domain name.
+func fqdnIPSetName(name string) string {
+	return addressFQDNPrefix + name
+}
+
+// Start tracking a domain name, creating its dynamic IPSet. The addresses are
+// filled in by the refresh loop.
+func (t *FQDNTable) Track(name string) (*IPSet, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return nil, ErrFQDNInvalid
+	}
+
+	if fqdn, ok := t.m[name]; ok {
+		return fqdn.ipset, nil
+	}
+
+	ipset := t.r.NewIPSet(fqdnIPSetName(name))
+	if ipset == nil {
+		return nil, ErrIPSetNameDuplicated
+	}
+	ipset.dynamic = true
+
+	if err := t.r.UpdateIPSet(ipset); err != nil {
+		delete(t.r.ipsets, ipset.name)
+		return nil, err
+	}
+
+	t.m[name] = &FQDN{
+		name:  name,
+		ipset: ipset,
+	}
+
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+
+	return ipset, nil
+}
+
+// Stop tracking a domain name. Its IPSet is deleted by the caller.
+func (t *FQDNTable) untrack(name string) {
+	delete(t.m, strings.ToLower(strings.TrimSuffix(name, ".")))
+}
+
+func (t *FQDNTable) Find(name string) *FQDN {
+	return t.m[strings.ToLower(strings.TrimSuffix(name, "."))]
+}
+
+// Get all tracked domain names ordered by name.
+func (t *FQDNTable) All() []*FQDN {
+	ret := make([]*FQDN, 0, len(t.m))
+	for _, fqdn := range t.m {
+		ret = append(ret, fqdn)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].name < ret[j].name })
+
+	return ret
+}
+
+// Resolve the domain names in background, following the TTL of the records,
+// until ctx is done. The router is locked while IPSets are being updated.
+func (t *FQDNTable) Run(ctx context.Context) {
+	for {
+		now := time.Now()
+		due := []*FQDN{}
+		next := time.Time{}
+
+		t.r.Lock()
+		for _, fqdn := range t.m {
+			if !fqdn.nextRefresh.After(now) {
+				due = append(due, fqdn)
+			} else if next.IsZero() || fqdn.nextRefresh.Before(next) {
+				next = fqdn.nextRefresh
+			}
+		}
+		t.r.Unlock()
+
+		if len(due) > 0 {
+			for _, fqdn := range due {
+				t.Refresh(ctx, fqdn)
+			}
+			continue
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(now))
+			timeout = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-t.wake:
+		case <-timeout:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Resolve a domain name and push the changed addresses into its IPSet. The
+// old addresses are kept if the resolution fails.
+func (t *FQDNTable) Refresh(ctx context.Context, fqdn *FQDN) error {
+	ips, ttl, err := []net.IP(nil), time.Duration(0), ErrDNSNoServer
+	if t.Resolver != nil {
+		ips, ttl, err = t.Resolver.Resolve(ctx, fqdn.name)
+	}
+
+	t.r.Lock()
+	defer t.r.Unlock()
+
+	if t.m[fqdn.name] != fqdn {
+		// no longer tracked since the resolution started
+		return nil
+	}
+
+	now := time.Now()
+	fqdn.lastRefresh = now
+
+	if err == nil {
+		ranges := make([]*IPRange, 0, len(ips))
+		for _, ip := range ips {
+			ranges = append(ranges, NewIPRangeHost(ip))
+		}
+		err = t.r.UpdateIPSet(fqdn.ipset.ReplaceIPRanges(ranges))
+	}
+
+	if err != nil {
+		ttl = t.MinRefresh
+	} else if ttl < t.MinRefresh {
+		ttl = t.MinRefresh
+	} else if ttl > t.MaxRefresh {
+		ttl = t.MaxRefresh
+	}
+
+	fqdn.err = err
+	fqdn.nextRefresh = now.Add(ttl)
+
+	return err
+}
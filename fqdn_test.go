@@ -0,0 +1,176 @@
+package yafw
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Start a DNS server stand-in on the loopback, answering every A and AAAA
+// question with the given records. Names under "broken." are answered after a
+// stray datagram, and fail their AAAA questions.
+func newTestDNSServer(t *testing.T, ttl uint32, ips ...string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			question := query.Questions[0]
+
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.Header.ID, Response: true},
+				Questions: query.Questions,
+			}
+			if strings.HasPrefix(question.Name.String(), "broken.") {
+				conn.WriteTo([]byte("stray"), addr)
+				if question.Type == dnsmessage.TypeAAAA {
+					response.Header.RCode = dnsmessage.RCodeServerFailure
+				}
+			}
+			for _, ip := range ips {
+				header := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: ttl}
+				parsed := net.ParseIP(ip)
+				if v4 := parsed.To4(); v4 != nil && question.Type == dnsmessage.TypeA {
+					header.Type = dnsmessage.TypeA
+					body := &dnsmessage.AResource{}
+					copy(body.A[:], v4)
+					response.Answers = append(response.Answers, dnsmessage.Resource{Header: header, Body: body})
+				} else if parsed.To4() == nil && question.Type == dnsmessage.TypeAAAA {
+					header.Type = dnsmessage.TypeAAAA
+					body := &dnsmessage.AAAAResource{}
+					copy(body.AAAA[:], parsed.To16())
+					response.Answers = append(response.Answers, dnsmessage.Resource{Header: header, Body: body})
+				}
+			}
+
+			packet, err := response.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(packet, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestDNSResolver(t *testing.T) {
+	server := newTestDNSServer(t, 300, "192.0.2.1", "192.0.2.2", "2001:db8::1")
+	resolver := &DNSResolver{Server: server}
+
+	ips, ttl, err := resolver.Resolve(context.Background(), "updates.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ips) != 3 || ttl != 300*time.Second {
+		t.Fatalf("test assert error: Resolve = %v, %v (expecting 3 addresses, 5m0s)", ips, ttl)
+	}
+
+	// the A records are kept when only AAAA fails, past a stray datagram
+	ips, _, err = resolver.Resolve(context.Background(), "broken.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 {
+		t.Fatalf("test assert error: Resolve = %v (expecting 2 addresses)", ips)
+	}
+}
+
+func TestFQDNRefresh(t *testing.T) {
+	router := newTestRouter()
+	router.fqdns.Resolver = &DNSResolver{Server: newTestDNSServer(t, 60, "192.0.2.1", "2001:db8::1")}
+
+	policy := &Policy{Destination: NewAddressFQDN("updates.example.com")}
+	if err := router.PolicyTable().Append(policy); err != nil {
+		t.Fatal(err)
+	}
+
+	fqdn := router.fqdns.Find("updates.example.com")
+	if fqdn == nil {
+		t.Fatalf("test assert error: fqdn not tracked")
+	}
+	if err := router.fqdns.Refresh(context.Background(), fqdn); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fqdn.IPSet().Members()) != 2 || fqdn.LastRefresh().IsZero() {
+		t.Fatalf("test assert error: members %v", fqdn.IPSet().Members())
+	}
+	if fqdn.nextRefresh.Sub(fqdn.lastRefresh) != time.Minute {
+		t.Fatalf("test assert error: next refresh in %v (expecting 1m0s)", fqdn.nextRefresh.Sub(fqdn.lastRefresh))
+	}
+
+	elements, err := router.query.GetSetElements(fqdn.IPSet().set.V6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elements) != 2 {
+		t.Fatalf("test assert error: %d elements in kernel (expecting 2)", len(elements))
+	}
+}
+
+func TestFQDNRelease(t *testing.T) {
+	router := newTestRouter()
+	policies := router.PolicyTable()
+
+	first := &Policy{Destination: NewAddressFQDN("updates.example.com")}
+	second := &Policy{Source: NewAddressFQDN("Updates.example.com."), Destination: NewAddressFQDN("updates.example.com")}
+	for _, policy := range []*Policy{first, second} {
+		if err := policies.Append(policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fqdn := router.fqdns.Find("updates.example.com")
+	if fqdn == nil {
+		t.Fatalf("test assert error: fqdn not tracked")
+	}
+	set := fqdn.IPSet().set
+
+	// the domain name is tracked until the last policy referring to it is
+	// removed
+	if err := policies.Remove(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := policies.Update(&Policy{ID: second.ID, Destination: NewAddressFQDN("updates.example.com")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if router.fqdns.Find("updates.example.com") != fqdn {
+		t.Fatalf("test assert error: fqdn untracked while referred")
+	}
+	assertConsistent(t, router)
+
+	if err := policies.Remove(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if router.fqdns.Find("updates.example.com") != nil || router.FindIPSet(fqdn.IPSet().Name()) != nil {
+		t.Fatalf("test assert error: fqdn tracked after the last policy is removed")
+	}
+	sets, err := router.query.GetSets(router.table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kernel := range sets {
+		if kernel.Name == set.V4.Name || kernel.Name == set.V6.Name {
+			t.Fatalf("test assert error: set %s kept in the kernel", kernel.Name)
+		}
+	}
+	assertConsistent(t, router)
+}
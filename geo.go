@@ -0,0 +1,380 @@
+package yafw
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrGeoCountryInvalid = errors.New("invalid country code")
+
+// Parse GeoIP database files into the ranges of each country, keyed by the
+// upper case ISO 3166-1 country code.
+//
+// Two formats are supported:
+//
+//   - MaxMind GeoLite2 Country CSV, i.e. the block files (e.g.
+//     "GeoLite2-Country-Blocks-IPv4.csv") along with the location file (e.g.
+//     "GeoLite2-Country-Locations-en.csv"), which maps their geoname_id to
+//     country codes
+//   - a simple format with a country code and an IP range on each line,
+//     separated by a comma or spaces, e.g. "CN,1.0.1.0/24", where empty lines
+//     and lines starting with "#" are ignored
+func ParseGeoIPFiles(paths ...string) (map[string][]*IPRange, error) {
+	ret := make(map[string][]*IPRange)
+
+	// MaxMind blocks are resolved once all the location files are read
+	geonames := make(map[string]string)
+	blocks := make(map[string][]*IPRange)
+
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		reader := csv.NewReader(file)
+		reader.FieldsPerRecord = -1
+		reader.Comment = '#'
+		reader.TrimLeadingSpace = true
+
+		header, err := reader.Read()
+		if err == io.EOF {
+			file.Close()
+			continue
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		columns := make(map[string]int)
+		for i, column := range header {
+			columns[column] = i
+		}
+
+		_, hasNetwork := columns["network"]
+		_, hasGeonameID := columns["geoname_id"]
+		_, hasCountry := columns["country_iso_code"]
+
+		switch {
+		case hasNetwork && hasGeonameID:
+			err = parseGeoIPBlocks(reader, columns, blocks)
+		case hasGeonameID && hasCountry:
+			err = parseGeoIPLocations(reader, columns, geonames)
+		default:
+			err = parseGeoIPSimple(reader, header, ret)
+		}
+		file.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	for geonameID, ranges := range blocks {
+		if country, ok := geonames[geonameID]; ok {
+			ret[country] = append(ret[country], ranges...)
+		}
+	}
+
+	return ret, nil
+}
+
+func parseGeoIPBlocks(reader *csv.Reader, columns map[string]int, blocks map[string][]*IPRange) error {
+	field := func(record []string, column string) string {
+		if i, ok := columns[column]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		iprange := NewIPRangeString(field(record, "network"))
+		if iprange == nil {
+			line, _ := reader.FieldPos(0)
+			return fmt.Errorf("line %d: invalid network", line)
+		}
+
+		// blocks without a located country are registered to one
+		geonameID := field(record, "geoname_id")
+		if geonameID == "" {
+			geonameID = field(record, "registered_country_geoname_id")
+		}
+		if geonameID != "" {
+			blocks[geonameID] = append(blocks[geonameID], iprange)
+		}
+	}
+}
+
+func parseGeoIPLocations(reader *csv.Reader, columns map[string]int, geonames map[string]string) error {
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		id, country := columns["geoname_id"], columns["country_iso_code"]
+		if id < len(record) && country < len(record) && record[country] != "" {
+			geonames[record[id]] = strings.ToUpper(record[country])
+		}
+	}
+}
+
+func parseGeoIPSimple(reader *csv.Reader, first []string, ret map[string][]*IPRange) error {
+	record := first
+	for {
+		fields := []string{}
+		for _, field := range record {
+			fields = append(fields, strings.Fields(field)...)
+		}
+
+		if len(fields) > 0 {
+			line, _ := reader.FieldPos(0)
+			if len(fields) != 2 {
+				return fmt.Errorf("line %d: expecting a country code and an ip range", line)
+			}
+
+			// either order is accepted
+			country, iprange := fields[0], NewIPRangeString(fields[1])
+			if iprange == nil {
+				country, iprange = fields[1], NewIPRangeString(fields[0])
+			}
+			if iprange == nil {
+				return fmt.Errorf("line %d: invalid ip range", line)
+			}
+
+			country = strings.ToUpper(country)
+			ret[country] = append(ret[country], iprange)
+		}
+
+		var err error
+		record, err = reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// The state of a file when it was loaded, telling whether it changed since.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) (fileState, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{}, err
+	}
+
+	return fileState{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+type GeoTable struct {
+	r *Router
+
+	// tracked countries to their dynamic IPSets
+	m map[string]*IPSet
+
+	// ranges of each country in the database last loaded
+	data     map[string][]*IPRange
+	files    map[string]fileState
+	loadedAt time.Time
+	err      error
+
+	// GeoIP database files, see ParseGeoIPFiles for the formats
+	Files []string
+
+	// interval of checking the files for changes
+	PollInterval time.Duration
+}
+
+func NewGeoTable(r *Router) *GeoTable {
+	return &GeoTable{
+		r:            r,
+		m:            make(map[string]*IPSet),
+		data:         make(map[string][]*IPRange),
+		PollInterval: time.Minute,
+	}
+}
+
+// Get the IPSet name backing a country.
+func geoIPSetName(country string) string {
+	return addressGeoPrefix + country
+}
+
+// Start tracking a country, creating its dynamic IPSet from the database
+// loaded.
+func (t *GeoTable) Track(country string) (*IPSet, error) {
+	country = strings.ToUpper(country)
+	if len(country) != 2 {
+		return nil, ErrGeoCountryInvalid
+	}
+
+	if ipset, ok := t.m[country]; ok {
+		return ipset, nil
+	}
+
+	ipset := t.r.NewIPSet(geoIPSetName(country))
+	if ipset == nil {
+		return nil, ErrIPSetNameDuplicated
+	}
+	ipset.dynamic = true
+
+	if err := t.r.UpdateIPSet(ipset.ReplaceIPRanges(t.data[country])); err != nil {
+		delete(t.r.ipsets, ipset.name)
+		return nil, err
+	}
+
+	t.m[country] = ipset
+
+	return ipset, nil
+}
+
+// Stop tracking a country. Its IPSet is deleted by the caller.
+func (t *GeoTable) untrack(country string) {
+	delete(t.m, strings.ToUpper(country))
+}
+
+// Get the tracked countries and their IPSets, ordered by country code.
+func (t *GeoTable) All() []*IPSet {
+	ret := make([]*IPSet, 0, len(t.m))
+	for _, ipset := range t.m {
+		ret = append(ret, ipset)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].name < ret[j].name })
+
+	return ret
+}
+
+// Check whether any of the files changed since they were loaded.
+func (t *GeoTable) changed() (map[string]fileState, bool) {
+	states := make(map[string]fileState)
+	changed := len(t.files) != len(t.Files)
+	for _, path := range t.Files {
+		state, err := statFile(path)
+		if err != nil {
+			// reported on loading
+			return nil, true
+		}
+		if t.files[path] != state {
+			changed = true
+		}
+		states[path] = state
+	}
+
+	return states, changed
+}
+
+// Load the database files, pushing the changed elements of the tracked
+// countries into their IPSets. The router has to be locked by the caller.
+func (t *GeoTable) Load() error {
+	states, _ := t.changed()
+	data, err := ParseGeoIPFiles(t.Files...)
+
+	return t.apply(states, data, err)
+}
+
+func (t *GeoTable) apply(states map[string]fileState, data map[string][]*IPRange, err error) error {
+	t.loadedAt = time.Now()
+	t.err = err
+	if err != nil {
+		// the database last loaded is kept
+		return err
+	}
+
+	t.data = data
+	t.files = states
+
+	for country, ipset := range t.m {
+		if err := t.r.UpdateIPSet(ipset.ReplaceIPRanges(data[country])); err != nil {
+			t.err = err
+		}
+	}
+
+	return t.err
+}
+
+// Reload the database files whenever they change on disk, until ctx is done.
+// The files are parsed without the router locked.
+func (t *GeoTable) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		t.r.Lock()
+		states, changed := t.changed()
+		files := append([]string(nil), t.Files...)
+		t.r.Unlock()
+
+		if !changed {
+			continue
+		}
+
+		data, err := ParseGeoIPFiles(files...)
+
+		t.r.Lock()
+		t.apply(states, data, err)
+		t.r.Unlock()
+	}
+}
+
+func (t *GeoTable) MarshalJSON() ([]byte, error) {
+	type country struct {
+		Country  string `json:"country"`
+		Elements int    `json:"elements"`
+	}
+
+	message := ""
+	if t.err != nil {
+		message = t.err.Error()
+	}
+
+	countries := []country{}
+	for _, ipset := range t.All() {
+		countries = append(countries, country{
+			Country:  strings.TrimPrefix(ipset.name, addressGeoPrefix),
+			Elements: len(ipset.Elements()),
+		})
+	}
+
+	return json.Marshal(struct {
+		Files     []string  `json:"files"`
+		LoadedAt  time.Time `json:"loaded_at"`
+		Error     string    `json:"error"`
+		Countries []country `json:"countries"`
+	}{
+		Files:     t.Files,
+		LoadedAt:  t.loadedAt,
+		Error:     message,
+		Countries: countries,
+	})
+}
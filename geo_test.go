@@ -0,0 +1,94 @@
+package yafw
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseGeoIPFiles(t *testing.T) {
+	simple := writeTestFile(t, "countries.txt", `# country, ip range
+CN,1.0.1.0/24
+CN 1.0.2.0/23
+2001:db8::/32,jp
+`)
+	blocks := writeTestFile(t, "GeoLite2-Country-Blocks-IPv4.csv", `network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider
+1.0.0.0/24,2077456,2077456,,0,0
+1.0.4.0/22,,2077456,,0,0
+1.0.8.0/21,1814991,1814991,,0,0
+`)
+	locations := writeTestFile(t, "GeoLite2-Country-Locations-en.csv", `geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name,is_in_european_union
+1814991,en,AS,Asia,CN,China,0
+2077456,en,OC,Oceania,AU,Australia,0
+`)
+
+	data, err := ParseGeoIPFiles(simple, blocks, locations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{"CN": 3, "JP": 1, "AU": 2}
+	for country, n := range want {
+		if len(data[country]) != n {
+			t.Fatalf("test assert error: %s has %v (expecting %d ranges)", country, data[country], n)
+		}
+	}
+
+	invalid := writeTestFile(t, "invalid.txt", "CN,1.0.1.0/33\n")
+	if _, err := ParseGeoIPFiles(invalid); err == nil {
+		t.Fatalf("test assert error: invalid file parsed")
+	}
+}
+
+func TestGeoReload(t *testing.T) {
+	router := newTestRouter()
+
+	path := writeTestFile(t, "countries.txt", "CN,1.0.1.0/24\nCN,1.0.2.0/23\nUS,3.0.0.0/8\n")
+	router.geo.Files = []string{path}
+	if err := router.geo.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := &Policy{Source: NewAddressGeo("cn")}
+	if err := router.PolicyTable().Append(policy); err != nil {
+		t.Fatal(err)
+	}
+
+	ipset := router.FindIPSet("geo:CN")
+	if ipset == nil || len(ipset.Elements()) != 1 {
+		t.Fatalf("test assert error: geo:CN not loaded")
+	}
+
+	if err := os.WriteFile(path, []byte("CN,1.0.1.0/24\nCN,1.0.8.0/21\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if _, changed := router.geo.changed(); !changed {
+		t.Fatalf("test assert error: change not detected")
+	}
+	if err := router.geo.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ipset.Members()) != 2 || len(ipset.Elements()) != 2 {
+		t.Fatalf("test assert error: members %v, elements %v", ipset.Members(), ipset.Elements())
+	}
+
+	// the country is no longer tracked once no policy refers to it
+	if err := router.PolicyTable().Remove(policy.ID); err != nil {
+		t.Fatal(err)
+	}
+	if router.FindIPSet("geo:CN") != nil || len(router.geo.All()) != 0 {
+		t.Fatalf("test assert error: geo:CN kept after the policy is removed")
+	}
+	assertConsistent(t, router)
+}
@@ -0,0 +1,300 @@
+package yafw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var ErrInterfaceNameInvalid = errors.New("invalid interface name")
+
+// The addresses configured on an interface, or its connected subnets, tracked
+// by yafw in a dynamic IPSet.
+type InterfaceAddress struct {
+	iface string
+	// connected subnets rather than the addresses themselves
+	networks bool
+	ipset    *IPSet
+
+	updatedAt time.Time
+	err       error
+}
+
+func (a *InterfaceAddress) Interface() string {
+	return a.iface
+}
+
+func (a *InterfaceAddress) Networks() bool {
+	return a.networks
+}
+
+func (a *InterfaceAddress) IPSet() *IPSet {
+	return a.ipset
+}
+
+func (a *InterfaceAddress) UpdatedAt() time.Time {
+	return a.updatedAt
+}
+
+func (a *InterfaceAddress) MarshalJSON() ([]byte, error) {
+	message := ""
+	if a.err != nil {
+		message = a.err.Error()
+	}
+
+	addresses := a.ipset.Members()
+	if addresses == nil {
+		addresses = []*IPRange{}
+	}
+
+	return json.Marshal(struct {
+		Name      string     `json:"name"`
+		Interface string     `json:"interface"`
+		Networks  bool       `json:"networks"`
+		Addresses []*IPRange `json:"addresses"`
+		UpdatedAt time.Time  `json:"updated_at"`
+		Error     string     `json:"error"`
+	}{
+		Name:      a.ipset.name,
+		Interface: a.iface,
+		Networks:  a.networks,
+		Addresses: addresses,
+		UpdatedAt: a.updatedAt,
+		Error:     message,
+	})
+}
+
+type InterfaceAddressTable struct {
+	r *Router
+
+	// IPSet names to the tracked interfaces
+	m map[string]*InterfaceAddress
+
+	// error of the address subscription, if it is broken
+	err error
+
+	// delay before subscribing again after the subscription breaks
+	RetryInterval time.Duration
+}
+
+func NewInterfaceAddressTable(r *Router) *InterfaceAddressTable {
+	return &InterfaceAddressTable{
+		r:             r,
+		m:             make(map[string]*InterfaceAddress),
+		RetryInterval: 5 * time.Second,
+	}
+}
+
+// Get the IPSet name backing the addresses or the subnets of an interface.
+func interfaceIPSetName(iface string, networks bool) string {
+	if networks {
+		return addressInterfaceNetPrefix + iface
+	}
+	return addressInterfacePrefix + iface
+}
+
+// Start tracking the addresses, or the subnets if networks is set, of an
+// interface, creating its dynamic IPSet. An interface which does not exist
+// yet gives an empty set, which is filled in once it is addressed.
+func (t *InterfaceAddressTable) Track(iface string, networks bool) (*IPSet, error) {
+	if iface == "" || strings.ContainsAny(iface, "/ ") {
+		return nil, ErrInterfaceNameInvalid
+	}
+
+	name := interfaceIPSetName(iface, networks)
+	if tracked, ok := t.m[name]; ok {
+		return tracked.ipset, nil
+	}
+
+	ipset := t.r.NewIPSet(name)
+	if ipset == nil {
+		return nil, ErrIPSetNameDuplicated
+	}
+	ipset.dynamic = true
+
+	tracked := &InterfaceAddress{
+		iface:    iface,
+		networks: networks,
+		ipset:    ipset,
+	}
+	if err := t.Refresh(tracked); err != nil && ipset.set == nil {
+		delete(t.r.ipsets, ipset.name)
+		return nil, err
+	}
+
+	t.m[name] = tracked
+
+	return ipset, nil
+}
+
+// Stop tracking an interface by the name of its IPSet. The IPSet is deleted
+// by the caller.
+func (t *InterfaceAddressTable) untrack(name string) {
+	delete(t.m, name)
+}
+
+// Get the tracked interfaces ordered by IPSet name.
+func (t *InterfaceAddressTable) All() []*InterfaceAddress {
+	ret := make([]*InterfaceAddress, 0, len(t.m))
+	for _, tracked := range t.m {
+		ret = append(ret, tracked)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ipset.name < ret[j].ipset.name })
+
+	return ret
+}
+
+// List the addresses of an interface through the netlink handle of the
+// router. Link-local addresses are left out, since they are never forwarded.
+func (t *InterfaceAddressTable) list(iface string, networks bool) ([]*IPRange, error) {
+	link, err := t.r.nl.LinkByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", iface, err)
+	}
+
+	addrs, err := t.r.nl.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", iface, err)
+	}
+
+	ret := []*IPRange{}
+	for _, addr := range addrs {
+		if addr.Scope == unix.RT_SCOPE_LINK || addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		if networks {
+			ones, _ := addr.Mask.Size()
+			ret = append(ret, NewIPRangeString(fmt.Sprintf("%s/%d", addr.IP, ones)))
+		} else {
+			ret = append(ret, NewIPRangeHost(addr.IP))
+		}
+	}
+
+	return ret, nil
+}
+
+// Read the addresses of a tracked interface, pushing the changed ones into
+// its IPSet. A missing interface empties the set. The router has to be locked
+// by the caller.
+func (t *InterfaceAddressTable) Refresh(tracked *InterfaceAddress) error {
+	ranges, err := t.list(tracked.iface, tracked.networks)
+	tracked.updatedAt = time.Now()
+	tracked.err = err
+
+	if updateErr := t.r.UpdateIPSet(tracked.ipset.ReplaceIPRanges(ranges)); updateErr != nil {
+		tracked.err = updateErr
+		return updateErr
+	}
+
+	return err
+}
+
+func (t *InterfaceAddressTable) refreshAll() {
+	for _, tracked := range t.m {
+		t.Refresh(tracked)
+	}
+}
+
+// Follow address changes in the network namespace of the router, updating the
+// tracked interfaces until ctx is done. The subscription is set up again if
+// it breaks.
+func (t *InterfaceAddressTable) Run(ctx context.Context) {
+	for {
+		updates := make(chan netlink.AddrUpdate, 64)
+		done := make(chan struct{})
+		err := netlink.AddrSubscribeWithOptions(updates, done, netlink.AddrSubscribeOptions{
+			Namespace: &t.r.ns,
+		})
+
+		if err == nil {
+			// changes before subscribing are caught up
+			t.r.Lock()
+			t.err = nil
+			t.refreshAll()
+			t.r.Unlock()
+
+			err = t.watch(ctx, updates)
+
+			close(done)
+			for range updates {
+				// drained until the subscription is closed
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		t.r.Lock()
+		t.err = err
+		t.r.Unlock()
+
+		timer := time.NewTimer(t.RetryInterval)
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+		timer.Stop()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+var errInterfaceSubscriptionClosed = errors.New("address subscription closed")
+
+// Update the tracked interfaces on address changes, until ctx is done or the
+// subscription is closed.
+func (t *InterfaceAddressTable) watch(ctx context.Context, updates <-chan netlink.AddrUpdate) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-updates:
+			if !ok {
+				return errInterfaceSubscriptionClosed
+			}
+		}
+
+		// changes come in bursts, e.g. on DHCP leases, so the pending ones
+		// are taken at once
+	drain:
+		for {
+			select {
+			case _, ok := <-updates:
+				if !ok {
+					break drain
+				}
+			default:
+				break drain
+			}
+		}
+
+		t.r.Lock()
+		t.refreshAll()
+		t.r.Unlock()
+	}
+}
+
+func (t *InterfaceAddressTable) MarshalJSON() ([]byte, error) {
+	message := ""
+	if t.err != nil {
+		message = t.err.Error()
+	}
+
+	return json.Marshal(struct {
+		Interfaces []*InterfaceAddress `json:"interfaces"`
+		Error      string              `json:"error"`
+	}{
+		Interfaces: t.All(),
+		Error:      message,
+	})
+}
@@ -0,0 +1,88 @@
+package yafw
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+func addTestAddress(t *testing.T, router *Router, link netlink.Link, cidr string) {
+	addr, err := netlink.ParseAddr(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.nl.AddrAdd(link, addr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInterfaceAddress(t *testing.T) {
+	router := newTestRouter()
+
+	// an interface tracked before it exists is filled in once addressed
+	policy := &Policy{
+		Source:      NewAddressInterfaceNet("dmz0"),
+		Destination: NewAddressInterface("dmz0"),
+	}
+	if err := router.PolicyTable().Append(policy); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go router.ifaddrs.Run(ctx)
+
+	// dummy interfaces are not always available, unlike veth pairs
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "dmz0"}, PeerName: "dmz1"}
+	if err := router.nl.LinkAdd(link); err != nil {
+		t.Fatal(err)
+	}
+	addTestAddress(t, router, link, "192.168.234.1/24")
+	addTestAddress(t, router, link, "fd00:234::1/64")
+
+	wait := func(name string, want ...string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			router.Lock()
+			members := router.FindIPSet(name).Members()
+			router.Unlock()
+
+			// the order follows the kernel
+			matched := len(members) == len(want)
+			for _, member := range members {
+				matched = matched && findString(want, member.String()) >= 0
+			}
+			if matched {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("test assert error: %s has %v (expecting %v)", name, members, want)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	wait("iface-net:dmz0", "192.168.234.0/24", "fd00:234::/64")
+	wait("iface:dmz0", "192.168.234.1", "fd00:234::1")
+
+	// re-addressing the interface moves the sets along
+	router.nl.AddrDel(link, &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP("192.168.234.1").To4(), Mask: net.CIDRMask(24, 32)}})
+	addTestAddress(t, router, link, "192.168.235.1/24")
+
+	wait("iface-net:dmz0", "192.168.235.0/24", "fd00:234::/64")
+	wait("iface:dmz0", "192.168.235.1", "fd00:234::1")
+
+	// the interface is no longer tracked once no policy refers to it
+	router.Lock()
+	defer router.Unlock()
+	if err := router.PolicyTable().Remove(policy.ID); err != nil {
+		t.Fatal(err)
+	}
+	if router.FindIPSet("iface:dmz0") != nil || len(router.ifaddrs.All()) != 0 {
+		t.Fatalf("test assert error: dmz0 kept after the policy is removed")
+	}
+	assertConsistent(t, router)
+}
@@ -0,0 +1,241 @@
+package yafw
+
+import (
+	"math/bits"
+	"net"
+	"sort"
+)
+
+// Set operations on collections of IPRanges. The collections are treated as
+// sets of addresses, so the ranges may overlap and come in any order, and
+// IPv4 and IPv6 ranges may be mixed. Results are minimal sorted slices of
+// non-overlapping ranges, with IPv4 ones first, as given by UnionIPRanges.
+// Intervals whose first address is after the last one are empty.
+
+// Get the address before an IP. The first IP of a family wraps around.
+func IPPrev(ip net.IP) net.IP {
+	n := len(ip)
+	out := make(net.IP, n)
+	copy(out, ip)
+
+	for i := n - 1; i >= 0; i-- {
+		out[i]--
+		if out[i] != 0xff {
+			break
+		}
+	}
+
+	return out
+}
+
+// Create an IPRange from its first and last address, which is a host if they
+// are the same.
+func newIPRangeFirstLast(first net.IP, last net.IP) *IPRange {
+	if first.Equal(last) {
+		return NewIPRangeHost(first)
+	}
+	return NewIPRange(first, last)
+}
+
+func validIPRanges(ranges []*IPRange) []*IPRange {
+	ret := make([]*IPRange, 0, len(ranges))
+	for _, r := range ranges {
+		if r != nil && compareIP(r.First(), r.Last()) <= 0 {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// Check whether an IP is in the range.
+func (r *IPRange) Contains(ip net.IP) bool {
+	ip = normalizeIP(ip)
+	first, last := normalizeIP(r.First()), normalizeIP(r.Last())
+	return len(ip) == len(first) && compareIP(first, ip) <= 0 && compareIP(ip, last) <= 0
+}
+
+// Check whether every address of another range is in the range.
+func (r *IPRange) ContainsRange(o *IPRange) bool {
+	return r.Contains(o.First()) && r.Contains(o.Last())
+}
+
+// Check whether the range shares any address with another range.
+func (r *IPRange) Overlaps(o *IPRange) bool {
+	first, last := normalizeIP(r.First()), normalizeIP(r.Last())
+	oFirst, oLast := normalizeIP(o.First()), normalizeIP(o.Last())
+	return len(first) == len(oFirst) && compareIP(first, oLast) <= 0 && compareIP(oFirst, last) <= 0
+}
+
+// Convert the range into a minimal list of CIDRs covering exactly the same
+// addresses, e.g. "192.168.1.1-192.168.1.6" gives "192.168.1.1/32",
+// "192.168.1.2/31", "192.168.1.4/31" and "192.168.1.6/32".
+func (r *IPRange) CIDRs() []*net.IPNet {
+	first, last := normalizeIP(r.First()), normalizeIP(r.Last())
+	if first == nil || last == nil || len(first) != len(last) || compareIP(first, last) > 0 {
+		return nil
+	}
+
+	size := len(first) * 8
+	ret := []*net.IPNet{}
+	for {
+		// the largest block aligned at first, shrunk until it fits
+		ones := size - trailingZeros(first)
+		for {
+			mask := net.CIDRMask(ones, size)
+			if compareIP(IPMaskedLast(first, mask), last) <= 0 {
+				break
+			}
+			ones++
+		}
+
+		mask := net.CIDRMask(ones, size)
+		ret = append(ret, &net.IPNet{IP: first, Mask: mask})
+
+		end := IPMaskedLast(first, mask)
+		if end.Equal(last) {
+			return ret
+		}
+		first = IPNext(end)
+	}
+}
+
+// Count the trailing zero bits of an IP.
+func trailingZeros(ip net.IP) int {
+	ret := 0
+	for i := len(ip) - 1; i >= 0; i-- {
+		if ip[i] != 0 {
+			return ret + bits.TrailingZeros8(ip[i])
+		}
+		ret += 8
+	}
+	return ret
+}
+
+// Convert ranges into a minimal list of CIDRs covering the same addresses.
+func IPRangesToCIDRs(ranges []*IPRange) []*net.IPNet {
+	ret := []*net.IPNet{}
+	for _, r := range UnionIPRanges(ranges) {
+		ret = append(ret, r.CIDRs()...)
+	}
+	return ret
+}
+
+// Get the addresses in any of the collections.
+func UnionIPRanges(collections ...[]*IPRange) []*IPRange {
+	all := []*IPRange{}
+	for _, ranges := range collections {
+		all = append(all, validIPRanges(ranges)...)
+	}
+	return mergeIPRanges(all)
+}
+
+// Get the addresses in both a and b.
+func IntersectIPRanges(a []*IPRange, b []*IPRange) []*IPRange {
+	a, b = UnionIPRanges(a), UnionIPRanges(b)
+
+	ret := []*IPRange{}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		aFirst, aLast := normalizeIP(a[i].First()), normalizeIP(a[i].Last())
+		bFirst, bLast := normalizeIP(b[j].First()), normalizeIP(b[j].Last())
+
+		if len(aFirst) == len(bFirst) {
+			first, last := aFirst, aLast
+			if compareIP(bFirst, first) > 0 {
+				first = bFirst
+			}
+			if compareIP(bLast, last) < 0 {
+				last = bLast
+			}
+			if compareIP(first, last) <= 0 {
+				ret = append(ret, newIPRangeFirstLast(first, last))
+			}
+		}
+
+		// the range ending first cannot overlap anything further
+		if compareIP(aLast, bLast) < 0 {
+			i++
+		} else {
+			j++
+		}
+	}
+
+	return ret
+}
+
+// Get the addresses in a but not in b.
+func SubtractIPRanges(a []*IPRange, b []*IPRange) []*IPRange {
+	a, b = UnionIPRanges(a), UnionIPRanges(b)
+
+	ret := []*IPRange{}
+	j := 0
+	for _, r := range a {
+		cursor, last := normalizeIP(r.First()), normalizeIP(r.Last())
+
+		// ranges of b ending before the cursor are done with
+		for j < len(b) && compareIP(b[j].Last(), cursor) < 0 {
+			j++
+		}
+
+		done := false
+		for k := j; k < len(b) && !done; k++ {
+			bFirst, bLast := normalizeIP(b[k].First()), normalizeIP(b[k].Last())
+			if compareIP(bFirst, last) > 0 {
+				break
+			}
+
+			if compareIP(bFirst, cursor) > 0 {
+				ret = append(ret, newIPRangeFirstLast(cursor, IPPrev(bFirst)))
+			}
+			if compareIP(bLast, last) >= 0 {
+				done = true
+			} else {
+				cursor = IPNext(bLast)
+			}
+		}
+
+		if !done {
+			ret = append(ret, newIPRangeFirstLast(cursor, last))
+		}
+	}
+
+	return ret
+}
+
+// Check whether every address in b is also in a.
+func ContainsIPRanges(a []*IPRange, b []*IPRange) bool {
+	return len(SubtractIPRanges(b, a)) == 0
+}
+
+// Check whether a and b share any address.
+func OverlapIPRanges(a []*IPRange, b []*IPRange) bool {
+	return len(IntersectIPRanges(a, b)) > 0
+}
+
+// A pair of overlapping ranges in a collection.
+type IPRangeOverlap struct {
+	A *IPRange `json:"a"`
+	B *IPRange `json:"b"`
+}
+
+// Find the pairs of ranges overlapping each other in a collection, e.g. to
+// review the members of an IPSet. A pair is reported once, with A going
+// first in the numeric order.
+func FindIPRangeOverlaps(ranges []*IPRange) []IPRangeOverlap {
+	sorted := validIPRanges(ranges)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return compareIP(sorted[i].First(), sorted[j].First()) < 0
+	})
+
+	ret := []IPRangeOverlap{}
+	for i, r := range sorted {
+		for _, o := range sorted[i+1:] {
+			if !r.Overlaps(o) {
+				// the following ones start even later, or in another family
+				break
+			}
+			ret = append(ret, IPRangeOverlap{A: r, B: o})
+		}
+	}
+
+	return ret
+}
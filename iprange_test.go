@@ -0,0 +1,121 @@
+package yafw
+
+import (
+	"net"
+	"testing"
+)
+
+func parseTestIPRanges(ranges ...string) []*IPRange {
+	ret := []*IPRange{}
+	for _, r := range ranges {
+		ret = append(ret, NewIPRangeString(r))
+	}
+	return ret
+}
+
+func assertIPRanges(t *testing.T, name string, got []*IPRange, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("test assert error: %s = %v (expecting %v)", name, got, want)
+	}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Fatalf("test assert error: %s = %v (expecting %v)", name, got, want)
+		}
+	}
+}
+
+func TestUnionIPRanges(t *testing.T) {
+	got := UnionIPRanges(
+		parseTestIPRanges("fd00::/120", "10.0.0.0/24"),
+		parseTestIPRanges("10.0.1.0/24", "10.0.0.10-10.0.0.5", "fd00::100"),
+	)
+	assertIPRanges(t, "union", got, "10.0.0.0-10.0.1.255", "fd00::-fd00::100")
+}
+
+func TestIntersectIPRanges(t *testing.T) {
+	a := parseTestIPRanges("10.0.0.0/24", "10.0.2.0/24", "fd00::/64")
+	b := parseTestIPRanges("10.0.0.128-10.0.2.0", "10.0.2.255", "fd00::1", "fd01::/64")
+
+	got := IntersectIPRanges(a, b)
+	assertIPRanges(t, "intersect", got, "10.0.0.128-10.0.0.255", "10.0.2.0", "10.0.2.255", "fd00::1")
+
+	if len(IntersectIPRanges(a, parseTestIPRanges("10.0.1.0/24", "fd01::1"))) != 0 {
+		t.Fatalf("test assert error: disjoint ranges intersect")
+	}
+}
+
+func TestSubtractIPRanges(t *testing.T) {
+	a := parseTestIPRanges("10.0.0.0/24", "fd00::/126")
+	b := parseTestIPRanges("10.0.0.0", "10.0.0.10-10.0.0.20", "10.0.0.255", "fd00::1-fd00::2")
+
+	got := SubtractIPRanges(a, b)
+	assertIPRanges(t, "subtract", got, "10.0.0.1-10.0.0.9", "10.0.0.21-10.0.0.254", "fd00::", "fd00::3")
+
+	all := parseTestIPRanges("0.0.0.0/0")
+	assertIPRanges(t, "subtract all", SubtractIPRanges(all, all))
+	assertIPRanges(t, "subtract edges", SubtractIPRanges(all, parseTestIPRanges("0.0.0.0", "255.255.255.255")),
+		"0.0.0.1-255.255.255.254")
+}
+
+func TestContainsIPRanges(t *testing.T) {
+	a := parseTestIPRanges("10.0.0.0/25", "10.0.0.128/25", "fd00::/64")
+
+	if !ContainsIPRanges(a, parseTestIPRanges("10.0.0.100-10.0.0.200", "fd00::1")) {
+		t.Fatalf("test assert error: ranges across adjacent members not contained")
+	}
+	if ContainsIPRanges(a, parseTestIPRanges("10.0.0.100-10.0.1.0")) {
+		t.Fatalf("test assert error: range beyond members contained")
+	}
+	if !OverlapIPRanges(a, parseTestIPRanges("10.0.0.255-10.0.1.0")) || OverlapIPRanges(a, parseTestIPRanges("fd01::1")) {
+		t.Fatalf("test assert error: overlap detection")
+	}
+
+	r := NewIPRangeString("10.0.0.0/24")
+	if !r.Contains(net.ParseIP("10.0.0.1")) || r.Contains(net.ParseIP("::ffff:10.0.1.1")) || r.Contains(net.ParseIP("fd00::1")) {
+		t.Fatalf("test assert error: %v contains", r)
+	}
+	if !r.ContainsRange(NewIPRangeString("10.0.0.5-10.0.0.6")) || r.ContainsRange(NewIPRangeString("10.0.0.0/23")) {
+		t.Fatalf("test assert error: %v contains range", r)
+	}
+}
+
+func TestFindIPRangeOverlaps(t *testing.T) {
+	ranges := parseTestIPRanges("192.168.233.0/24", "10.0.0.1", "192.168.233.1", "192.168.234.0/24", "fd00::/64", "fd00::1")
+
+	overlaps := FindIPRangeOverlaps(ranges)
+	if len(overlaps) != 2 ||
+		overlaps[0].A.String() != "192.168.233.0/24" || overlaps[0].B.String() != "192.168.233.1" ||
+		overlaps[1].A.String() != "fd00::/64" || overlaps[1].B.String() != "fd00::1" {
+		t.Fatalf("test assert error: overlaps %v", overlaps)
+	}
+}
+
+func TestIPRangeCIDRs(t *testing.T) {
+	want := map[string][]string{
+		"192.168.1.1-192.168.1.6":         {"192.168.1.1/32", "192.168.1.2/31", "192.168.1.4/31", "192.168.1.6/32"},
+		"10.0.0.0-10.0.3.255":             {"10.0.0.0/22"},
+		"0.0.0.0-255.255.255.255":         {"0.0.0.0/0"},
+		"10.0.0.255-10.0.1.0":             {"10.0.0.255/32", "10.0.1.0/32"},
+		"fd00::-fd00::1:ffff":             {"fd00::/111"},
+		"fd00::ffff-fd00::1:0":            {"fd00::ffff/128", "fd00::1:0/128"},
+		"255.255.255.254-255.255.255.255": {"255.255.255.254/31"},
+	}
+
+	for interval, cidrs := range want {
+		got := NewIPRangeString(interval).CIDRs()
+		if len(got) != len(cidrs) {
+			t.Fatalf("test assert error: %s = %v (expecting %v)", interval, got, cidrs)
+		}
+		for i := range cidrs {
+			if got[i].String() != cidrs[i] {
+				t.Fatalf("test assert error: %s = %v (expecting %v)", interval, got, cidrs)
+			}
+		}
+	}
+
+	got := IPRangesToCIDRs(parseTestIPRanges("10.0.0.0/25", "10.0.0.128/25", "10.0.1.1"))
+	if len(got) != 2 || got[0].String() != "10.0.0.0/24" || got[1].String() != "10.0.1.1/32" {
+		t.Fatalf("test assert error: IPRangesToCIDRs = %v", got)
+	}
+}
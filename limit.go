@@ -0,0 +1,160 @@
+package yafw
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+var ErrLimitInvalid = errors.New("invalid limit")
+
+// How long a source address is kept in a meter after its last new connection.
+const meterTimeout = time.Minute
+
+// A rate of packets or bytes, e.g. 10 packets per second with a burst of 5.
+type RateLimit struct {
+	Rate uint64 `json:"rate"`
+	// the rate counts bytes rather than packets
+	Bytes bool `json:"bytes"`
+	// "second", "minute", "hour" or "day", which is "second" if empty
+	Per   string `json:"per"`
+	Burst uint32 `json:"burst"`
+}
+
+var limitUnits = map[string]expr.LimitTime{
+	"":       expr.LimitTimeSecond,
+	"second": expr.LimitTimeSecond,
+	"minute": expr.LimitTimeMinute,
+	"hour":   expr.LimitTimeHour,
+	"day":    expr.LimitTimeDay,
+}
+
+func (l *RateLimit) Validate() error {
+	if l.Rate == 0 {
+		return fmt.Errorf("%w: rate of 0", ErrLimitInvalid)
+	}
+	if _, ok := limitUnits[l.Per]; !ok {
+		return fmt.Errorf("%w: rate per %q", ErrLimitInvalid, l.Per)
+	}
+	return nil
+}
+
+// Get the limit expression of the rate. The expression matches packets within
+// the rate, or beyond it if over is set.
+func (l *RateLimit) expr(over bool) *expr.Limit {
+	ret := &expr.Limit{
+		Type:  expr.LimitTypePkts,
+		Rate:  l.Rate,
+		Over:  over,
+		Unit:  limitUnits[l.Per],
+		Burst: l.Burst,
+	}
+	if l.Bytes {
+		ret.Type = expr.LimitTypePktBytes
+	}
+	return ret
+}
+
+// Limits kept for each source address on its own.
+type SourceLimit struct {
+	// rate of new connections from a source
+	NewConnections *RateLimit `json:"new_connections,omitempty"`
+	// number of connections from a source tracked at the same time, which is
+	// not limited if 0
+	Connections uint32 `json:"connections"`
+}
+
+func (l *SourceLimit) Validate() error {
+	if l.NewConnections != nil {
+		if err := l.NewConnections.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// What is done to packets beyond the limits of a policy.
+type OverflowAction int
+
+const (
+	OverflowDrop OverflowAction = iota
+	OverflowAccept
+	// the policy is skipped and the following ones decide
+	OverflowContinue
+)
+
+func (action OverflowAction) MarshalJSON() ([]byte, error) {
+	switch action {
+	case OverflowDrop:
+		return json.Marshal("drop")
+	case OverflowAccept:
+		return json.Marshal("accept")
+	case OverflowContinue:
+		return json.Marshal("continue")
+	default:
+		return json.Marshal("(unknown)")
+	}
+}
+
+func (action *OverflowAction) UnmarshalJSON(data []byte) error {
+	text := ""
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	switch text {
+	case "drop", "":
+		*action = OverflowDrop
+	case "accept":
+		*action = OverflowAccept
+	case "continue":
+		*action = OverflowContinue
+	default:
+		return fmt.Errorf("%w: overflow action %q", ErrLimitInvalid, text)
+	}
+
+	return nil
+}
+
+// Get dynamic sets keyed by source addresses for a meter of each family.
+// They are owned by the entry alone, and given back by releaseSharedSets
+// like the shared sets.
+func (r *Router) acquireMeter(timeout time.Duration) (*AddressSet, error) {
+	ret := &AddressSet{}
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		r.meterCounter++
+		set := &nftables.Set{
+			Table:   r.table,
+			Name:    fmt.Sprintf("meter-%d", r.meterCounter),
+			Dynamic: true,
+			KeyType: ipSetKeyType(family),
+		}
+		if timeout > 0 {
+			set.HasTimeout = true
+			set.Timeout = timeout
+		}
+		if err := r.nft.AddSet(set, nil); err != nil {
+			return nil, err
+		}
+
+		shared := &sharedSet{
+			set:  set,
+			key:  "meter:" + set.Name,
+			refs: 1,
+		}
+		r.shared[shared.key] = shared
+		r.sharedNames[set.Name] = shared
+		r.acquired = append(r.acquired, set)
+
+		if family == nftables.TableFamilyIPv4 {
+			ret.V4 = set
+		} else {
+			ret.V6 = set
+		}
+	}
+
+	return ret, nil
+}
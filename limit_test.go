@@ -0,0 +1,107 @@
+package yafw
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestPolicyLimit(t *testing.T) {
+	router := newTestRouter()
+
+	published := &Policy{
+		Destination: NewAddressImmediate(parseTestIPRanges("192.0.2.10")),
+		Service:     &Service{Protocol: 6, DestinationPortMin: 443, DestinationPortMax: 443},
+		RateLimit:   &RateLimit{Rate: 100, Burst: 20},
+		SourceLimit: &SourceLimit{
+			NewConnections: &RateLimit{Rate: 10, Per: "minute", Burst: 5},
+			Connections:    20,
+		},
+	}
+	if err := router.PolicyTable().Append(published); err != nil {
+		t.Fatal(err)
+	}
+
+	compiled, err := router.PolicyTable().Compiled(published.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"meta nfproto ipv4 ip daddr @immediate-1 meta l4proto tcp tcp dport 443-443 limit rate over 100/second burst 20 packets counter packets 0 bytes 0 drop",
+		"meta nfproto ipv4 ip daddr @immediate-1 meta l4proto tcp tcp dport 443-443 update @meter-1 { ip saddr timeout 1m limit rate over 10/minute burst 5 packets } counter packets 0 bytes 0 drop",
+		"meta nfproto ipv4 ip daddr @immediate-1 meta l4proto tcp tcp dport 443-443 add @meter-3 { ip saddr ct count over 20 } counter packets 0 bytes 0 drop",
+		"meta nfproto ipv4 ip daddr @immediate-1 meta l4proto tcp tcp dport 443-443 counter packets 0 bytes 0 accept",
+	}
+	if len(compiled) != len(expected) {
+		t.Fatalf("test assert error: compiled %v (expecting %v)", compiled, expected)
+	}
+	for i, rule := range compiled {
+		if rule.String() != expected[i] {
+			t.Fatalf("test assert error: compiled %q (expecting %q)", rule.String(), expected[i])
+		}
+	}
+
+	// beyond the limits, the following policies decide
+	shared := &Policy{
+		RateLimit: &RateLimit{Rate: 1000000, Bytes: true},
+		Overflow:  OverflowContinue,
+	}
+	if err := router.PolicyTable().Append(shared); err != nil {
+		t.Fatal(err)
+	}
+	compiled, err = router.PolicyTable().Compiled(shared.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compiled) != 1 || compiled[0].String() != "limit rate 1000000 bytes/second burst 0 bytes counter packets 0 bytes 0 accept" {
+		t.Fatalf("test assert error: compiled %v", compiled)
+	}
+
+	verifications, err := router.VerifyEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, verification := range verifications {
+		if !verification.OK {
+			t.Fatalf("test assert error: %+v does not match the kernel", verification)
+		}
+	}
+
+	stats, err := router.SetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Meters != 4 || len(stats.Stale) != 0 {
+		t.Fatalf("test assert error: stats %+v (expecting 4 meters)", stats)
+	}
+
+	// the meters are owned by the policy alone
+	if err := router.PolicyTable().Remove(published.ID); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = router.SetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Meters != 0 || stats.Kernel != 0 {
+		t.Fatalf("test assert error: stats %+v after removal", stats)
+	}
+
+	invalid := &Policy{RateLimit: &RateLimit{Rate: 10, Per: "fortnight"}}
+	if err := router.PolicyTable().Append(invalid); !errors.Is(err, ErrLimitInvalid) {
+		t.Fatalf("test assert error: invalid limit appended with %v", err)
+	}
+}
+
+func TestOverflowActionJSON(t *testing.T) {
+	policy := &Policy{}
+	if err := json.Unmarshal([]byte(`{"rate_limit": {"rate": 5}, "overflow": "continue"}`), policy); err != nil {
+		t.Fatal(err)
+	}
+	if policy.Overflow != OverflowContinue || policy.RateLimit.Rate != 5 {
+		t.Fatalf("test assert error: decoded %+v", policy)
+	}
+	if err := json.Unmarshal([]byte(`{"overflow": "reject"}`), policy); !errors.Is(err, ErrLimitInvalid) {
+		t.Fatalf("test assert error: unknown overflow action decoded with %v", err)
+	}
+}
@@ -0,0 +1,390 @@
+package yafw
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables"
+)
+
+var (
+	ErrMACInvalid           = errors.New("invalid mac address")
+	ErrMACSetNameDuplicated = errors.New("macset name duplicated")
+	ErrMACSetNotFound       = errors.New("macset not found")
+	ErrMACSetReferred       = errors.New("macset is referred")
+)
+
+// Parse an ethernet hardware address, e.g. "00:11:22:33:44:55".
+func ParseMAC(s string) (net.HardwareAddr, error) {
+	mac, err := net.ParseMAC(s)
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("%w: %s", ErrMACInvalid, s)
+	}
+	return mac, nil
+}
+
+func macSetElements(macs []net.HardwareAddr) []nftables.SetElement {
+	ret := make([]nftables.SetElement, 0, len(macs))
+	for _, mac := range macs {
+		ret = append(ret, nftables.SetElement{Key: []byte(mac)})
+	}
+	return ret
+}
+
+// Source hardware addresses matched by a policy: either immediate addresses
+// (an anonymous set in nftables) or a reference to a named MACSet.
+//
+// In JSON, immediate addresses are a list and a MACSet is its name, e.g.
+//
+//	["00:11:22:33:44:55"] or "printers"
+type MACAddress struct {
+	Immediate []net.HardwareAddr `json:"immediate"`
+	MACSet    string             `json:"macset"`
+}
+
+func NewMACAddressImmediate(immediate []net.HardwareAddr) *MACAddress {
+	return &MACAddress{
+		Immediate: immediate,
+	}
+}
+
+func NewMACAddressSet(macset string) *MACAddress {
+	return &MACAddress{
+		MACSet: macset,
+	}
+}
+
+func (m *MACAddress) UnmarshalJSON(data []byte) error {
+	macs := []string{}
+	if err := json.Unmarshal(data, &macs); err != nil {
+		macset := ""
+		if err := json.Unmarshal(data, &macset); err != nil {
+			return fmt.Errorf("cannot convert to mac address")
+		}
+
+		m.MACSet = macset
+		return nil
+	}
+
+	for _, s := range macs {
+		mac, err := ParseMAC(s)
+		if err != nil {
+			return err
+		}
+		m.Immediate = append(m.Immediate, mac)
+	}
+
+	return nil
+}
+
+func (m *MACAddress) MarshalJSON() ([]byte, error) {
+	if m.MACSet != "" {
+		return json.Marshal(m.MACSet)
+	}
+
+	macs := []string{}
+	for _, mac := range m.Immediate {
+		macs = append(macs, mac.String())
+	}
+	return json.Marshal(macs)
+}
+
+func (m *MACAddress) String() string {
+	if m.MACSet != "" {
+		return fmt.Sprintf("macset:%s", m.MACSet)
+	}
+
+	macs := []string{}
+	for _, mac := range m.Immediate {
+		macs = append(macs, mac.String())
+	}
+	return fmt.Sprintf("[%s]", strings.Join(macs, ","))
+}
+
+// A named set of hardware addresses, kept in a kernel set of
+// nftables.TypeEtherAddr and updated incrementally like an IPSet.
+type MACSet struct {
+	set *nftables.Set
+
+	// incremental update, keyed by the address string
+	willAdd    map[string]net.HardwareAddr
+	willDelete map[string]net.HardwareAddr
+
+	name       string
+	members    []net.HardwareAddr
+	memberKeys map[string]bool
+}
+
+func (s *MACSet) Name() string {
+	return s.name
+}
+
+func (s *MACSet) Members() []net.HardwareAddr {
+	return s.members
+}
+
+func (s *MACSet) init() {
+	if s.memberKeys == nil {
+		s.memberKeys = make(map[string]bool)
+		s.willAdd = make(map[string]net.HardwareAddr)
+		s.willDelete = make(map[string]net.HardwareAddr)
+	}
+}
+
+// forget the changes taken by the kernel
+func (s *MACSet) clearPending() {
+	for key := range s.willAdd {
+		delete(s.willAdd, key)
+	}
+	for key := range s.willDelete {
+		delete(s.willDelete, key)
+	}
+}
+
+func (s *MACSet) AddMAC(mac net.HardwareAddr) *MACSet {
+	if len(mac) != 6 {
+		return s
+	}
+	s.init()
+
+	key := mac.String()
+	if !s.memberKeys[key] {
+		s.members = append(s.members, mac)
+		s.memberKeys[key] = true
+
+		// an address deleted and added back is kept in the kernel
+		if _, ok := s.willDelete[key]; ok {
+			delete(s.willDelete, key)
+		} else {
+			s.willAdd[key] = mac
+		}
+	}
+
+	return s
+}
+
+func (s *MACSet) DeleteMAC(mac net.HardwareAddr) *MACSet {
+	s.init()
+
+	key := mac.String()
+	if s.memberKeys[key] {
+		for i, member := range s.members {
+			if member.String() == key {
+				s.members = append(s.members[:i], s.members[i+1:]...)
+				break
+			}
+		}
+		delete(s.memberKeys, key)
+
+		// an address added and deleted before an update never reaches the
+		// kernel
+		if _, ok := s.willAdd[key]; ok {
+			delete(s.willAdd, key)
+		} else {
+			s.willDelete[key] = mac
+		}
+	}
+
+	return s
+}
+
+// Replace all members, putting only the differences into the incremental
+// update.
+func (s *MACSet) ReplaceMACs(macs []net.HardwareAddr) *MACSet {
+	s.init()
+
+	keys := make(map[string]bool, len(macs))
+	for _, mac := range macs {
+		if len(mac) == 6 {
+			keys[mac.String()] = true
+		}
+	}
+
+	for _, member := range append([]net.HardwareAddr(nil), s.members...) {
+		if !keys[member.String()] {
+			s.DeleteMAC(member)
+		}
+	}
+	for _, mac := range macs {
+		s.AddMAC(mac)
+	}
+
+	return s
+}
+
+func (s *MACSet) MarshalJSON() ([]byte, error) {
+	members := []string{}
+	for _, mac := range s.members {
+		members = append(members, mac.String())
+	}
+
+	return json.Marshal(struct {
+		Name    string   `json:"name"`
+		Members []string `json:"members"`
+	}{
+		Name:    s.name,
+		Members: members,
+	})
+}
+
+func (r *Router) NewMACSet(name string) *MACSet {
+	if r.FindMACSet(name) != nil {
+		return nil
+	}
+
+	ret := &MACSet{
+		name: name,
+	}
+	ret.init()
+	r.macsets[name] = ret
+
+	return ret
+}
+
+func (r *Router) FindMACSet(name string) *MACSet {
+	return r.macsets[name]
+}
+
+// Get all MACSets ordered by name.
+func (r *Router) MACSets() []*MACSet {
+	ret := make([]*MACSet, 0, len(r.macsets))
+	for _, macset := range r.macsets {
+		ret = append(ret, macset)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].name < ret[j].name })
+
+	return ret
+}
+
+// Push a MACSet into the kernel, creating its set on the first update and
+// sending only the changed elements afterwards.
+// The changes are kept pending until the kernel takes them, so that they are
+// sent again on a retry.
+func (r *Router) UpdateMACSet(macset *MACSet) error {
+	if macset.set == nil {
+		r.macsetCounter++
+		set := &nftables.Set{
+			Table:   r.table,
+			Name:    fmt.Sprintf("macset-%d", r.macsetCounter),
+			KeyType: nftables.TypeEtherAddr,
+		}
+		if err := r.nft.AddSet(set, nil); err != nil {
+			return err
+		}
+		if err := r.setAddElements(set, macSetElements(macset.members)); err != nil {
+			return err
+		}
+		if err := r.Update(); err != nil {
+			return err
+		}
+
+		macset.set = set
+		r.macsets[macset.name] = macset
+		macset.clearPending()
+
+		return nil
+	}
+
+	if len(macset.willAdd) == 0 && len(macset.willDelete) == 0 {
+		// nothing changed
+		return nil
+	}
+
+	willAdd := make([]net.HardwareAddr, 0, len(macset.willAdd))
+	for _, mac := range macset.willAdd {
+		willAdd = append(willAdd, mac)
+	}
+	willDelete := make([]net.HardwareAddr, 0, len(macset.willDelete))
+	for _, mac := range macset.willDelete {
+		willDelete = append(willDelete, mac)
+	}
+
+	if err := r.setDeleteElements(macset.set, macSetElements(willDelete)); err != nil {
+		return err
+	}
+	if err := r.setAddElements(macset.set, macSetElements(willAdd)); err != nil {
+		return err
+	}
+	if err := r.Update(); err != nil {
+		return err
+	}
+
+	macset.clearPending()
+
+	return nil
+}
+
+// Delete a MACSet along with its kernel set. It is refused while entries
+// still refer to it.
+func (r *Router) DeleteMACSet(name string) error {
+	macset := r.FindMACSet(name)
+	if macset == nil {
+		return ErrMACSetNotFound
+	}
+	if refs := r.MACSetReferences(name); len(refs) > 0 {
+		return fmt.Errorf("%w: used by %s", ErrMACSetReferred, describeReferences(refs))
+	}
+
+	if macset.set != nil {
+		r.nft.DelSet(macset.set)
+		if err := r.Update(); err != nil {
+			return err
+		}
+	}
+
+	delete(r.macsets, name)
+
+	return nil
+}
+
+// Delete a MACSet, removing the entries referring to it first.
+func (r *Router) DeleteMACSetCascade(name string) error {
+	if r.FindMACSet(name) == nil {
+		return ErrMACSetNotFound
+	}
+
+	if err := r.removeReferences(r.MACSetReferences(name)); err != nil {
+		return err
+	}
+
+	return r.DeleteMACSet(name)
+}
+
+// Get the entries referring to a MACSet.
+func (r *Router) MACSetReferences(name string) []Reference {
+	return r.refs.Users(Object{Kind: ObjectMACSet, Name: name})
+}
+
+// Get the kernel set matching a MACAddress, which is a shared set for
+// immediate addresses.
+func (r *Router) macAddressToSet(address *MACAddress) (*nftables.Set, error) {
+	if address.MACSet != "" {
+		macset := r.FindMACSet(address.MACSet)
+		if macset == nil {
+			return nil, fmt.Errorf("%w: %s", ErrMACSetNotFound, address.MACSet)
+		}
+		if macset.set == nil {
+			if err := r.UpdateMACSet(macset); err != nil {
+				return nil, err
+			}
+		}
+		return macset.set, nil
+	}
+
+	if len(address.Immediate) == 0 {
+		return nil, nil
+	}
+
+	macs := []string{}
+	for _, mac := range address.Immediate {
+		macs = append(macs, mac.String())
+	}
+	sort.Strings(macs)
+	key := fmt.Sprintf("mac:%s", strings.Join(macs, ","))
+
+	return r.acquireSharedSet(key, nftables.TypeEtherAddr, false, macSetElements(address.Immediate))
+}
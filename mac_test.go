@@ -0,0 +1,91 @@
+package yafw
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+func mustParseMAC(s string) net.HardwareAddr {
+	mac, err := ParseMAC(s)
+	if err != nil {
+		panic(err)
+	}
+	return mac
+}
+
+func TestMACSet(t *testing.T) {
+	router := newTestRouter()
+
+	macset := router.NewMACSet("printers")
+	macset.AddMAC(mustParseMAC("00:11:22:33:44:55")).AddMAC(mustParseMAC("00:11:22:33:44:66"))
+	if err := router.UpdateMACSet(macset); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := &Policy{SourceMAC: NewMACAddressSet("printers")}
+	if err := router.PolicyTable().Append(policy); err != nil {
+		t.Fatal(err)
+	}
+	immediate := &Policy{SourceMAC: NewMACAddressImmediate([]net.HardwareAddr{mustParseMAC("00:11:22:33:44:77")})}
+	if err := router.PolicyTable().Append(immediate); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the changes are sent to the kernel, and are kept until it takes
+	// them
+	macset.DeleteMAC(mustParseMAC("00:11:22:33:44:55")).AddMAC(mustParseMAC("00:11:22:33:44:88"))
+	router.nft.DelTable(&nftables.Table{Name: "missing", Family: nftables.TableFamilyINet})
+	if err := router.UpdateMACSet(macset); err == nil {
+		t.Fatalf("test assert error: rejected batch flushed")
+	}
+	if len(macset.willAdd) != 1 || len(macset.willDelete) != 1 {
+		t.Fatalf("test assert error: incremental update %v, %v", macset.willAdd, macset.willDelete)
+	}
+	if err := router.UpdateMACSet(macset); err != nil {
+		t.Fatal(err)
+	}
+	if len(macset.willAdd) != 0 || len(macset.willDelete) != 0 || macset.set.Name != "macset-1" {
+		t.Fatalf("test assert error: %s updated with %v, %v left", macset.set.Name, macset.willAdd, macset.willDelete)
+	}
+
+	elements, err := router.query.GetSetElements(macset.set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, element := range elements {
+		got[net.HardwareAddr(element.Key).String()] = true
+	}
+	if len(got) != 2 || !got["00:11:22:33:44:66"] || !got["00:11:22:33:44:88"] {
+		t.Fatalf("test assert error: kernel elements %v", got)
+	}
+
+	if err := router.DeleteMACSet("printers"); !errors.Is(err, ErrMACSetReferred) {
+		t.Fatalf("test assert error: DeleteMACSet = %v (expecting %v)", err, ErrMACSetReferred)
+	}
+}
+
+func TestMACAddressJSON(t *testing.T) {
+	for _, data := range []string{`["00:11:22:33:44:55"]`, `"printers"`} {
+		address := &MACAddress{}
+		if err := json.Unmarshal([]byte(data), address); err != nil {
+			t.Fatalf("error unmarshal %s: %v", data, err)
+		}
+
+		marshaled, err := json.Marshal(address)
+		if err != nil {
+			t.Fatalf("error marshal %v: %v", address, err)
+		}
+		if string(marshaled) != data {
+			t.Fatalf("test assert error: marshal %v = %s (expecting %s)", address, marshaled, data)
+		}
+	}
+
+	if err := json.Unmarshal([]byte(`["00:11:22:33:44"]`), &MACAddress{}); !errors.Is(err, ErrMACInvalid) {
+		t.Fatalf("test assert error: invalid mac unmarshaled (%v)", err)
+	}
+}
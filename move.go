@@ -0,0 +1,132 @@
+package yafw
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/nftables"
+)
+
+var ErrEntryMoveInvalid = errors.New("invalid entry move")
+
+// Move entries before another one. The entries are placed in the order they
+// are given, and are re-installed without rebuilding their artifacts. The change
+// is committed at once, unless a transaction is open, see Begin.
+func (t *EntryTable) MoveBefore(beforeIndex int, indexes ...int) error {
+	return t.move(indexes, func(rest []Entry) (int, error) {
+		for i, entry := range rest {
+			if entry.Index() == beforeIndex {
+				return i, nil
+			}
+		}
+		return 0, t.anchorError(beforeIndex, indexes)
+	})
+}
+
+// Move entries after another one, see MoveBefore.
+func (t *EntryTable) MoveAfter(afterIndex int, indexes ...int) error {
+	return t.move(indexes, func(rest []Entry) (int, error) {
+		for i, entry := range rest {
+			if entry.Index() == afterIndex {
+				return i + 1, nil
+			}
+		}
+		return 0, t.anchorError(afterIndex, indexes)
+	})
+}
+
+// Move entries before all the others, see MoveBefore.
+func (t *EntryTable) MoveToTop(indexes ...int) error {
+	return t.move(indexes, func(rest []Entry) (int, error) {
+		return 0, nil
+	})
+}
+
+// Move entries after all the others, see MoveBefore.
+func (t *EntryTable) MoveToBottom(indexes ...int) error {
+	return t.move(indexes, func(rest []Entry) (int, error) {
+		return len(rest), nil
+	})
+}
+
+func (t *EntryTable) anchorError(anchor int, indexes []int) error {
+	for _, index := range indexes {
+		if index == anchor {
+			return fmt.Errorf("%w: entry %d is placed next to itself", ErrEntryMoveInvalid, anchor)
+		}
+	}
+	return fmt.Errorf("%w: %d", ErrEntryIndexNotFound, anchor)
+}
+
+// Move entries to a position among the other entries, which is found by
+// position once they are taken out.
+func (t *EntryTable) move(indexes []int, position func(rest []Entry) (int, error)) error {
+	if len(indexes) == 0 {
+		return fmt.Errorf("%w: no entries", ErrEntryMoveInvalid)
+	}
+	moving := make(map[int]bool, len(indexes))
+	moved := make([]Entry, 0, len(indexes))
+	for _, index := range indexes {
+		entry := t.Find(index)
+		if entry == nil {
+			return fmt.Errorf("%w: %d", ErrEntryIndexNotFound, index)
+		}
+		if moving[index] {
+			return fmt.Errorf("%w: entry %d is given twice", ErrEntryMoveInvalid, index)
+		}
+		moving[index] = true
+		moved = append(moved, entry)
+	}
+
+	rest := []Entry{}
+	for _, entry := range t.list {
+		if !moving[entry.Index()] {
+			rest = append(rest, entry)
+		}
+	}
+	at, err := position(rest)
+	if err != nil {
+		return err
+	}
+
+	list := append([]Entry{}, rest[:at]...)
+	list = append(list, moved...)
+	list = append(list, rest[at:]...)
+
+	unchanged := true
+	for i := range list {
+		unchanged = unchanged && list[i] == t.list[i]
+	}
+	if unchanged {
+		return nil
+	}
+
+	tx := t.r.Begin()
+	if err := t.stageMove(list, moved); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Stage the new order of the table in the open transaction, re-installing the
+// rules of the moved entries.
+func (t *EntryTable) stageMove(list []Entry, moved []Entry) error {
+	change := t.r.tx.table(t)
+
+	staged := make(map[int][]*nftables.Rule, len(moved))
+	for _, entry := range moved {
+		rules, err := installedRules(entry)
+		if err != nil {
+			return err
+		}
+		staged[entry.Index()] = rules
+	}
+
+	t.list = list
+	for index, rules := range staged {
+		change.staged[index] = rules
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package yafw
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEntryMove(t *testing.T) {
+	router := newTestRouter()
+	policies := router.PolicyTable()
+
+	ids := []int{}
+	for _, source := range []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24"} {
+		policy := &Policy{Source: NewAddressImmediate(parseTestIPRanges(source))}
+		if err := policies.Append(policy); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, policy.ID)
+	}
+	a, b, c, d := ids[0], ids[1], ids[2], ids[3]
+
+	if err := policies.MoveToBottom(a); err != nil {
+		t.Fatal(err)
+	}
+	assertEntryOrder(t, policies, b, c, d, a)
+
+	// several entries are placed in the order they are given
+	if err := policies.MoveToTop(a, d); err != nil {
+		t.Fatal(err)
+	}
+	assertEntryOrder(t, policies, a, d, b, c)
+
+	if err := policies.MoveBefore(a, c, b); err != nil {
+		t.Fatal(err)
+	}
+	assertEntryOrder(t, policies, c, b, a, d)
+
+	if err := policies.MoveToBottom(a); err != nil {
+		t.Fatal(err)
+	}
+	assertEntryOrder(t, policies, c, b, d, a)
+
+	if err := policies.MoveAfter(a, b); err != nil {
+		t.Fatal(err)
+	}
+	assertEntryOrder(t, policies, c, d, a, b)
+	assertConsistent(t, router)
+
+	// moves staged in a transaction are dropped by a rollback
+	tx := router.Begin()
+	if err := policies.MoveToTop(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := policies.MoveAfter(b, a); err != nil {
+		t.Fatal(err)
+	}
+	if list, kernel := entryOrder(policies), kernelEntryOrder(t, policies); list[0] != b || list[1] != a || kernel[0] != c {
+		t.Fatalf("test assert error: entries %v in the kernel as %v before commit", list, kernel)
+	}
+	tx.Rollback()
+	assertEntryOrder(t, policies, c, d, a, b)
+	assertConsistent(t, router)
+
+	if err := policies.MoveBefore(a, a, b); !errors.Is(err, ErrEntryMoveInvalid) {
+		t.Fatalf("test assert error: entry moved next to itself with %v", err)
+	}
+	if err := policies.MoveToTop(b, a, b); !errors.Is(err, ErrEntryMoveInvalid) {
+		t.Fatalf("test assert error: entry moved twice with %v", err)
+	}
+	if err := policies.MoveAfter(100, a); !errors.Is(err, ErrEntryIndexNotFound) {
+		t.Fatalf("test assert error: entry moved after a missing one with %v", err)
+	}
+	if err := policies.MoveToTop(a, 100); !errors.Is(err, ErrEntryIndexNotFound) {
+		t.Fatalf("test assert error: missing entry moved with %v", err)
+	}
+	assertEntryOrder(t, policies, c, d, a, b)
+}
@@ -1,7 +1,6 @@
 package yafw
 
 import (
-	"fmt"
 	"net"
 
 	"github.com/google/nftables"
@@ -29,7 +28,7 @@ const (
 type SNATRule struct {
 	ID            int        `json:"id"`
 	Description   string     `json:"description"`
-	Enabled       bool       `json:"enabled"`
+	Enable        *bool      `json:"enabled"`
 	Source        *Address   `json:"source"`
 	Destination   *Address   `json:"destination"`
 	Egress        string     `json:"egress"`
@@ -42,8 +41,8 @@ type SNATRule struct {
 }
 
 type SNATRuleArtifact struct {
-	Source      *nftables.Set
-	Destination *nftables.Set
+	Source      *AddressSet
+	Destination *AddressSet
 	Egress      *net.Interface
 }
 
@@ -99,6 +98,33 @@ func (snat *SNATRule) buildArtifact(router *Router) error {
 	return nil
 }
 
+func (snat *SNATRule) references() []Object {
+	return addressObjects(snat.Source, snat.Destination, snat.TargetAddress)
+}
+
+func (snat *SNATRule) artifactSets() []*nftables.Set {
+	if snat.artifact == nil {
+		return nil
+	}
+
+	ret := []*nftables.Set{}
+	for _, set := range []*AddressSet{snat.artifact.Source, snat.artifact.Destination} {
+		if set != nil {
+			ret = append(ret, set.V4, set.V6)
+		}
+	}
+
+	return ret
+}
+
+func (snat *SNATRule) artifactState() any {
+	return snat.artifact
+}
+
+func (snat *SNATRule) restoreArtifact(state any) {
+	snat.artifact, _ = state.(*SNATRuleArtifact)
+}
+
 func (snat *SNATRule) Index() int {
 	return snat.ID
 }
@@ -107,41 +133,55 @@ func (snat *SNATRule) SetIndex(index int) {
 	snat.ID = index
 }
 
-func (snat *SNATRule) ToRules() []*nftables.Rule {
-	builder := &ExprBuilder{}
+// Check whether the rule is enabled, which it is unless enabled is set to
+// false.
+func (snat *SNATRule) Enabled() bool {
+	return snat.Enable == nil || *snat.Enable
+}
+
+func (snat *SNATRule) SetEnabled(enabled bool) {
+	snat.Enable = &enabled
+}
+
+func (snat *SNATRule) ToRules() ([]*nftables.Rule, error) {
 	artifact := snat.artifact
+	if artifact == nil {
+		artifact = &SNATRuleArtifact{}
+	}
 
-	if artifact != nil {
-		if snat.Egress != "" {
-			builder.MetaEgressInterface(1).CompareInterfaceName(1, artifact.Egress.Name)
-		}
+	// a rule is compiled for each family the addresses can match
+	rules := []*nftables.Rule{}
+	for _, family := range matchFamilies(artifact.Source, artifact.Destination) {
+		builder := &ExprBuilder{}
 
-		if snat.Source != nil {
-			builder.PayloadIPSource(1).LookupSet(1, artifact.Source)
+		if snat.Egress != "" && artifact.Egress != nil {
+			builder.MatchEgressInterface(artifact.Egress.Name)
 		}
 
-		if snat.Destination != nil {
-			builder.PayloadIPSource(1).LookupSet(1, artifact.Destination)
-		}
-	}
+		builder.MatchFamily(family)
 
-	builder.Append(&expr.Log{
-		Data:  []byte("yafw-snat"),
-		Flags: expr.LogFlagsIPOpt | expr.LogFlagsTCPOpt,
-	})
+		builder.MatchSourceAddress(family, artifact.Source).
+			MatchDestinationAddress(family, artifact.Destination)
 
-	switch snat.Target {
-	case SNATEgress:
-		builder.Masquerade()
-		// case SNATSpecific:
-		// 	builder.SourceNATIP(snat.TargetAddress)
-	}
+		builder.Counter()
 
-	fmt.Printf("nat builder: %v\n", len(builder.Exprs()))
+		builder.Log("yafw-snat", expr.LogFlagsIPOpt|expr.LogFlagsTCPOpt)
+
+		switch snat.Target {
+		case SNATEgress:
+			builder.Masquerade()
+			// case SNATSpecific:
+			// 	builder.SourceNATIP(snat.TargetAddress)
+		}
 
-	return []*nftables.Rule{
-		{
-			Exprs: builder.Exprs(),
-		},
+		exprs, err := builder.Build()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, &nftables.Rule{
+			Exprs: exprs,
+		})
 	}
+
+	return rules, nil
 }
@@ -2,6 +2,7 @@ package yafw
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
@@ -46,21 +47,47 @@ type Policy struct {
 	Description string       `json:"description"`
 	Log         bool         `json:"log"`
 	Action      PolicyAction `json:"action"`
+	Disabled    bool         `json:"disabled"`
 
-	Source          *Address `json:"source"`
-	SourceZone      string   `json:"source_zone"`
-	Destination     *Address `json:"destination"`
-	DestinationZone string   `json:"destination_zone"`
-	Service         *Service `json:"service"`
+	Source          *Address    `json:"source"`
+	SourceMAC       *MACAddress `json:"source_mac"`
+	SourceZone      string      `json:"source_zone"`
+	Destination     *Address    `json:"destination"`
+	DestinationZone string      `json:"destination_zone"`
+	Service         *Service    `json:"service"`
+
+	// Policies only see the packets of connections which are not established
+	// yet, so the limits apply to new connections. Packets beyond them get
+	// the overflow action instead of the action.
+	RateLimit   *RateLimit     `json:"rate_limit,omitempty"`
+	SourceLimit *SourceLimit   `json:"source_limit,omitempty"`
+	Overflow    OverflowAction `json:"overflow"`
+
+	// Unlike the limits, the quota counts the packets of the established
+	// connections accepted by the policy as well.
+	Quota *Quota `json:"quota,omitempty"`
+
+	// name of the schedule the policy follows, or always active if empty
+	Schedule string `json:"schedule,omitempty"`
 
 	artifact *PolicyArtifact
 }
 
 type PolicyArtifact struct {
-	Source          *nftables.Set
+	Source          *AddressSet
+	SourceMAC       *nftables.Set
 	SourceZone      *nftables.Set
-	Destination     *nftables.Set
+	Destination     *AddressSet
 	DestinationZone *nftables.Set
+
+	// meters of the new connections and the connections of each source
+	RateMeter       *AddressSet
+	ConnectionMeter *AddressSet
+
+	// name of the quota object
+	Quota string
+
+	Schedule *scheduleState
 }
 
 func (r *Router) Policies() (ret []*Policy) {
@@ -76,25 +103,44 @@ func (r *Router) Policies() (ret []*Policy) {
 // the following contents implement Entry in entry.go
 
 func (policy *Policy) buildArtifact(router *Router) error {
+	if policy.Service != nil {
+		if err := policy.Service.Validate(); err != nil {
+			return err
+		}
+	}
+	if policy.RateLimit != nil {
+		if err := policy.RateLimit.Validate(); err != nil {
+			return err
+		}
+	}
+	if policy.SourceLimit != nil {
+		if err := policy.SourceLimit.Validate(); err != nil {
+			return err
+		}
+	}
+	if policy.Quota != nil {
+		if err := policy.Quota.Validate(); err != nil {
+			return err
+		}
+	}
+
 	artifact := &PolicyArtifact{}
 
-	// if policy.SourceZone != "" {
-	// 	zone := router.zones.FindZone(policy.SourceZone)
-	// 	if zone != nil {
-	// 		artifact.SourceZone = zone.set
-	// 	} else {
-	// 		return fmt.Errorf("zone \"%s\" not found", policy.SourceZone)
-	// 	}
-	// }
-
-	// if policy.DestinationZone != "" {
-	// 	zone := router.zones.FindZone(policy.DestinationZone)
-	// 	if zone != nil {
-	// 		artifact.DestinationZone = zone.set
-	// 	} else {
-	// 		return fmt.Errorf("zone \"%s\" not found", policy.DestinationZone)
-	// 	}
-	// }
+	if policy.SourceZone != "" {
+		zone := router.zones.FindZone(policy.SourceZone)
+		if zone == nil {
+			return fmt.Errorf("%w: %s", ErrZoneNotFound, policy.SourceZone)
+		}
+		artifact.SourceZone = zone.set
+	}
+
+	if policy.DestinationZone != "" {
+		zone := router.zones.FindZone(policy.DestinationZone)
+		if zone == nil {
+			return fmt.Errorf("%w: %s", ErrZoneNotFound, policy.DestinationZone)
+		}
+		artifact.DestinationZone = zone.set
+	}
 
 	if policy.Source != nil {
 		set, err := router.addressToSet(policy.Source)
@@ -112,11 +158,94 @@ func (policy *Policy) buildArtifact(router *Router) error {
 		artifact.Destination = set
 	}
 
+	if policy.SourceMAC != nil {
+		set, err := router.macAddressToSet(policy.SourceMAC)
+		if err != nil {
+			return err
+		}
+		artifact.SourceMAC = set
+	}
+
+	if policy.SourceLimit != nil && policy.SourceLimit.NewConnections != nil {
+		meter, err := router.acquireMeter(meterTimeout)
+		if err != nil {
+			return err
+		}
+		artifact.RateMeter = meter
+	}
+
+	if policy.SourceLimit != nil && policy.SourceLimit.Connections != 0 {
+		meter, err := router.acquireMeter(0)
+		if err != nil {
+			return err
+		}
+		artifact.ConnectionMeter = meter
+	}
+
+	if policy.Schedule != "" {
+		schedule, err := router.schedules.state(policy.Schedule)
+		if err != nil {
+			return err
+		}
+		artifact.Schedule = schedule
+	}
+
+	quota, err := router.quotas.set(policy)
+	if err != nil {
+		return err
+	}
+	artifact.Quota = quota
+
 	policy.artifact = artifact
 
 	return nil
 }
 
+func (policy *Policy) references() []Object {
+	ret := addressObjects(policy.Source, policy.Destination)
+	if policy.SourceMAC != nil && policy.SourceMAC.MACSet != "" {
+		ret = append(ret, Object{Kind: ObjectMACSet, Name: policy.SourceMAC.MACSet})
+	}
+	for _, zone := range []string{policy.SourceZone, policy.DestinationZone} {
+		if zone != "" {
+			ret = append(ret, Object{Kind: ObjectZone, Name: zone})
+		}
+	}
+	if policy.Schedule != "" {
+		ret = append(ret, Object{Kind: ObjectSchedule, Name: policy.Schedule})
+	}
+
+	return ret
+}
+
+func (policy *Policy) artifactSets() []*nftables.Set {
+	if policy.artifact == nil {
+		return nil
+	}
+
+	artifact := policy.artifact
+	ret := []*nftables.Set{artifact.SourceMAC}
+	for _, set := range []*AddressSet{artifact.Source, artifact.Destination, artifact.RateMeter, artifact.ConnectionMeter} {
+		if set != nil {
+			ret = append(ret, set.V4, set.V6)
+		}
+	}
+
+	return ret
+}
+
+func (policy *Policy) artifactState() any {
+	return policy.artifact
+}
+
+func (policy *Policy) restoreArtifact(state any) {
+	policy.artifact, _ = state.(*PolicyArtifact)
+}
+
+func (policy *Policy) releaseArtifact(router *Router) {
+	router.quotas.release(policy.ID)
+}
+
 func (policy *Policy) Index() int {
 	return policy.ID
 }
@@ -125,49 +254,165 @@ func (policy *Policy) SetIndex(index int) {
 	policy.ID = index
 }
 
-func (policy *Policy) ToRules() []*nftables.Rule {
-	builder := &ExprBuilder{}
-	artifact := policy.artifact
+func (policy *Policy) Enabled() bool {
+	return !policy.Disabled
+}
 
-	if artifact != nil {
-		if policy.SourceZone != "" && artifact.SourceZone != nil {
-			builder.MetaIngressInterface(1).LookupSet(1, artifact.SourceZone)
-		}
+func (policy *Policy) SetEnabled(enabled bool) {
+	policy.Disabled = !enabled
+}
 
-		if policy.DestinationZone != "" && artifact.DestinationZone != nil {
-			builder.MetaIngressInterface(1).LookupSet(1, artifact.DestinationZone)
-		}
+// A policy following a schedule the kernel does not match is only installed
+// while the schedule is active.
+func (policy *Policy) active() bool {
+	if policy.artifact == nil || policy.artifact.Schedule == nil {
+		return true
+	}
+	schedule := policy.artifact.Schedule
+	return schedule.inKernel || schedule.active
+}
 
-		if policy.Source != nil && artifact.Source != nil {
-			builder.PayloadIPSource(1).LookupSet(1, artifact.Source)
-		}
+// Add the matches of the policy in a family and a time to a rule.
+func (policy *Policy) match(builder *ExprBuilder, family nftables.TableFamily, when *timeMatch, artifact *PolicyArtifact) {
+	if policy.SourceZone != "" {
+		builder.MatchIngressInterfaceSet(artifact.SourceZone)
+	}
+
+	if policy.DestinationZone != "" {
+		builder.MatchEgressInterfaceSet(artifact.DestinationZone)
+	}
 
-		if policy.Destination != nil && artifact.Destination != nil {
-			builder.PayloadIPDestination(1).LookupSet(1, artifact.Destination)
+	builder.MatchSourceMAC(artifact.SourceMAC)
+
+	builder.MatchFamily(family)
+
+	builder.MatchSourceAddress(family, artifact.Source).
+		MatchDestinationAddress(family, artifact.Destination)
+
+	builder.MatchService(family, policy.Service)
+
+	when.match(builder)
+}
+
+// Add the limits of the policy to a rule, matching packets beyond any of
+// them if over is set, or within all of them otherwise.
+func (policy *Policy) limit(builder *ExprBuilder, family nftables.TableFamily, when *timeMatch, artifact *PolicyArtifact, over bool) []*ExprBuilder {
+	ret := []*ExprBuilder{}
+	next := func() *ExprBuilder {
+		if !over {
+			return builder
 		}
+		// a limit of its own for each rule, any of which overflows
+		b := &ExprBuilder{}
+		policy.match(b, family, when, artifact)
+		ret = append(ret, b)
+		return b
 	}
 
-	if policy.Service != nil {
-		builder.AppendGroup(policy.Service.Exprs())
+	if policy.RateLimit != nil {
+		next().Limit(policy.RateLimit, over)
+	}
+	if artifact.RateMeter != nil {
+		next().MatchSourceRate(family, artifact.RateMeter, policy.SourceLimit.NewConnections, over)
+	}
+	if artifact.ConnectionMeter != nil {
+		next().MatchSourceConnections(family, artifact.ConnectionMeter, policy.SourceLimit.Connections, over)
 	}
 
-	if policy.Log {
-		builder.Append(&expr.Log{
-			Data:  []byte("yafw-policy"),
-			Flags: expr.LogFlagsIPOpt | expr.LogFlagsTCPOpt,
-		})
+	return ret
+}
+
+func (policy *Policy) limited() bool {
+	return policy.RateLimit != nil || policy.SourceLimit != nil
+}
+
+func (policy *Policy) ToRules() ([]*nftables.Rule, error) {
+	artifact := policy.artifact
+	if artifact == nil {
+		artifact = &PolicyArtifact{}
 	}
 
-	switch policy.Action {
-	case PolicyAccept:
-		builder.VerdictAccept()
-	case PolicyDrop:
-		builder.VerdictDrop()
+	// a rule is compiled for each family the addresses can match, and the
+	// meters of sources are kept for each family
+	families := policy.Service.families(matchFamilies(artifact.Source, artifact.Destination))
+	if artifact.RateMeter != nil || artifact.ConnectionMeter != nil {
+		families = splitFamilies(families)
 	}
 
-	return []*nftables.Rule{
-		{
-			Exprs: builder.Exprs(),
-		},
+	// the times of a schedule the kernel matches are alternatives, each
+	// with rules of its own, and there may be none if the schedule ended
+	times := []*timeMatch{nil}
+	if artifact.Schedule != nil && artifact.Schedule.inKernel {
+		times = artifact.Schedule.matches
+	}
+
+	builders := []*ExprBuilder{}
+	for _, family := range families {
+		for _, when := range times {
+			// packets beyond the limits are caught by rules of their own
+			// before the policy, unless they fall through to the following
+			// policies
+			if policy.limited() && policy.Overflow != OverflowContinue {
+				for _, builder := range policy.limit(&ExprBuilder{}, family, when, artifact, true) {
+					builder.Counter()
+					if policy.Log {
+						builder.Log("yafw-overflow", expr.LogFlagsIPOpt|expr.LogFlagsTCPOpt)
+					}
+					switch policy.Overflow {
+					case OverflowAccept:
+						builder.VerdictAccept()
+					case OverflowDrop:
+						builder.VerdictDrop()
+					}
+					builders = append(builders, builder)
+				}
+			}
+
+			builder := &ExprBuilder{}
+			policy.match(builder, family, when, artifact)
+			if policy.limited() && policy.Overflow == OverflowContinue {
+				policy.limit(builder, family, when, artifact, false)
+			}
+
+			builder.Counter()
+
+			if policy.Log {
+				builder.Log("yafw-policy", expr.LogFlagsIPOpt|expr.LogFlagsTCPOpt)
+			}
+
+			switch policy.Action {
+			case PolicyAccept:
+				if artifact.Quota != "" {
+					// packets about to be accepted are charged to the quota
+					// in the quota chain, which gives the fallback action
+					// beyond it, and are accepted by the rule following
+					// once they come back
+					builder.SetConntrackMark(quotaMark(policy.ID)).VerdictJump(quotaChain)
+					builders = append(builders, builder)
+
+					builder = &ExprBuilder{}
+					policy.match(builder, family, when, artifact)
+					builder.MatchConntrackMark(quotaMark(policy.ID))
+				}
+				builder.VerdictAccept()
+			case PolicyDrop:
+				builder.VerdictDrop()
+			}
+
+			builders = append(builders, builder)
+		}
 	}
+
+	rules := []*nftables.Rule{}
+	for _, builder := range builders {
+		exprs, err := builder.Build()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, &nftables.Rule{
+			Exprs: exprs,
+		})
+	}
+
+	return rules, nil
 }
@@ -0,0 +1,535 @@
+package yafw
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrQuotaInvalid  = errors.New("invalid quota")
+	ErrQuotaNotFound = errors.New("quota not found")
+)
+
+// NFT_OBJECT_QUOTA, which is missing from unix
+const nftObjectQuota = 2
+
+// A number of bytes a policy passes in each period. Only the packets the
+// policy accepts are charged, so a quota has no effect on a dropping policy.
+// Once the quota is used up, the packets of the policy get the fallback
+// action, including those of the connections accepted before.
+type Quota struct {
+	Bytes uint64 `json:"bytes"`
+	// "hour", "day", "week" or "month" starting at midnight in local time, or
+	// empty if the quota is only reset by hand
+	Period string `json:"period"`
+	// either "drop" or "accept"
+	Fallback OverflowAction `json:"fallback"`
+}
+
+func (q *Quota) Validate() error {
+	if q.Bytes == 0 {
+		return fmt.Errorf("%w: quota of 0 bytes", ErrQuotaInvalid)
+	}
+	if _, ok := quotaPeriods[q.Period]; !ok {
+		return fmt.Errorf("%w: period %q", ErrQuotaInvalid, q.Period)
+	}
+	if q.Fallback == OverflowContinue {
+		return fmt.Errorf("%w: connections cannot continue to other policies", ErrQuotaInvalid)
+	}
+	return nil
+}
+
+// Get the start of the period following t.
+var quotaPeriods = map[string]func(t time.Time) time.Time{
+	"": nil,
+	"hour": func(t time.Time) time.Time {
+		return t.Truncate(time.Hour).Add(time.Hour)
+	},
+	"day": func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+	},
+	"week": func(t time.Time) time.Time {
+		// weeks start on Monday
+		days := (8 - int(t.Weekday())) % 7
+		if days == 0 {
+			days = 7
+		}
+		return time.Date(t.Year(), t.Month(), t.Day()+days, 0, 0, 0, 0, t.Location())
+	},
+	"month": func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+	},
+}
+
+// Consumption of the quota of a policy.
+type QuotaUsage struct {
+	Policy    int        `json:"policy"`
+	Object    string     `json:"object"`
+	Bytes     uint64     `json:"bytes"`
+	Consumed  uint64     `json:"consumed"`
+	Exhausted bool       `json:"exhausted"`
+	Period    string     `json:"period"`
+	LastReset time.Time  `json:"last_reset"`
+	NextReset *time.Time `json:"next_reset"`
+}
+
+type policyQuota struct {
+	policy int
+	name   string
+	quota  Quota
+
+	// rule of the quota chain using the object
+	rule *nftables.Rule
+	// whether the rule is built again as the pending batch is flushed
+	stale bool
+
+	lastReset time.Time
+	// zero if the quota is only reset by hand
+	nextReset time.Time
+}
+
+// Quota objects of the policies. Packets of the connections accepted by a
+// policy with a quota carry its ID as their conntrack mark, and are charged to
+// its quota in a chain jumped to before the conntrack states are accepted, or
+// by the policy as it accepts the first packet.
+type QuotaTable struct {
+	r *Router
+
+	m       map[int]*policyQuota
+	counter int
+
+	chain *nftables.Chain
+	// whether rules of the quota chain are pending, whose handles are found
+	// after the flush
+	dirty bool
+	// objects created or updated before the rules of the pending batch
+	objects []netlink.Message
+	// objects deleted after the rules of the pending batch
+	dead []string
+
+	// interval of checking the quotas for the end of their periods
+	PollInterval time.Duration
+}
+
+func NewQuotaTable(r *Router) *QuotaTable {
+	return &QuotaTable{
+		r:            r,
+		m:            make(map[int]*policyQuota),
+		PollInterval: 10 * time.Second,
+	}
+}
+
+// Name of the chain charging the packets of policies to their quotas.
+const quotaChain = "quota"
+
+// Get the conntrack mark of the connections of a policy.
+func quotaMark(policy int) uint32 {
+	return uint32(policy)
+}
+
+func (t *QuotaTable) tag(rule *nftables.Rule, policy int) {
+	rule.UserData = make([]byte, 8)
+	binary.BigEndian.PutUint64(rule.UserData, uint64(policy))
+}
+
+// Create the quota chain along with the rule jumping to it, before the rule
+// accepting established connections. It goes into the pending batch.
+func (t *QuotaTable) initChain() {
+	if t.chain != nil {
+		return
+	}
+
+	t.chain = t.r.nft.AddChain(&nftables.Chain{
+		Name:  quotaChain,
+		Table: t.r.table,
+	})
+	t.r.nft.InsertRule(&nftables.Rule{
+		Table: t.r.table,
+		Chain: t.r.forward,
+		Exprs: (&ExprBuilder{}).Append(&expr.Verdict{Kind: expr.VerdictJump, Chain: t.chain.Name}).Exprs(),
+	})
+}
+
+// Create, update or release the quota of a policy as it is configured,
+// returning the name of its object. The object and the rule using it go into
+// the pending batch.
+func (t *QuotaTable) set(policy *Policy) (string, error) {
+	old, ok := t.m[policy.ID]
+	if policy.Quota == nil {
+		t.release(policy.ID)
+		return "", nil
+	}
+
+	q := old
+	if !ok {
+		t.counter++
+		q = &policyQuota{
+			policy:    policy.ID,
+			name:      fmt.Sprintf("quota-%d", t.counter),
+			lastReset: time.Now(),
+		}
+	}
+
+	// an existing object keeps its consumption
+	if !ok || q.quota.Bytes != policy.Quota.Bytes {
+		t.objects = append(t.objects, t.r.quotaObjectNew(q.name, policy.Quota.Bytes))
+	}
+
+	if !ok || q.quota.Fallback != policy.Quota.Fallback {
+		t.initChain()
+		// the rule is only built at flush, since a rule of the pending batch
+		// has no handle to be deleted by
+		q.stale = true
+	}
+
+	if !ok || q.quota.Period != policy.Quota.Period {
+		q.nextReset = time.Time{}
+		if next := quotaPeriods[policy.Quota.Period]; next != nil {
+			q.nextReset = next(time.Now())
+		}
+	}
+
+	q.quota = *policy.Quota
+	t.m[policy.ID] = q
+
+	return q.name, nil
+}
+
+// Delete the quota of a policy. The object is deleted in the pending batch,
+// after the rules using it.
+func (t *QuotaTable) release(policy int) {
+	q, ok := t.m[policy]
+	if !ok {
+		return
+	}
+
+	if q.rule != nil {
+		t.r.nft.DelRule(q.rule)
+	}
+	t.dead = append(t.dead, q.name)
+	delete(t.m, policy)
+}
+
+// State of the quotas restored once a transaction is rolled back.
+type quotaSnapshot struct {
+	m       map[int]policyQuota
+	counter int
+	chain   *nftables.Chain
+	dirty   bool
+	objects []netlink.Message
+	dead    []string
+}
+
+func (t *QuotaTable) snapshot() *quotaSnapshot {
+	ret := &quotaSnapshot{
+		m:       make(map[int]policyQuota, len(t.m)),
+		counter: t.counter,
+		chain:   t.chain,
+		dirty:   t.dirty,
+		objects: append([]netlink.Message(nil), t.objects...),
+		dead:    append([]string(nil), t.dead...),
+	}
+	for policy, q := range t.m {
+		ret.m[policy] = *q
+	}
+	return ret
+}
+
+// Restore the quotas of a snapshot. Their objects are changed in the batch
+// along with the rules, so the kernel is left as it is.
+func (t *QuotaTable) restore(s *quotaSnapshot) {
+	t.m = make(map[int]*policyQuota, len(s.m))
+	for policy, q := range s.m {
+		q := q
+		t.m[policy] = &q
+	}
+	t.counter, t.chain, t.dirty, t.objects, t.dead = s.counter, s.chain, s.dirty, s.objects, s.dead
+}
+
+// Add the rules of the quotas changed to the pending batch, replacing the
+// ones in the kernel.
+func (t *QuotaTable) beforeFlush() error {
+	for _, q := range t.m {
+		if !q.stale {
+			continue
+		}
+		if q.rule != nil {
+			t.r.nft.DelRule(q.rule)
+		}
+
+		builder := (&ExprBuilder{}).MatchConntrackMark(quotaMark(q.policy)).Quota(q.name).Counter()
+		if q.quota.Fallback == OverflowAccept {
+			builder.VerdictAccept()
+		} else {
+			builder.VerdictDrop()
+		}
+		exprs, err := builder.Build()
+		if err != nil {
+			return err
+		}
+		q.rule = &nftables.Rule{Table: t.r.table, Chain: t.chain, Exprs: exprs}
+		t.tag(q.rule, q.policy)
+		t.r.nft.AddRule(q.rule)
+		q.stale = false
+		t.dirty = true
+	}
+	return nil
+}
+
+// Put the objects changed into a batch, the ones created or updated before
+// the rules which may use them, and the ones deleted after the rules which
+// used them.
+func (t *QuotaTable) addObjects(batch []netlink.Message) []netlink.Message {
+	if len(t.objects) == 0 && len(t.dead) == 0 {
+		return batch
+	}
+	if len(batch) == 0 {
+		batch = wrapBatch(nil)
+	}
+
+	ret := make([]netlink.Message, 0, len(batch)+len(t.objects)+len(t.dead))
+	ret = append(ret, batch[0])
+	ret = append(ret, t.objects...)
+	ret = append(ret, batch[1:len(batch)-1]...)
+	for _, name := range t.dead {
+		ret = append(ret, t.r.quotaObjectMessage(unix.NFT_MSG_DELOBJ, name, nil))
+	}
+	ret = append(ret, batch[len(batch)-1])
+	t.objects, t.dead = nil, nil
+
+	return ret
+}
+
+// Find the handles of the rules added to the quota chain once the pending
+// batch is flushed.
+func (t *QuotaTable) afterFlush() error {
+	if !t.dirty {
+		return nil
+	}
+	if err := t.updateHandles(); err != nil {
+		return err
+	}
+	t.dirty = false
+	return nil
+}
+
+func (t *QuotaTable) updateHandles() error {
+	rules, err := t.r.query.GetRules(t.r.table, t.chain)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if id, ok := ruleTag(rule); ok {
+			if q, ok := t.m[id]; ok {
+				q.rule = rule
+			}
+		}
+	}
+
+	return nil
+}
+
+func (t *QuotaTable) usage(q *policyQuota, reset bool) (*QuotaUsage, error) {
+	bytes, consumed, err := t.r.getQuotaObject(q.name, reset)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &QuotaUsage{
+		Policy:    q.policy,
+		Object:    q.name,
+		Bytes:     bytes,
+		Consumed:  consumed,
+		Exhausted: consumed >= bytes,
+		Period:    q.quota.Period,
+		LastReset: q.lastReset,
+	}
+	if !q.nextReset.IsZero() {
+		next := q.nextReset
+		ret.NextReset = &next
+	}
+
+	return ret, nil
+}
+
+// Get the consumption of the quota of a policy.
+func (t *QuotaTable) Usage(policy int) (*QuotaUsage, error) {
+	q, ok := t.m[policy]
+	if !ok {
+		return nil, ErrQuotaNotFound
+	}
+	return t.usage(q, false)
+}
+
+// Get the consumption of every quota, ordered by policy.
+func (t *QuotaTable) All() ([]*QuotaUsage, error) {
+	ret := []*QuotaUsage{}
+	for _, entry := range t.r.policyEntries.All() {
+		if q, ok := t.m[entry.Index()]; ok {
+			usage, err := t.usage(q, false)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, usage)
+		}
+	}
+	return ret, nil
+}
+
+// Reset the consumption of the quota of a policy to 0, returning the
+// consumption before. The period goes on as it is.
+func (t *QuotaTable) Reset(policy int) (*QuotaUsage, error) {
+	q, ok := t.m[policy]
+	if !ok {
+		return nil, ErrQuotaNotFound
+	}
+
+	usage, err := t.usage(q, true)
+	if err != nil {
+		return nil, err
+	}
+	q.lastReset = time.Now()
+
+	return usage, nil
+}
+
+// Reset the quotas whose periods are over. It returns the first error, after
+// trying every due quota.
+func (t *QuotaTable) resetDue(now time.Time) error {
+	var ret error
+	for _, q := range t.m {
+		if q.nextReset.IsZero() || now.Before(q.nextReset) {
+			continue
+		}
+		if _, err := t.usage(q, true); err != nil {
+			if ret == nil {
+				ret = err
+			}
+			continue
+		}
+		q.lastReset = now
+		q.nextReset = quotaPeriods[q.quota.Period](now)
+	}
+	return ret
+}
+
+// Reset the quotas at the end of their periods, until ctx is done.
+func (t *QuotaTable) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		t.r.Lock()
+		// a failed reset is tried again on the next tick
+		_ = t.resetDue(time.Now())
+		t.r.Unlock()
+	}
+}
+
+// The nftables library only knows counter objects, so quota objects are sent
+// over netlink here. Their messages are like those of the library.
+
+func (r *Router) quotaObjectMessage(t uint16, name string, data []netlink.Attribute) netlink.Message {
+	attrs := []netlink.Attribute{
+		{Type: unix.NFTA_OBJ_TABLE, Data: []byte(r.table.Name + "\x00")},
+		{Type: unix.NFTA_OBJ_NAME, Data: []byte(name + "\x00")},
+		{Type: unix.NFTA_OBJ_TYPE, Data: binaryutil.BigEndian.PutUint32(nftObjectQuota)},
+	}
+	if data != nil {
+		nested, _ := netlink.MarshalAttributes(data)
+		attrs = append(attrs, netlink.Attribute{Type: unix.NLA_F_NESTED | unix.NFTA_OBJ_DATA, Data: nested})
+	}
+	encoded, _ := netlink.MarshalAttributes(attrs)
+
+	flags := netlink.Request | netlink.Acknowledge
+	if t == unix.NFT_MSG_NEWOBJ {
+		flags |= netlink.Create
+	}
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | t),
+			Flags: flags,
+		},
+		Data: append(nfgenHeader(uint8(r.table.Family), 0), encoded...),
+	}
+}
+
+func nfgenHeader(family uint8, resID uint16) []byte {
+	return append([]byte{family, unix.NFNETLINK_V0}, binaryutil.BigEndian.PutUint16(resID)...)
+}
+
+// Get the message creating a quota object matching packets beyond its bytes,
+// or updating the bytes of an existing one, which keeps its consumption.
+func (r *Router) quotaObjectNew(name string, bytes uint64) netlink.Message {
+	return r.quotaObjectMessage(unix.NFT_MSG_NEWOBJ, name, []netlink.Attribute{
+		{Type: unix.NFTA_QUOTA_BYTES, Data: binaryutil.BigEndian.PutUint64(bytes)},
+		{Type: unix.NFTA_QUOTA_FLAGS, Data: binaryutil.BigEndian.PutUint32(unix.NFT_QUOTA_F_INV)},
+	})
+}
+
+// Get the bytes and the consumption of a quota object, resetting the
+// consumption to 0 if reset is set.
+func (r *Router) getQuotaObject(name string, reset bool) (uint64, uint64, error) {
+	conn, err := r.dialNetfilter()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	t := uint16(unix.NFT_MSG_GETOBJ)
+	if reset {
+		t = unix.NFT_MSG_GETOBJ_RESET
+	}
+	replies, err := conn.Execute(r.quotaObjectMessage(t, name, nil))
+	if err != nil {
+		return 0, 0, fmt.Errorf("quota %s: %w", name, err)
+	}
+
+	var bytes, consumed uint64
+	for _, reply := range replies {
+		if len(reply.Data) < 4 {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(reply.Data[4:])
+		if err != nil {
+			return 0, 0, err
+		}
+		ad.ByteOrder = binary.BigEndian
+		for ad.Next() {
+			if ad.Type() != unix.NFTA_OBJ_DATA {
+				continue
+			}
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					switch nad.Type() {
+					case unix.NFTA_QUOTA_BYTES:
+						bytes = nad.Uint64()
+					case unix.NFTA_QUOTA_CONSUMED:
+						consumed = nad.Uint64()
+					}
+				}
+				return nil
+			})
+		}
+		if err := ad.Err(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return bytes, consumed, nil
+}
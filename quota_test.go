@@ -0,0 +1,171 @@
+package yafw
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+func TestPolicyQuota(t *testing.T) {
+	router := newTestRouter()
+
+	guest := &Policy{
+		Source: NewAddressImmediate(parseTestIPRanges("10.0.1.0/24")),
+		Quota:  &Quota{Bytes: 1000000, Period: "day"},
+	}
+	if err := router.PolicyTable().Append(guest); err != nil {
+		t.Fatal(err)
+	}
+
+	compiled, err := router.PolicyTable().Compiled(guest.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the packets accepted are charged, once they pass the policy
+	expected := []string{
+		"meta nfproto ipv4 ip saddr @immediate-1 counter packets 0 bytes 0 ct mark set 0x00000001 jump quota",
+		"meta nfproto ipv4 ip saddr @immediate-1 ct mark 0x00000001 accept",
+	}
+	if len(compiled) != len(expected) {
+		t.Fatalf("test assert error: compiled %v (expecting %v)", compiled, expected)
+	}
+	for i, rule := range compiled {
+		if rule.String() != expected[i] {
+			t.Fatalf("test assert error: compiled %q (expecting %q)", rule.String(), expected[i])
+		}
+	}
+
+	verifications, err := router.VerifyEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, verification := range verifications {
+		if !verification.OK {
+			t.Fatalf("test assert error: %+v does not match the kernel", verification)
+		}
+	}
+
+	// the established connections of the policy are charged in the quota chain
+	ruleset, err := router.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, chain := range ruleset.Chains {
+		if chain.Name != "quota" {
+			continue
+		}
+		for _, rule := range chain.Rules {
+			if rule.Entry == guest.ID && rule.Kind == "policy" &&
+				rule.Text == "ct mark 0x00000001 counter packets 0 bytes 0 drop" {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("test assert error: quota chain missing from %+v", ruleset.Chains)
+	}
+
+	usage, err := router.QuotaTable().Usage(guest.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Bytes != 1000000 || usage.Consumed != 0 || usage.Exhausted || usage.NextReset == nil {
+		t.Fatalf("test assert error: usage %+v of a new quota", usage)
+	}
+
+	// the object is updated in place as the quota changes
+	guest.Quota = &Quota{Bytes: 2000000, Period: "week", Fallback: OverflowAccept}
+	if err := router.PolicyTable().Update(guest, nil); err != nil {
+		t.Fatal(err)
+	}
+	all, err := router.QuotaTable().All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].Object != usage.Object || all[0].Bytes != 2000000 || all[0].NextReset.Weekday() != time.Monday {
+		t.Fatalf("test assert error: usage %+v after update", all)
+	}
+
+	if _, err := router.QuotaTable().Reset(guest.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.QuotaTable().resetDue(time.Now().AddDate(0, 0, 8)); err != nil {
+		t.Fatal(err)
+	}
+	if usage, err = router.QuotaTable().Usage(guest.ID); err != nil || !usage.NextReset.After(time.Now().AddDate(0, 0, 8)) {
+		t.Fatalf("test assert error: usage %+v with %v after the period", usage, err)
+	}
+
+	invalid := &Policy{Quota: &Quota{Bytes: 1000, Fallback: OverflowContinue}}
+	if err := router.PolicyTable().Append(invalid); !errors.Is(err, ErrQuotaInvalid) {
+		t.Fatalf("test assert error: invalid quota appended with %v", err)
+	}
+
+	// the object is deleted along with the policy
+	if err := router.PolicyTable().Remove(guest.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := router.QuotaTable().Usage(guest.ID); err != ErrQuotaNotFound {
+		t.Fatalf("test assert error: usage of a removed policy read with %v", err)
+	}
+	if _, _, err := router.getQuotaObject(usage.Object, false); err == nil {
+		t.Fatalf("test assert error: object %s kept after removal", usage.Object)
+	}
+}
+
+func TestPolicyQuotaTransaction(t *testing.T) {
+	router := newTestRouter()
+	policies := router.PolicyTable()
+
+	// the object of a quota goes with the batch the kernel rejects
+	tx := router.Begin()
+	guest := &Policy{
+		Source: NewAddressImmediate(parseTestIPRanges("10.0.1.0/24")),
+		Quota:  &Quota{Bytes: 1000000},
+	}
+	if err := policies.Append(guest); err != nil {
+		t.Fatal(err)
+	}
+	name := router.QuotaTable().m[guest.ID].name
+	router.nft.DelTable(&nftables.Table{Name: "missing", Family: nftables.TableFamilyINet})
+	if err := tx.Commit(); err == nil {
+		t.Fatalf("test assert error: rejected batch committed")
+	}
+	if _, _, err := router.getQuotaObject(name, false); err == nil {
+		t.Fatalf("test assert error: object %s kept after the rejected batch", name)
+	}
+	assertConsistent(t, router)
+
+	// a quota changed again before its rule is flushed
+	tx = router.Begin()
+	if err := policies.Append(guest); err != nil {
+		t.Fatal(err)
+	}
+	guest.Quota = &Quota{Bytes: 2000000, Fallback: OverflowAccept}
+	if err := policies.Update(guest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := router.QuotaTable().Usage(guest.ID)
+	if err != nil || usage.Bytes != 2000000 {
+		t.Fatalf("test assert error: usage %+v with %v", usage, err)
+	}
+	assertConsistent(t, router)
+
+	ruleset, err := router.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("ct mark 0x%08x counter packets 0 bytes 0 accept", guest.ID)
+	for _, chain := range ruleset.Chains {
+		if chain.Name == "quota" && (len(chain.Rules) != 1 || chain.Rules[0].Text != expected) {
+			t.Fatalf("test assert error: %d rules in the quota chain (expecting %q)", len(chain.Rules), expected)
+		}
+	}
+}
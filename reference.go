@@ -0,0 +1,182 @@
+package yafw
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Kinds of named objects which entries refer to.
+const (
+	ObjectIPSet    = "ipset"
+	ObjectMACSet   = "macset"
+	ObjectZone     = "zone"
+	ObjectSchedule = "schedule"
+)
+
+// A named object referred by entries or other objects.
+type Object struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// Something referring to an object, either an entry of a table (e.g. "policy"
+// with its ID) or another object (e.g. "ipset" with its name).
+type Reference struct {
+	Kind string `json:"kind"`
+	ID   int    `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+func (ref Reference) String() string {
+	if ref.Name != "" {
+		return fmt.Sprintf("%s %s", ref.Kind, ref.Name)
+	}
+	return fmt.Sprintf("%s %d", ref.Kind, ref.ID)
+}
+
+// An index from objects to the entries referring to them, which is kept along
+// with the entries installed into the kernel.
+type ReferenceIndex struct {
+	users   map[Object]map[Reference]bool
+	objects map[Reference][]Object
+}
+
+func NewReferenceIndex() *ReferenceIndex {
+	return &ReferenceIndex{
+		users:   make(map[Object]map[Reference]bool),
+		objects: make(map[Reference][]Object),
+	}
+}
+
+// Replace the objects referred by an entry.
+func (idx *ReferenceIndex) Set(ref Reference, objects []Object) {
+	idx.Remove(ref)
+
+	if len(objects) == 0 {
+		return
+	}
+
+	for _, object := range objects {
+		if idx.users[object] == nil {
+			idx.users[object] = make(map[Reference]bool)
+		}
+		idx.users[object][ref] = true
+	}
+	idx.objects[ref] = objects
+}
+
+// Remove all the references of an entry.
+func (idx *ReferenceIndex) Remove(ref Reference) {
+	for _, object := range idx.objects[ref] {
+		delete(idx.users[object], ref)
+		if len(idx.users[object]) == 0 {
+			delete(idx.users, object)
+		}
+	}
+	delete(idx.objects, ref)
+}
+
+func (idx *ReferenceIndex) clone() *ReferenceIndex {
+	ret := NewReferenceIndex()
+	for ref, objects := range idx.objects {
+		ret.Set(ref, append([]Object(nil), objects...))
+	}
+	return ret
+}
+
+// Point the references to an object to its new name.
+func (idx *ReferenceIndex) Rename(object Object, name string) {
+	renamed := Object{Kind: object.Kind, Name: name}
+	for ref := range idx.users[object] {
+		objects := idx.objects[ref]
+		for i := range objects {
+			if objects[i] == object {
+				objects[i] = renamed
+			}
+		}
+	}
+
+	if users, ok := idx.users[object]; ok {
+		idx.users[renamed] = users
+		delete(idx.users, object)
+	}
+}
+
+// Get the entries referring to an object, ordered by kind and ID.
+func (idx *ReferenceIndex) Users(object Object) []Reference {
+	ret := make([]Reference, 0, len(idx.users[object]))
+	for ref := range idx.users[object] {
+		ret = append(ret, ref)
+	}
+	sortReferences(ret)
+
+	return ret
+}
+
+func sortReferences(refs []Reference) {
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Kind != refs[j].Kind {
+			return refs[i].Kind < refs[j].Kind
+		}
+		if refs[i].ID != refs[j].ID {
+			return refs[i].ID < refs[j].ID
+		}
+		return refs[i].Name < refs[j].Name
+	})
+}
+
+func describeReferences(refs []Reference) string {
+	ret := []string{}
+	for _, ref := range refs {
+		ret = append(ret, ref.String())
+	}
+	return strings.Join(ret, ", ")
+}
+
+// Get the objects an address refers to.
+func addressObjects(addresses ...*Address) []Object {
+	ret := []Object{}
+	for _, address := range addresses {
+		if address != nil && address.Type() == AddressIPSet {
+			ret = append(ret, Object{Kind: ObjectIPSet, Name: address.IPSet})
+		}
+	}
+	return ret
+}
+
+// Get the entries and IPSets referring to an IPSet.
+func (r *Router) IPSetReferences(name string) []Reference {
+	ret := r.refs.Users(Object{Kind: ObjectIPSet, Name: name})
+	for _, ipset := range r.ipsets {
+		if findString(ipset.refs, name) >= 0 {
+			ret = append(ret, Reference{Kind: ObjectIPSet, Name: ipset.name})
+		}
+	}
+	sortReferences(ret)
+
+	return ret
+}
+
+// Get the entries referring to a zone.
+func (r *Router) ZoneReferences(name string) []Reference {
+	return r.refs.Users(Object{Kind: ObjectZone, Name: name})
+}
+
+// Get the entries referring to a schedule.
+func (r *Router) ScheduleReferences(name string) []Reference {
+	return r.refs.Users(Object{Kind: ObjectSchedule, Name: name})
+}
+
+// Remove the entries among refs from their tables, ignoring other objects.
+func (r *Router) removeReferences(refs []Reference) error {
+	for _, ref := range refs {
+		if table := r.entryTable(ref.Kind); table != nil {
+			if err := table.Remove(ref.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package yafw
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUnknownIPSet(t *testing.T) {
+	router := newTestRouter()
+
+	policy := &Policy{Source: NewAddressIPSet("missing")}
+	if err := router.PolicyTable().Append(policy); !errors.Is(err, ErrIPSetNotFound) {
+		t.Fatalf("test assert error: Append = %v (expecting %v)", err, ErrIPSetNotFound)
+	}
+}
+
+func TestIPSetReferences(t *testing.T) {
+	router := newTestRouter()
+
+	for _, name := range []string{"servers", "all"} {
+		ipset := router.NewIPSet(name)
+		ipset.AddIPRange(NewIPRangeString("192.168.233.0/24"))
+		if err := router.UpdateIPSet(ipset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := router.UpdateIPSet(router.FindIPSet("all").AddIPSetRef("servers")); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := &Policy{Destination: NewAddressIPSet("servers")}
+	if err := router.PolicyTable().Append(policy); err != nil {
+		t.Fatal(err)
+	}
+	snat := &SNATRule{Source: NewAddressIPSet("servers")}
+	if err := router.SNATRuleTable().Append(snat); err != nil {
+		t.Fatal(err)
+	}
+
+	refs := router.IPSetReferences("servers")
+	want := []Reference{
+		{Kind: ObjectIPSet, Name: "all"},
+		{Kind: "policy", ID: policy.ID},
+		{Kind: "snat", ID: snat.ID},
+	}
+	if len(refs) != len(want) {
+		t.Fatalf("test assert error: references %v (expecting %v)", refs, want)
+	}
+	for i := range want {
+		if refs[i] != want[i] {
+			t.Fatalf("test assert error: references %v (expecting %v)", refs, want)
+		}
+	}
+
+	if err := router.DeleteIPSet("servers"); !errors.Is(err, ErrIPSetReferred) {
+		t.Fatalf("test assert error: DeleteIPSet = %v (expecting %v)", err, ErrIPSetReferred)
+	}
+
+	// references follow a rename
+	if err := router.RenameIPSet("servers", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if len(router.IPSetReferences("web")) != 3 || len(router.IPSetReferences("servers")) != 0 {
+		t.Fatalf("test assert error: references not renamed")
+	}
+
+	// a removed entry no longer refers to the set
+	if err := router.SNATRuleTable().Remove(snat.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(router.IPSetReferences("web")) != 2 {
+		t.Fatalf("test assert error: references %v", router.IPSetReferences("web"))
+	}
+
+	if err := router.DeleteIPSetCascade("web"); err != nil {
+		t.Fatal(err)
+	}
+	if router.FindIPSet("web") != nil || len(router.Policies()) != 0 ||
+		len(router.FindIPSet("all").Refs()) != 0 {
+		t.Fatalf("test assert error: cascade incomplete")
+	}
+}
+
+func TestZoneReferences(t *testing.T) {
+	router := newTestRouter()
+
+	router.zones.AddZone("trust")
+	if err := router.zones.Update(router.zones.FindZone("trust")); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := &Policy{SourceZone: "trust"}
+	if err := router.PolicyTable().Append(policy); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := router.zones.DeleteZone("trust"); !errors.Is(err, ErrZoneReferred) {
+		t.Fatalf("test assert error: DeleteZone = %v (expecting %v)", err, ErrZoneReferred)
+	}
+	if err := router.zones.DeleteZone("untrust"); !errors.Is(err, ErrZoneNotFound) {
+		t.Fatalf("test assert error: DeleteZone = %v (expecting %v)", err, ErrZoneNotFound)
+	}
+
+	if err := router.zones.DeleteZoneCascade("trust"); err != nil {
+		t.Fatal(err)
+	}
+	if router.zones.FindZone("trust") != nil || len(router.Policies()) != 0 {
+		t.Fatalf("test assert error: cascade incomplete")
+	}
+}
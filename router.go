@@ -3,9 +3,12 @@ package yafw
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"log"
 	"reflect"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
@@ -14,12 +17,23 @@ import (
 	"github.com/vishvananda/netns"
 )
 
+// A Router is not safe for concurrent use by itself. Goroutines sharing a
+// router serialize their access through Lock and Unlock, as the background
+// workers of the router do.
 type Router struct {
+	mu sync.Mutex
+
 	// kernel network interfaces
-	ns  netns.NsHandle
-	nft *nftables.Conn
-	nl  *netlink.Handle
-	ct  *conntrack.Conn
+	ns netns.NsHandle
+	// batches are built by nft and recorded, and the kernel is read through query
+	nft      *nftables.Conn
+	recorder *batchRecorder
+	query    *nftables.Conn
+	nl       *netlink.Handle
+	ct       *conntrack.Conn
+
+	// transaction open, whose changes are flushed once it is committed
+	tx *Transaction
 
 	// main netfilter table
 	table *nftables.Table
@@ -28,13 +42,35 @@ type Router struct {
 	postrouting *nftables.Chain
 	prerouting  *nftables.Chain
 
-	zones  *ZoneTable
-	ipsets map[string]*IPSet
+	zones   *ZoneTable
+	ipsets  map[string]*IPSet
+	macsets map[string]*MACSet
+	fqdns   *FQDNTable
+	geo     *GeoTable
+	feeds   *FeedTable
+	ifaddrs *InterfaceAddressTable
+	refs    *ReferenceIndex
+
+	// shared sets of immediate addresses, by their key and by their name
+	shared        map[string]*sharedSet
+	sharedNames   map[string]*sharedSet
+	sharedCounter int
+	meterCounter  int
+	// dynamic IPSets tracked for entries, by the name of their IPv4 sets
+	tracked map[string]*trackedSet
+	// kernel sets of IPSets and MACSets are numbered, so that they outlive
+	// renames
+	ipsetCounter  int
+	macsetCounter int
+	// shared sets acquired by the artifact being built
+	acquired []*nftables.Set
 	// serviceGroups map[string]*ServiceGroup
 
 	snatEntries   *EntryTable
 	dnatEntries   *EntryTable
 	policyEntries *EntryTable
+	quotas        *QuotaTable
+	schedules     *ScheduleTable
 }
 
 var (
@@ -46,28 +82,77 @@ var (
 // A general entry in nftables chains, which stands for a bunch of rules.
 type Entry interface {
 	buildArtifact(router *Router) error
+	// named objects the entry refers to
+	references() []Object
+	// kernel sets held by the artifact, the shared ones among them are given
+	// back once the entry is updated or removed
+	artifactSets() []*nftables.Set
+	// the artifact built last, which is restored once a transaction is
+	// rolled back
+	artifactState() any
+	restoreArtifact(state any)
 
 	Index() int
 	SetIndex(int)
-	ToRules() []*nftables.Rule
+	// A disabled entry keeps its position, but its rules are not installed.
+	Enabled() bool
+	SetEnabled(bool)
+	ToRules() ([]*nftables.Rule, error)
+}
+
+// An entry whose rules are only installed while it is active, e.g. a policy
+// following a schedule the kernel cannot match.
+type activeEntry interface {
+	active() bool
+}
+
+func entryActive(e Entry) bool {
+	a, ok := e.(activeEntry)
+	return !ok || a.active()
+}
+
+// Get the rules of an entry installed into the kernel, none if it is
+// disabled or inactive.
+func installedRules(e Entry) ([]*nftables.Rule, error) {
+	if !e.Enabled() || !entryActive(e) {
+		return []*nftables.Rule{}, nil
+	}
+	return e.ToRules()
+}
+
+// An entry holding kernel objects other than its rules and sets, which are
+// released once it is removed.
+type artifactReleaser interface {
+	releaseArtifact(router *Router)
 }
 
 type EntryTable struct {
-	r         *Router
+	r *Router
+	// kind of the entries in references, e.g. "policy"
+	kind      string
 	entryType reflect.Type
 	list      []Entry
 	ruleMap   map[int][]*nftables.Rule
 	counter   int
 
+	// counters of the entries, see Counters
+	counters map[int]*entryCounter
+	// interval of sampling the counters by Run
+	SampleInterval time.Duration
+
 	chain *nftables.Chain
 }
 
-func NewEntryTable(router *Router, chain *nftables.Chain, v any) *EntryTable {
+func NewEntryTable(router *Router, kind string, chain *nftables.Chain, v any) *EntryTable {
 	return &EntryTable{
 		r:         router,
+		kind:      kind,
 		chain:     chain,
 		entryType: reflect.TypeOf(v),
 		ruleMap:   make(map[int][]*nftables.Rule),
+
+		counters:       make(map[int]*entryCounter),
+		SampleInterval: 10 * time.Second,
 	}
 }
 
@@ -79,6 +164,16 @@ func (t *EntryTable) All() []Entry {
 	return t.list
 }
 
+// Get the entry of an index, or nil if there is none.
+func (t *EntryTable) Find(index int) Entry {
+	for _, entry := range t.list {
+		if entry.Index() == index {
+			return entry
+		}
+	}
+	return nil
+}
+
 func (t *EntryTable) Append(e Entry) error {
 	return t.Update(e, nil)
 }
@@ -87,127 +182,250 @@ func (t *EntryTable) InsertBefore(e Entry, beforeIndex int) error {
 	return t.Update(e, &beforeIndex)
 }
 
+// Add or update an entry, placing it before another one if beforeIndex is
+// given. An entry updated without beforeIndex keeps its position. The change
+// is committed at once, unless a transaction is open, see Begin.
 func (t *EntryTable) Update(e Entry, beforeIndex *int) error {
 	if reflect.TypeOf(e) != t.entryType {
 		return ErrEntryTypeMismatch
 	}
 
-	update := true
-	if _, ok := t.ruleMap[e.Index()]; !ok {
+	tx := t.r.Begin()
+	if err := t.stageUpdate(e, beforeIndex); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Stage an update in the open transaction. Once it fails, the table is left
+// as it was before.
+func (t *EntryTable) stageUpdate(e Entry, beforeIndex *int) error {
+	tx := t.r.tx
+	change := tx.table(t)
+	list, counter := append([]Entry(nil), t.list...), t.counter
+	index, state := e.Index(), e.artifactState()
+
+	old := t.Find(e.Index())
+	if old == nil {
 		t.counter++
 		e.SetIndex(t.counter)
-		t.ruleMap[e.Index()] = make([]*nftables.Rule, 0)
-
-		update = false
 	}
 
-	if beforeIndex != nil {
-		if _, ok := t.ruleMap[*beforeIndex]; !ok {
-			beforeIndex = nil
-		}
+	if beforeIndex != nil && t.Find(*beforeIndex) == nil {
+		beforeIndex = nil
 	}
 
-	beforeHandle := (*uint64)(nil)
-	if update {
+	// the shared sets of the old artifact, which may be the same entry
+	var oldSets []*nftables.Set
+	if old != nil {
+		oldSets = old.artifactSets()
 		for i, entry := range t.list {
 			if entry.Index() == e.Index() {
-				if i+1 < len(t.list) {
+				if i+1 < len(t.list) && beforeIndex == nil {
 					index := t.list[i+1].Index()
-					if beforeIndex == nil {
-						beforeIndex = &index
-					}
-					handle := t.ruleMap[index][0].Handle
-					beforeHandle = &handle
+					beforeIndex = &index
 				}
 				t.list = append(t.list[:i], t.list[i+1:]...)
 				break
 			}
 		}
 	}
+	t.insert(e, beforeIndex)
+
+	t.r.acquired = nil
+	// disabled entries are built all the same, so that they are checked
+	// and keep their references until they are enabled
+	err := e.buildArtifact(t.r)
+	var rules []*nftables.Rule
+	if err == nil {
+		rules, err = e.ToRules()
+	}
+	if err == nil && (!e.Enabled() || !entryActive(e)) {
+		rules = []*nftables.Rule{}
+	}
+	if err != nil {
+		// shared sets acquired before the failure are given back
+		t.r.releaseSharedSets(t.r.acquired...)
+		t.list, t.counter = list, counter
+		e.SetIndex(index)
+		e.restoreArtifact(state)
+		return err
+	}
 
+	if old != nil {
+		tx.releases = append(tx.releases, func() {
+			t.r.releaseSharedSets(oldSets...)
+		})
+	}
+
+	change.staged[e.Index()] = rules
+	t.r.refs.Set(Reference{Kind: t.kind, ID: e.Index()}, e.references())
+
+	return nil
+}
+
+// Place an entry before another one, or at the end if beforeIndex is nil.
+func (t *EntryTable) insert(e Entry, beforeIndex *int) {
 	if beforeIndex != nil {
 		for i, entry := range t.list {
 			if entry.Index() == *beforeIndex {
-				rule := t.ruleMap[entry.Index()][0]
-				beforeHandle = &rule.Handle
 				t.list = append(t.list[:i+1], t.list[i:]...)
 				t.list[i] = e
-				break
+				return
 			}
 		}
-	} else {
-		t.list = append(t.list, e)
 	}
+	t.list = append(t.list, e)
+}
 
-	err := e.buildArtifact(t.r)
-	if err != nil {
+// Remove an entry. The change is committed at once, unless a transaction is
+// open, see Begin.
+func (t *EntryTable) Remove(index int) error {
+	tx := t.r.Begin()
+	if err := t.stageRemove(index); err != nil {
+		tx.Rollback()
 		return err
 	}
+	return tx.Commit()
+}
 
-	if update {
-		err := t.removeRules(t.ruleMap[e.Index()])
-		if err != nil {
-			return err
+func (t *EntryTable) stageRemove(index int) error {
+	entry := t.Find(index)
+	if entry == nil {
+		return ErrEntryIndexNotFound
+	}
+	tx := t.r.tx
+	change := tx.table(t)
+
+	for i := range t.list {
+		if t.list[i] == entry {
+			t.list = append(t.list[:i], t.list[i+1:]...)
+			break
+		}
+	}
+
+	delete(change.staged, index)
+	change.removed[index] = true
+	tx.release(entry)
+	if releaser, ok := entry.(artifactReleaser); ok {
+		tx.releases = append(tx.releases, func() {
+			releaser.releaseArtifact(t.r)
+		})
+	}
+	t.r.refs.Remove(Reference{Kind: t.kind, ID: index})
+
+	return nil
+}
+
+// Enable or disable entries, which keep their positions and indexes. The
+// rules of entries enabled are installed in place again. The change is
+// committed at once, unless a transaction is open, see Begin.
+func (t *EntryTable) SetEnabled(enabled bool, indexes ...int) error {
+	for _, index := range indexes {
+		if t.Find(index) == nil {
+			return fmt.Errorf("%w: %d", ErrEntryIndexNotFound, index)
 		}
 	}
 
-	t.addRules(e.Index(), beforeHandle, e.ToRules())
-	if err := t.r.Update(); err != nil {
+	tx := t.r.Begin()
+	if err := t.stageEnabled(enabled, indexes); err != nil {
+		tx.Rollback()
 		return err
 	}
-	rules, err := t.findRulesByTag(e.Index())
+	return tx.Commit()
+}
+
+func (t *EntryTable) stageEnabled(enabled bool, indexes []int) error {
+	change := t.r.tx.table(t)
+
+	staged := make(map[int][]*nftables.Rule, len(indexes))
+	for _, index := range indexes {
+		entry := t.Find(index)
+		if entry.Enabled() == enabled {
+			continue
+		}
+		rules := []*nftables.Rule{}
+		if enabled && entryActive(entry) {
+			var err error
+			if rules, err = entry.ToRules(); err != nil {
+				return err
+			}
+		}
+		staged[index] = rules
+	}
+
+	for index, rules := range staged {
+		t.Find(index).SetEnabled(enabled)
+		change.staged[index] = rules
+	}
+
+	return nil
+}
+
+// Stage the rules of an entry to be installed again, e.g. once the schedule
+// of a policy changes.
+func (t *EntryTable) stageReinstall(index int) error {
+	entry := t.Find(index)
+	if entry == nil {
+		return fmt.Errorf("%w: %d", ErrEntryIndexNotFound, index)
+	}
+	rules, err := installedRules(entry)
 	if err != nil {
 		return err
 	}
-	t.ruleMap[e.Index()] = rules
+	t.r.tx.table(t).staged[index] = rules
 
 	return nil
 }
 
-func (t *EntryTable) Remove(index int) error {
-	if t.ruleMap[index] != nil {
-		{
-			if err := t.removeRules(t.ruleMap[index]); err != nil {
-				return err
-			}
-			if err := t.r.Update(); err != nil {
-				return err
-			}
-
-			t.ruleMap[index] = nil
+// Get the handle of the first kernel rule placed after the entry at position
+// i, skipping entries that are compiled to no rules and those whose rules
+// are staged, see commitRules. It returns nil if there is none.
+func (t *EntryTable) handleAfter(i int, staged map[int][]*nftables.Rule) *uint64 {
+	for _, entry := range t.list[i+1:] {
+		if _, ok := staged[entry.Index()]; ok {
+			continue
 		}
-
-		for i, entry := range t.list {
-			if entry.Index() == index {
-				t.list = append(t.list[:i], t.list[i+1:]...)
-				break
-			}
+		if rules := t.ruleMap[entry.Index()]; len(rules) > 0 {
+			handle := rules[0].Handle
+			return &handle
 		}
-	} else {
-		return ErrEntryIndexNotFound
 	}
 
 	return nil
 }
 
-func (t *EntryTable) findRulesByTag(tag int) ([]*nftables.Rule, error) {
+// Get the kernel rules of the table by the entries they are tagged with.
+func (t *EntryTable) rulesByTag() (map[int][]*nftables.Rule, error) {
 	r := t.r
 
-	allRules, err := r.nft.GetRules(r.table, t.chain)
+	allRules, err := r.query.GetRules(r.table, t.chain)
 	if err != nil {
 		return nil, err
 	}
 
-	ret := make([]*nftables.Rule, 0)
+	ret := make(map[int][]*nftables.Rule)
 	for _, rule := range allRules {
-		if len(rule.UserData) == 8 && binary.BigEndian.Uint64(rule.UserData) == uint64(tag) {
-			ret = append(ret, rule)
+		if id, ok := ruleTag(rule); ok {
+			ret[id] = append(ret[id], rule)
 		}
 	}
 
 	return ret, nil
 }
 
+func (t *EntryTable) findRulesByTag(tag int) ([]*nftables.Rule, error) {
+	rules, err := t.rulesByTag()
+	if err != nil {
+		return nil, err
+	}
+	if rules[tag] == nil {
+		return make([]*nftables.Rule, 0), nil
+	}
+	return rules[tag], nil
+}
+
 func (t *EntryTable) addRules(tag int, beforeHandle *uint64, rules []*nftables.Rule) {
 	r := t.r
 
@@ -248,7 +466,7 @@ func InterfaceName(str string) []byte {
 }
 
 func (r *Router) initNftables() {
-	tables, _ := r.nft.ListTables()
+	tables, _ := r.query.ListTables()
 	for _, table := range tables {
 		if table.Name == "yafw" {
 			r.nft.FlushTable(table)
@@ -262,7 +480,7 @@ func (r *Router) initNftables() {
 	}
 	r.table = r.nft.AddTable(&nftables.Table{
 		Name:   "yafw",
-		Family: nftables.TableFamilyIPv4,
+		Family: nftables.TableFamilyINet,
 	})
 
 	table := r.table
@@ -310,7 +528,7 @@ func (r *Router) initNftables() {
 }
 
 func NewRouterNS(ns netns.NsHandle) (*Router, error) {
-	nft, err := nftables.New(nftables.WithNetNSFd(int(ns)))
+	query, err := nftables.New(nftables.WithNetNSFd(int(ns)))
 
 	if err != nil {
 		return nil, err
@@ -328,19 +546,33 @@ func NewRouterNS(ns netns.NsHandle) (*Router, error) {
 	}
 
 	ret := &Router{
-		ns:     ns,
-		nft:    nft,
-		nl:     nl,
-		ct:     ct,
-		ipsets: make(map[string]*IPSet),
+		ns:       ns,
+		recorder: &batchRecorder{},
+		query:    query,
+		nl:       nl,
+		ct:       ct,
+		ipsets:   make(map[string]*IPSet),
+		macsets:  make(map[string]*MACSet),
+		refs:     NewReferenceIndex(),
+
+		shared:      make(map[string]*sharedSet),
+		sharedNames: make(map[string]*sharedSet),
+		tracked:     make(map[string]*trackedSet),
 	}
 
+	ret.nft = newBatchConn(ret.recorder)
 	ret.initNftables()
 
-	ret.snatEntries = NewEntryTable(ret, ret.postrouting, &SNATRule{})
-	ret.dnatEntries = NewEntryTable(ret, ret.prerouting, &DNATRule{})
-	ret.policyEntries = NewEntryTable(ret, ret.forward, &Policy{})
+	ret.snatEntries = NewEntryTable(ret, "snat", ret.postrouting, &SNATRule{})
+	ret.dnatEntries = NewEntryTable(ret, "dnat", ret.prerouting, &DNATRule{})
+	ret.policyEntries = NewEntryTable(ret, "policy", ret.forward, &Policy{})
+	ret.quotas = NewQuotaTable(ret)
+	ret.schedules = NewScheduleTable(ret)
 	ret.zones = NewZoneTable(ret)
+	ret.fqdns = NewFQDNTable(ret)
+	ret.geo = NewGeoTable(ret)
+	ret.feeds = NewFeedTable(ret)
+	ret.ifaddrs = NewInterfaceAddressTable(ret)
 
 	return ret, nil
 }
@@ -356,21 +588,76 @@ func NewRouter() (*Router, error) {
 }
 
 func (r *Router) Stop() {
-	sets, _ := r.nft.GetSets(r.table)
+	sets, _ := r.query.GetSets(r.table)
 	r.nft.FlushTable(r.table)
 	for _, set := range sets {
 		r.nft.DelSet(set)
 	}
 }
 
+// Flush the pending batch to the kernel. While a transaction is open, the
+// batch is kept until it is committed.
 func (r *Router) Update() error {
+	if r.tx != nil {
+		return nil
+	}
+	return r.flush()
+}
+
+func (r *Router) flush() error {
+	if r.quotas != nil {
+		if err := r.quotas.beforeFlush(); err != nil {
+			return err
+		}
+	}
 	if err := r.nft.Flush(); err != nil {
 		return err
 	}
+	batch := r.recorder.take()
+	if r.quotas != nil {
+		batch = r.quotas.addObjects(batch)
+	}
+	if len(batch) > 0 {
+		if err := r.sendBatch(batch); err != nil {
+			return err
+		}
+	}
+
+	if r.quotas != nil {
+		return r.quotas.afterFlush()
+	}
+	return nil
+}
+
+// Drop the pending batch without sending it, along with the serialization
+// error kept by the connection.
+func (r *Router) discardPending() {
+	r.recorder.take()
+	r.nft = newBatchConn(r.recorder)
+}
+
+func (r *Router) Lock() {
+	r.mu.Lock()
+}
+
+func (r *Router) Unlock() {
+	r.mu.Unlock()
+}
 
+// Get the entry table of a kind, or nil if there is none.
+func (r *Router) entryTable(kind string) *EntryTable {
+	for _, table := range []*EntryTable{r.snatEntries, r.dnatEntries, r.policyEntries} {
+		if table.kind == kind {
+			return table
+		}
+	}
 	return nil
 }
 
+func (r *Router) ZoneTable() *ZoneTable {
+	return r.zones
+}
+
 func (r *Router) SNATRuleTable() *EntryTable {
 	return r.snatEntries
 }
@@ -378,3 +665,27 @@ func (r *Router) SNATRuleTable() *EntryTable {
 func (r *Router) PolicyTable() *EntryTable {
 	return r.policyEntries
 }
+
+func (r *Router) QuotaTable() *QuotaTable {
+	return r.quotas
+}
+
+func (r *Router) ScheduleTable() *ScheduleTable {
+	return r.schedules
+}
+
+func (r *Router) FQDNTable() *FQDNTable {
+	return r.fqdns
+}
+
+func (r *Router) GeoTable() *GeoTable {
+	return r.geo
+}
+
+func (r *Router) FeedTable() *FeedTable {
+	return r.feeds
+}
+
+func (r *Router) InterfaceAddressTable() *InterfaceAddressTable {
+	return r.ifaddrs
+}
@@ -1,10 +1,27 @@
 package yafw
 
 import (
+	"encoding/json"
+	"errors"
+	"runtime"
+	"testing"
+
 	"github.com/vishvananda/netns"
 )
 
 func newTestRouter() *Router {
+	// creating a namespace switches the current thread into it, so the
+	// original one is restored afterwards to keep other tests unaffected
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		panic(err)
+	}
+	defer origin.Close()
+	defer netns.Set(origin)
+
 	_ = netns.DeleteNamed("yafw-ns")
 	ns, err := netns.NewNamed("yafw-ns")
 
@@ -20,3 +37,84 @@ func newTestRouter() *Router {
 
 	return router
 }
+
+func TestEntryEnabled(t *testing.T) {
+	router := newTestRouter()
+	policies := router.PolicyTable()
+
+	ids := []int{}
+	for _, source := range []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24"} {
+		policy := &Policy{Source: NewAddressImmediate(parseTestIPRanges(source))}
+		if err := policies.Append(policy); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, policy.ID)
+	}
+
+	// disabled entries keep their positions without kernel rules
+	if err := policies.SetEnabled(false, ids[0], ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if kernel := kernelEntryOrder(t, policies); len(kernel) != 1 || kernel[0] != ids[2] {
+		t.Fatalf("test assert error: entries in the kernel as %v after disabling", kernel)
+	}
+	if list := entryOrder(policies); len(list) != 3 || list[0] != ids[0] || policies.Find(ids[0]).Enabled() {
+		t.Fatalf("test assert error: entries %v after disabling", list)
+	}
+	assertConsistent(t, router)
+
+	// and are installed in place once enabled
+	if err := policies.SetEnabled(true, ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if kernel := kernelEntryOrder(t, policies); len(kernel) != 2 || kernel[0] != ids[1] {
+		t.Fatalf("test assert error: entries in the kernel as %v after enabling", kernel)
+	}
+
+	// a disabled entry is updated and moved without being installed
+	disabled := &Policy{Destination: NewAddressImmediate(parseTestIPRanges("10.0.3.0/24")), Disabled: true}
+	if err := policies.InsertBefore(disabled, ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := policies.MoveToBottom(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := policies.SetEnabled(true, ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	assertEntryOrder(t, policies, ids[1], ids[2], ids[0])
+	if list := entryOrder(policies); len(list) != 4 || list[0] != disabled.ID {
+		t.Fatalf("test assert error: entries %v with a disabled one", list)
+	}
+	assertConsistent(t, router)
+
+	// the rollback of a transaction restores the states
+	tx := router.Begin()
+	if err := policies.SetEnabled(false, ids[0], ids[1], ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	assertEntryOrder(t, policies, ids[1], ids[2], ids[0])
+	if !policies.Find(ids[0]).Enabled() || policies.Find(disabled.ID).Enabled() {
+		t.Fatalf("test assert error: states not restored by the rollback")
+	}
+
+	// rules are enabled unless the field says otherwise
+	snat := &SNATRule{Source: NewAddressImmediate(parseTestIPRanges("10.0.0.0/24"))}
+	if err := json.Unmarshal([]byte(`{"enabled":false}`), snat); err != nil {
+		t.Fatal(err)
+	}
+	if snat.Enabled() || !(&SNATRule{}).Enabled() {
+		t.Fatalf("test assert error: enabled field not honored")
+	}
+	if err := router.SNATRuleTable().Append(snat); err != nil {
+		t.Fatal(err)
+	}
+	if kernel := kernelEntryOrder(t, router.SNATRuleTable()); len(kernel) != 0 {
+		t.Fatalf("test assert error: disabled snat rule in the kernel as %v", kernel)
+	}
+
+	if err := policies.SetEnabled(true, 100); !errors.Is(err, ErrEntryIndexNotFound) {
+		t.Fatalf("test assert error: missing entry enabled with %v", err)
+	}
+}
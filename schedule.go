@@ -0,0 +1,542 @@
+package yafw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+var (
+	ErrScheduleInvalid  = errors.New("invalid schedule")
+	ErrScheduleNotFound = errors.New("schedule not found")
+	ErrScheduleReferred = errors.New("schedule is referred")
+)
+
+const (
+	secondsPerDay  = 24 * 60 * 60
+	secondsPerWeek = 7 * secondsPerDay
+)
+
+// Layouts of the times of schedules, which are in their time zones.
+const (
+	clockLayout = "15:04"
+	dateLayout  = "2006-01-02 15:04"
+)
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// A Schedule is a named set of times when the policies referring to it are
+// active, any of its weekly windows or one-off ranges. As policies only see
+// the packets of new connections, those accepted while a policy is active
+// are kept once it is not.
+type Schedule struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// IANA time zone of the windows and the ranges, e.g. "Europe/Berlin", or
+	// local time if empty
+	TimeZone string `json:"time_zone"`
+
+	Weekly []*WeeklyWindow `json:"weekly"`
+	Ranges []*DateRange    `json:"ranges"`
+}
+
+// The hours of a day repeated on days of the week, e.g. from "18:00" to
+// "22:00" on "mon" to "fri". A window ending at or before its start runs past
+// midnight into the following day.
+type WeeklyWindow struct {
+	// "sun" to "sat", or every day if empty
+	Days  []string `json:"days"`
+	Start string   `json:"start"`
+	// "24:00" ends a window at midnight
+	End string `json:"end"`
+}
+
+// A one-off range of time, from "2006-01-02 15:04" up to the end excluded.
+type DateRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// A span of a week in seconds, starting from Sunday midnight.
+type weekSpan struct {
+	start  int
+	length int
+}
+
+// Parse a time of the day into the seconds since midnight.
+func parseClock(text string) (int, error) {
+	if text == "24:00" {
+		return secondsPerDay, nil
+	}
+	t, err := time.Parse(clockLayout, text)
+	if err != nil {
+		return 0, fmt.Errorf("%w: time of day %q", ErrScheduleInvalid, text)
+	}
+	return t.Hour()*3600 + t.Minute()*60, nil
+}
+
+func (w *WeeklyWindow) spans() ([]weekSpan, error) {
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return nil, err
+	}
+	if start == secondsPerDay {
+		return nil, fmt.Errorf("%w: window starting at %s", ErrScheduleInvalid, w.Start)
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return nil, err
+	}
+	length := end - start
+	if length <= 0 {
+		length += secondsPerDay
+	}
+
+	days := w.Days
+	if len(days) == 0 {
+		days = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+	}
+	ret := []weekSpan{}
+	for _, name := range days {
+		day, ok := weekdayNames[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("%w: day %q", ErrScheduleInvalid, name)
+		}
+		ret = append(ret, weekSpan{start: int(day)*secondsPerDay + start, length: length})
+	}
+
+	return ret, nil
+}
+
+func (d *DateRange) parse(loc *time.Location) ([2]time.Time, error) {
+	start, err := time.ParseInLocation(dateLayout, d.Start, loc)
+	if err != nil {
+		return [2]time.Time{}, fmt.Errorf("%w: date %q", ErrScheduleInvalid, d.Start)
+	}
+	end, err := time.ParseInLocation(dateLayout, d.End, loc)
+	if err != nil {
+		return [2]time.Time{}, fmt.Errorf("%w: date %q", ErrScheduleInvalid, d.End)
+	}
+	if !end.After(start) {
+		return [2]time.Time{}, fmt.Errorf("%w: range from %s to %s", ErrScheduleInvalid, d.Start, d.End)
+	}
+	return [2]time.Time{start, end}, nil
+}
+
+func (s *Schedule) Validate() error {
+	_, err := parseSchedule(s)
+	return err
+}
+
+// A match of the time packets are seen at, as the kernel tells it. Each part
+// is only matched if it is set.
+type timeMatch struct {
+	days           bool
+	dayMin, dayMax time.Weekday
+	// seconds since midnight in UTC, both included
+	hours            bool
+	hourMin, hourMax uint32
+	span             bool
+	from, to         time.Time
+}
+
+func (m *timeMatch) match(builder *ExprBuilder) {
+	if m == nil {
+		return
+	}
+	if m.days {
+		builder.MatchWeekday(m.dayMin, m.dayMax)
+	}
+	if m.hours {
+		builder.MatchHour(m.hourMin, m.hourMax)
+	}
+	if m.span {
+		builder.MatchTime(m.from, m.to)
+	}
+}
+
+// A schedule with its times parsed, which the artifacts of the policies
+// referring to it point to.
+type scheduleState struct {
+	schedule *Schedule
+	loc      *time.Location
+	spans    []weekSpan
+	ranges   [][2]time.Time
+
+	// whether the kernel matches the times, see ScheduleTable.InKernel
+	inKernel bool
+	// matches of the kernel, compiled with the UTC offset the time zone has
+	// at the time, and leaving out the ranges ended by then
+	offset  int
+	matches []*timeMatch
+	// whether the schedule is active, which the policies toggled by
+	// ScheduleTable.Run follow
+	active bool
+}
+
+func parseSchedule(s *Schedule) (*scheduleState, error) {
+	if s.Name == "" {
+		return nil, fmt.Errorf("%w: no name", ErrScheduleInvalid)
+	}
+
+	loc := time.Local
+	if s.TimeZone != "" {
+		var err error
+		if loc, err = time.LoadLocation(s.TimeZone); err != nil {
+			return nil, fmt.Errorf("%w: time zone %q", ErrScheduleInvalid, s.TimeZone)
+		}
+	}
+
+	state := &scheduleState{schedule: s, loc: loc}
+	for _, window := range s.Weekly {
+		spans, err := window.spans()
+		if err != nil {
+			return nil, err
+		}
+		state.spans = append(state.spans, spans...)
+	}
+	for _, r := range s.Ranges {
+		times, err := r.parse(loc)
+		if err != nil {
+			return nil, err
+		}
+		state.ranges = append(state.ranges, times)
+	}
+	if len(state.spans) == 0 && len(state.ranges) == 0 {
+		return nil, fmt.Errorf("%w: no windows or ranges", ErrScheduleInvalid)
+	}
+
+	return state, nil
+}
+
+func (state *scheduleState) activeAt(now time.Time) bool {
+	local := now.In(state.loc)
+	at := int(local.Weekday())*secondsPerDay + local.Hour()*3600 + local.Minute()*60 + local.Second()
+	for _, span := range state.spans {
+		// spans may run past the end of the week
+		if (at-span.start+secondsPerWeek)%secondsPerWeek < span.length {
+			return true
+		}
+	}
+	for _, r := range state.ranges {
+		if !now.Before(r[0]) && now.Before(r[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compile the matches of the kernel at a time. The spans are moved to UTC
+// and cut at midnight there, and the days with the same hours are matched
+// together.
+func (state *scheduleState) compile(now time.Time) {
+	_, offset := now.In(state.loc).Zone()
+	state.offset = offset
+	state.active = state.activeAt(now)
+	state.matches = nil
+
+	days := make(map[[2]int]*[7]bool)
+	for _, span := range state.spans {
+		at := ((span.start-offset)%secondsPerWeek + secondsPerWeek) % secondsPerWeek
+		for left := span.length; left > 0; {
+			from := at % secondsPerDay
+			to := from + left
+			if to > secondsPerDay {
+				to = secondsPerDay
+			}
+			hours := [2]int{from, to}
+			if days[hours] == nil {
+				days[hours] = &[7]bool{}
+			}
+			days[hours][at/secondsPerDay] = true
+			left -= to - from
+			at = (at + to - from) % secondsPerWeek
+		}
+	}
+
+	hours := make([][2]int, 0, len(days))
+	for key := range days {
+		hours = append(hours, key)
+	}
+	sort.Slice(hours, func(i, j int) bool {
+		if hours[i][0] != hours[j][0] {
+			return hours[i][0] < hours[j][0]
+		}
+		return hours[i][1] < hours[j][1]
+	})
+	for _, key := range hours {
+		for day := 0; day < 7; {
+			if !days[key][day] {
+				day++
+				continue
+			}
+			first := day
+			for day < 7 && days[key][day] {
+				day++
+			}
+
+			m := &timeMatch{}
+			if first != 0 || day != 7 {
+				m.days, m.dayMin, m.dayMax = true, time.Weekday(first), time.Weekday(day-1)
+			}
+			if key != [2]int{0, secondsPerDay} {
+				m.hours, m.hourMin, m.hourMax = true, uint32(key[0]), uint32(key[1]-1)
+			}
+			state.matches = append(state.matches, m)
+		}
+	}
+
+	for _, r := range state.ranges {
+		if r[1].After(now) {
+			state.matches = append(state.matches, &timeMatch{span: true, from: r[0], to: r[1].Add(-time.Nanosecond)})
+		}
+	}
+}
+
+// Whether the matches are out of date at a time, as the UTC offset of the
+// time zone changes or a range ends.
+func (state *scheduleState) stale(now time.Time) bool {
+	if _, offset := now.In(state.loc).Zone(); offset != state.offset {
+		return true
+	}
+	for _, m := range state.matches {
+		if m.span && m.to.Before(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// The state of a schedule, see ScheduleTable.All.
+type ScheduleStatus struct {
+	*Schedule
+	Active bool `json:"active"`
+	// the kernel matches the times, rather than Run toggling the rules
+	InKernel bool `json:"in_kernel"`
+}
+
+type ScheduleTable struct {
+	r *Router
+	m map[string]*scheduleState
+
+	// Whether the kernel matches the time of packets, which needs Linux 5.4
+	// or later. Otherwise the rules of the policies are installed and
+	// deleted by Run as their schedules begin and end. It is probed by
+	// NewScheduleTable, and is changed before any schedule is added.
+	InKernel bool
+	// interval of checking the schedules by Run
+	PollInterval time.Duration
+}
+
+func NewScheduleTable(r *Router) *ScheduleTable {
+	return &ScheduleTable{
+		r:            r,
+		m:            make(map[string]*scheduleState),
+		InKernel:     r.probeTimeMatch(),
+		PollInterval: 10 * time.Second,
+	}
+}
+
+// Check whether the kernel matches the time of packets, by adding such a rule
+// to a chain of its own, which is deleted right away.
+func (r *Router) probeTimeMatch() bool {
+	chain := r.nft.AddChain(&nftables.Chain{
+		Name:  "probe-time",
+		Table: r.table,
+	})
+	r.nft.AddRule(&nftables.Rule{
+		Table: r.table,
+		Chain: chain,
+		Exprs: (&ExprBuilder{}).MatchHour(0, 0).Exprs(),
+	})
+	if err := r.Update(); err != nil {
+		return false
+	}
+
+	r.nft.FlushChain(chain)
+	r.nft.DelChain(chain)
+	if err := r.Update(); err != nil {
+		log.Printf("update error: %v", err)
+	}
+	return true
+}
+
+// Add a schedule, or replace the one of the same name. The rules of the
+// policies referring to it are installed again at once, unless a transaction
+// is open, see Begin, which restores the schedule once it is rolled back.
+func (t *ScheduleTable) Update(s *Schedule) error {
+	state, err := parseSchedule(s)
+	if err != nil {
+		return err
+	}
+	state.inKernel = t.InKernel
+	state.compile(time.Now())
+
+	tx := t.r.Begin()
+	old, ok := t.m[s.Name]
+	if !ok {
+		t.m[s.Name] = state
+		return tx.Commit()
+	}
+
+	// the artifacts of the policies point to the old state, which is
+	// replaced in place
+	previous := *old
+	*old = *state
+	if err := t.stage([]*scheduleState{old}); err != nil {
+		tx.Rollback()
+		if tx.joined {
+			// left to the open transaction, whose rules staged so far follow
+			// the old state again
+			*old = previous
+			_ = t.stage([]*scheduleState{old})
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get a schedule by its name, or nil if there is none.
+func (t *ScheduleTable) Find(name string) *Schedule {
+	if state, ok := t.m[name]; ok {
+		return state.schedule
+	}
+	return nil
+}
+
+func (t *ScheduleTable) state(name string) (*scheduleState, error) {
+	state, ok := t.m[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrScheduleNotFound, name)
+	}
+	return state, nil
+}
+
+// Get the states of all schedules ordered by name.
+func (t *ScheduleTable) All() []*ScheduleStatus {
+	ret := []*ScheduleStatus{}
+	for _, state := range t.m {
+		ret = append(ret, &ScheduleStatus{
+			Schedule: state.schedule,
+			Active:   state.activeAt(time.Now()),
+			InKernel: state.inKernel,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// Delete a schedule. It is refused while policies still refer to it, see
+// DeleteCascade.
+func (t *ScheduleTable) Delete(name string) error {
+	if _, ok := t.m[name]; !ok {
+		return ErrScheduleNotFound
+	}
+	if refs := t.r.ScheduleReferences(name); len(refs) > 0 {
+		return fmt.Errorf("%w: used by %s", ErrScheduleReferred, describeReferences(refs))
+	}
+
+	delete(t.m, name)
+
+	return nil
+}
+
+// Delete a schedule, removing the policies referring to it first.
+func (t *ScheduleTable) DeleteCascade(name string) error {
+	if _, ok := t.m[name]; !ok {
+		return ErrScheduleNotFound
+	}
+
+	if err := t.r.removeReferences(t.r.ScheduleReferences(name)); err != nil {
+		return err
+	}
+
+	return t.Delete(name)
+}
+
+// Install the rules of the entries referring to schedules again.
+func (t *ScheduleTable) reinstall(states []*scheduleState) error {
+	if len(states) == 0 {
+		return nil
+	}
+
+	tx := t.r.Begin()
+	if err := t.stage(states); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Stage the rules of the entries referring to schedules into the open
+// transaction.
+func (t *ScheduleTable) stage(states []*scheduleState) error {
+	for _, state := range states {
+		for _, ref := range t.r.ScheduleReferences(state.schedule.Name) {
+			table := t.r.entryTable(ref.Kind)
+			if table == nil {
+				continue
+			}
+			if err := table.stageReinstall(ref.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Compile the schedules matched by the kernel again once they are stale, and
+// toggle the rules of the others as they begin or end.
+func (t *ScheduleTable) refresh(now time.Time) error {
+	changed := []*scheduleState{}
+	previous := make(map[*scheduleState]scheduleState)
+	for _, state := range t.m {
+		if state.inKernel && !state.stale(now) || !state.inKernel && state.activeAt(now) == state.active {
+			continue
+		}
+		previous[state] = *state
+		state.compile(now)
+		changed = append(changed, state)
+	}
+
+	if err := t.reinstall(changed); err != nil {
+		for state, p := range previous {
+			*state = p
+		}
+		return err
+	}
+	return nil
+}
+
+// Follow the schedules as time goes by, until ctx is done.
+func (t *ScheduleTable) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		t.r.Lock()
+		// a failed refresh is tried again on the next tick
+		_ = t.refresh(time.Now())
+		t.r.Unlock()
+	}
+}
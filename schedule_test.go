@@ -0,0 +1,227 @@
+package yafw
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+func TestScheduleCompile(t *testing.T) {
+	evenings := &Schedule{
+		Name:     "evenings",
+		TimeZone: "Europe/Berlin",
+		Weekly:   []*WeeklyWindow{{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "18:00", End: "22:00"}},
+	}
+	state, err := parseSchedule(evenings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the kernel matches the hours in UTC, which move along with daylight
+	// saving time
+	winter := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	state.compile(winter)
+	if len(state.matches) != 1 || *state.matches[0] != (timeMatch{
+		days: true, dayMin: time.Monday, dayMax: time.Friday,
+		hours: true, hourMin: 17 * 3600, hourMax: 21*3600 - 1,
+	}) {
+		t.Fatalf("test assert error: matches %+v in winter", state.matches[0])
+	}
+	summer := time.Date(2024, 7, 15, 12, 0, 0, 0, time.UTC)
+	if !state.stale(summer) {
+		t.Fatalf("test assert error: matches of winter kept in summer")
+	}
+	state.compile(summer)
+	if len(state.matches) != 1 || state.matches[0].hourMin != 16*3600 {
+		t.Fatalf("test assert error: matches %+v in summer", state.matches[0])
+	}
+	if !state.activeAt(time.Date(2024, 7, 15, 17, 30, 0, 0, time.UTC)) || state.activeAt(time.Date(2024, 7, 13, 17, 30, 0, 0, time.UTC)) {
+		t.Fatalf("test assert error: wrong activity on a monday or a saturday evening")
+	}
+
+	// a window is cut at midnight in UTC, moving part of it to the day before
+	mornings, err := parseSchedule(&Schedule{
+		Name:     "mornings",
+		TimeZone: "Asia/Tokyo",
+		Weekly:   []*WeeklyWindow{{Days: []string{"mon"}, Start: "08:00", End: "10:00"}},
+		Ranges:   []*DateRange{{Start: "2024-12-24 18:00", End: "2024-12-26 00:00"}, {Start: "2000-01-01 00:00", End: "2000-01-02 00:00"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mornings.compile(winter)
+	expected := []timeMatch{
+		{days: true, dayMin: time.Monday, dayMax: time.Monday, hours: true, hourMin: 0, hourMax: 3600 - 1},
+		{days: true, dayMin: time.Sunday, dayMax: time.Sunday, hours: true, hourMin: 23 * 3600, hourMax: 24*3600 - 1},
+		{span: true, from: time.Date(2024, 12, 24, 9, 0, 0, 0, time.UTC), to: time.Date(2024, 12, 25, 15, 0, 0, 0, time.UTC).Add(-time.Nanosecond)},
+	}
+	if len(mornings.matches) != len(expected) {
+		t.Fatalf("test assert error: matches %d (expecting %d)", len(mornings.matches), len(expected))
+	}
+	for i, m := range mornings.matches {
+		if !m.from.Equal(expected[i].from) || !m.to.Equal(expected[i].to) {
+			t.Fatalf("test assert error: match %+v (expecting %+v)", m, expected[i])
+		}
+		m.from, m.to = expected[i].from, expected[i].to
+		if *m != expected[i] {
+			t.Fatalf("test assert error: match %+v (expecting %+v)", m, expected[i])
+		}
+	}
+
+	for _, invalid := range []*Schedule{
+		{Name: "empty"},
+		{Name: "zone", TimeZone: "Nowhere/Land", Weekly: []*WeeklyWindow{{Start: "08:00", End: "10:00"}}},
+		{Name: "day", Weekly: []*WeeklyWindow{{Days: []string{"someday"}, Start: "08:00", End: "10:00"}}},
+		{Name: "range", Ranges: []*DateRange{{Start: "2024-12-26 00:00", End: "2024-12-24 00:00"}}},
+	} {
+		if err := invalid.Validate(); !errors.Is(err, ErrScheduleInvalid) {
+			t.Fatalf("test assert error: schedule %q validated with %v", invalid.Name, err)
+		}
+	}
+}
+
+func TestPolicySchedule(t *testing.T) {
+	router := newTestRouter()
+	schedules := router.ScheduleTable()
+	if !schedules.InKernel {
+		t.Fatalf("test assert error: time matches not supported by the kernel")
+	}
+
+	evenings := &Schedule{
+		Name:     "evenings",
+		TimeZone: "UTC",
+		Weekly:   []*WeeklyWindow{{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "18:00", End: "22:00"}},
+	}
+	if err := schedules.Update(evenings); err != nil {
+		t.Fatal(err)
+	}
+
+	gaming := &Policy{
+		Source:   NewAddressImmediate(parseTestIPRanges("10.0.1.0/24")),
+		Schedule: "evenings",
+	}
+	if err := router.PolicyTable().Append(gaming); err != nil {
+		t.Fatal(err)
+	}
+	compiled, err := router.PolicyTable().Compiled(gaming.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `meta nfproto ipv4 ip saddr @immediate-1 meta day "Monday"-"Friday" meta hour "18:00"-"21:59:59" counter packets 0 bytes 0 accept`
+	if len(compiled) != 1 || compiled[0].String() != expected {
+		t.Fatalf("test assert error: compiled %v (expecting %q)", compiled, expected)
+	}
+
+	// the rules are installed again as the schedule changes
+	evenings.Weekly = append(evenings.Weekly, &WeeklyWindow{Days: []string{"sat", "sun"}, Start: "10:00", End: "24:00"})
+	if err := schedules.Update(evenings); err != nil {
+		t.Fatal(err)
+	}
+	if kernel := kernelEntryOrder(t, router.PolicyTable()); len(kernel) != 1 {
+		t.Fatalf("test assert error: entries in the kernel as %v", kernel)
+	}
+	if rules, err := router.PolicyTable().findRulesByTag(gaming.ID); err != nil || len(rules) != 3 {
+		t.Fatalf("test assert error: %d rules with %v after update", len(rules), err)
+	}
+	assertConsistent(t, router)
+
+	if err := schedules.Delete("evenings"); !errors.Is(err, ErrScheduleReferred) {
+		t.Fatalf("test assert error: referred schedule deleted with %v", err)
+	}
+	if err := router.PolicyTable().Append(&Policy{Schedule: "never"}); !errors.Is(err, ErrScheduleNotFound) {
+		t.Fatalf("test assert error: policy of a missing schedule appended with %v", err)
+	}
+
+	// without time matches in the kernel, the rules are toggled instead
+	schedules.InKernel = false
+	holidays := &Schedule{
+		Name:   "holidays",
+		Ranges: []*DateRange{{Start: "2099-12-24 00:00", End: "2099-12-27 00:00"}},
+	}
+	if err := schedules.Update(holidays); err != nil {
+		t.Fatal(err)
+	}
+	closed := &Policy{
+		Source:   NewAddressImmediate(parseTestIPRanges("10.0.2.0/24")),
+		Action:   PolicyDrop,
+		Schedule: "holidays",
+	}
+	if err := router.PolicyTable().Append(closed); err != nil {
+		t.Fatal(err)
+	}
+	if kernel := kernelEntryOrder(t, router.PolicyTable()); len(kernel) != 1 {
+		t.Fatalf("test assert error: inactive policy in the kernel as %v", kernel)
+	}
+	if err := schedules.refresh(time.Date(2099, 12, 25, 12, 0, 0, 0, time.Local)); err != nil {
+		t.Fatal(err)
+	}
+	assertEntryOrder(t, router.PolicyTable(), gaming.ID, closed.ID)
+	if err := schedules.refresh(time.Date(2099, 12, 28, 0, 0, 0, 0, time.Local)); err != nil {
+		t.Fatal(err)
+	}
+	if kernel := kernelEntryOrder(t, router.PolicyTable()); len(kernel) != 1 {
+		t.Fatalf("test assert error: ended policy in the kernel as %v", kernel)
+	}
+	assertConsistent(t, router)
+
+	if err := router.PolicyTable().Remove(closed.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := schedules.Delete("holidays"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScheduleTransaction(t *testing.T) {
+	router := newTestRouter()
+	schedules := router.ScheduleTable()
+
+	evenings := &Schedule{Name: "evenings", Weekly: []*WeeklyWindow{{Start: "18:00", End: "22:00"}}}
+	if err := schedules.Update(evenings); err != nil {
+		t.Fatal(err)
+	}
+	policy := &Policy{Source: NewAddressImmediate(parseTestIPRanges("10.0.1.0/24")), Schedule: "evenings"}
+	if err := router.PolicyTable().Append(policy); err != nil {
+		t.Fatal(err)
+	}
+	compiled, err := router.PolicyTable().Compiled(policy.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// schedules added or replaced are restored by a rollback, along with the
+	// rules of their policies
+	tx := router.Begin()
+	if err := schedules.Update(&Schedule{Name: "mornings", Weekly: []*WeeklyWindow{{Start: "06:00", End: "09:00"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := schedules.Update(&Schedule{Name: "evenings", Weekly: []*WeeklyWindow{{Start: "20:00", End: "23:00"}}}); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+
+	if schedules.Find("mornings") != nil || schedules.Find("evenings") != evenings {
+		t.Fatalf("test assert error: schedules %v after rollback", schedules.All())
+	}
+	assertConsistent(t, router)
+
+	// and so is a schedule replaced in a batch the kernel rejects
+	router.nft.DelTable(&nftables.Table{Name: "missing", Family: nftables.TableFamilyINet})
+	if err := schedules.Update(&Schedule{Name: "evenings", Weekly: []*WeeklyWindow{{Start: "20:00", End: "23:00"}}}); err == nil {
+		t.Fatalf("test assert error: rejected batch committed")
+	}
+	if schedules.Find("evenings") != evenings {
+		t.Fatalf("test assert error: schedules %v after the rejected batch", schedules.All())
+	}
+	assertConsistent(t, router)
+
+	after, err := router.PolicyTable().Compiled(policy.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(compiled) || after[0].String() != compiled[0].String() {
+		t.Fatalf("test assert error: compiled %v (expecting %v)", after, compiled)
+	}
+}
@@ -1,7 +1,19 @@
 package yafw
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrServiceInvalid = errors.New("invalid service")
+	ErrServiceFamily  = errors.New("service matches a header of a single family")
 )
 
 type ServiceGroup struct {
@@ -9,6 +21,9 @@ type ServiceGroup struct {
 	Services []*Service `json:"services"`
 }
 
+// A service matches the transport protocol of packets, and optionally their
+// ports, ICMP type and code, TCP flags, length, TTL and DSCP. A range of
+// lengths or TTLs is matched if its maximum is not 0.
 type Service struct {
 	Name               string `json:"name"`
 	Protocol           uint8  `json:"protocol"`
@@ -16,21 +31,132 @@ type Service struct {
 	SourcePortMax      uint16 `json:"source_port_max"`
 	DestinationPortMin uint16 `json:"destination_port_min"`
 	DestinationPortMax uint16 `json:"destination_port_max"`
+
+	// type and code of ICMP or ICMPv6, depending on the protocol
+	ICMPType *uint8 `json:"icmp_type,omitempty"`
+	ICMPCode *uint8 `json:"icmp_code,omitempty"`
+
+	// the flags in TCPFlagsMask, or in TCPFlags if it is 0, must be exactly
+	// TCPFlags, e.g. ["syn"] out of ["syn", "ack"] for a connection request
+	TCPFlags     TCPFlags `json:"tcp_flags,omitempty"`
+	TCPFlagsMask TCPFlags `json:"tcp_flags_mask,omitempty"`
+
+	// length of the whole packet, including the network header
+	LengthMin uint16 `json:"length_min"`
+	LengthMax uint16 `json:"length_max"`
+	// TTL of IPv4 or hop limit of IPv6
+	TTLMin uint8  `json:"ttl_min"`
+	TTLMax uint8  `json:"ttl_max"`
+	DSCP   *uint8 `json:"dscp,omitempty"`
 }
 
-func (s *Service) Exprs() []expr.Any {
-	builder := &ExprBuilder{}
-	builder.MetaL4Protocol(1).CompareL4Protocol(1, s.Protocol)
+type TCPFlags uint8
+
+const (
+	TCPFlagFIN TCPFlags = 1 << iota
+	TCPFlagSYN
+	TCPFlagRST
+	TCPFlagPSH
+	TCPFlagACK
+	TCPFlagURG
+	TCPFlagECE
+	TCPFlagCWR
+)
 
-	if s.SourcePortMin != 0 && s.SourcePortMax != 0 {
-		builder.LoadSourcePort(1).ComparePortRange(1, s.SourcePortMin, s.SourcePortMax)
+var tcpFlagNames = []string{"fin", "syn", "rst", "psh", "ack", "urg", "ecn", "cwr"}
+
+func (f TCPFlags) Names() []string {
+	ret := []string{}
+	for i, name := range tcpFlagNames {
+		if f&(1<<i) != 0 {
+			ret = append(ret, name)
+		}
 	}
+	return ret
+}
 
-	if s.DestinationPortMin != 0 && s.DestinationPortMax != 0 {
-		builder.LoadDestinationPort(1).ComparePortRange(1, s.DestinationPortMin, s.DestinationPortMax)
+func (f TCPFlags) String() string {
+	return strings.Join(f.Names(), "|")
+}
+
+func (f TCPFlags) MarshalJSON() ([]byte, error) {
+	return json.Marshal(f.Names())
+}
+
+func (f *TCPFlags) UnmarshalJSON(data []byte) error {
+	names := []string{}
+	if err := json.Unmarshal(data, &names); err != nil {
+		return err
+	}
+
+	*f = 0
+	for _, name := range names {
+		found := false
+		for i, flag := range tcpFlagNames {
+			if strings.EqualFold(name, flag) {
+				*f |= 1 << i
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: tcp flag %q", ErrServiceInvalid, name)
+		}
 	}
 
-	return builder.Exprs()
+	return nil
+}
+
+func (s *Service) isICMP() bool {
+	return s.Protocol == unix.IPPROTO_ICMP || s.Protocol == unix.IPPROTO_ICMPV6
+}
+
+// Check the fields of a service against each other, e.g. an ICMP type is only
+// matched in ICMP packets.
+func (s *Service) Validate() error {
+	if (s.ICMPType != nil || s.ICMPCode != nil) && !s.isICMP() {
+		return fmt.Errorf("%w: icmp type or code of protocol %d", ErrServiceInvalid, s.Protocol)
+	}
+	if (s.TCPFlags != 0 || s.TCPFlagsMask != 0) && s.Protocol != unix.IPPROTO_TCP {
+		return fmt.Errorf("%w: tcp flags of protocol %d", ErrServiceInvalid, s.Protocol)
+	}
+	if s.TCPFlagsMask != 0 && s.TCPFlags&^s.TCPFlagsMask != 0 {
+		return fmt.Errorf("%w: tcp flags %s out of mask %s", ErrServiceInvalid, s.TCPFlags, s.TCPFlagsMask)
+	}
+	for _, r := range [][2]uint16{
+		{s.SourcePortMin, s.SourcePortMax},
+		{s.DestinationPortMin, s.DestinationPortMax},
+		{s.LengthMin, s.LengthMax},
+		{uint16(s.TTLMin), uint16(s.TTLMax)},
+	} {
+		if r[1] != 0 && r[0] > r[1] {
+			return fmt.Errorf("%w: range %d-%d", ErrServiceInvalid, r[0], r[1])
+		}
+	}
+	if s.DSCP != nil && *s.DSCP >= 64 {
+		return fmt.Errorf("%w: dscp %d", ErrServiceInvalid, *s.DSCP)
+	}
+
+	return nil
+}
+
+// Whether the service matches a field of the network header, whose offset
+// depends on the family.
+func (s *Service) familySpecific() bool {
+	return s != nil && (s.TTLMax != 0 || s.DSCP != nil)
+}
+
+// Expand the families a rule is compiled for so that none of them is
+// nftables.TableFamilyINet, if the service needs it.
+func (s *Service) families(families []nftables.TableFamily) []nftables.TableFamily {
+	if !s.familySpecific() {
+		return families
+	}
+	return splitFamilies(families)
+}
+
+// Get the expressions matching the service in an inet rule.
+func (s *Service) Exprs() []expr.Any {
+	return (&ExprBuilder{}).MatchService(nftables.TableFamilyINet, s).Exprs()
 }
 
 // func (r *Router) ServiceGroups() []*ServiceGroup {
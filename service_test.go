@@ -0,0 +1,101 @@
+package yafw
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestServiceJSON(t *testing.T) {
+	service := &Service{}
+	if err := json.Unmarshal([]byte(`{"protocol": 6, "tcp_flags": ["syn"], "tcp_flags_mask": ["SYN", "ack"]}`), service); err != nil {
+		t.Fatal(err)
+	}
+	if service.TCPFlags != TCPFlagSYN || service.TCPFlagsMask != TCPFlagSYN|TCPFlagACK {
+		t.Fatalf("test assert error: tcp flags %s of %s", service.TCPFlags, service.TCPFlagsMask)
+	}
+
+	data, err := json.Marshal(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &Service{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if *decoded != *service {
+		t.Fatalf("test assert error: %s decoded as %+v", data, decoded)
+	}
+
+	if err := json.Unmarshal([]byte(`{"tcp_flags": ["syn", "xmas"]}`), service); !errors.Is(err, ErrServiceInvalid) {
+		t.Fatalf("test assert error: unknown tcp flag decoded with %v", err)
+	}
+}
+
+func TestServiceValidate(t *testing.T) {
+	echoRequest, dscp := uint8(8), uint8(64)
+
+	for _, c := range []struct {
+		service *Service
+		valid   bool
+	}{
+		{&Service{Protocol: 1, ICMPType: &echoRequest}, true},
+		{&Service{Protocol: 58, ICMPCode: &echoRequest}, true},
+		{&Service{Protocol: 17, ICMPType: &echoRequest}, false},
+		{&Service{Protocol: 6, TCPFlags: TCPFlagSYN, TCPFlagsMask: TCPFlagSYN | TCPFlagACK}, true},
+		{&Service{Protocol: 6, TCPFlags: TCPFlagSYN, TCPFlagsMask: TCPFlagACK}, false},
+		{&Service{Protocol: 17, TCPFlags: TCPFlagSYN}, false},
+		{&Service{Protocol: 17, LengthMin: 1500, LengthMax: 100}, false},
+		{&Service{Protocol: 17, TTLMin: 10}, true},
+		{&Service{Protocol: 17, DSCP: &dscp}, false},
+	} {
+		if err := c.service.Validate(); (err == nil) != c.valid {
+			t.Fatalf("test assert error: %+v validated with %v", c.service, err)
+		}
+	}
+}
+
+func TestServicePolicy(t *testing.T) {
+	router := newTestRouter()
+	echoRequest, expedited := uint8(8), uint8(46)
+
+	ping := &Policy{Service: &Service{Protocol: 1, ICMPType: &echoRequest}}
+	if err := router.PolicyTable().Append(ping); err != nil {
+		t.Fatal(err)
+	}
+	xmas := &Policy{
+		Service: &Service{
+			Protocol:     6,
+			TCPFlags:     TCPFlagFIN | TCPFlagPSH | TCPFlagURG,
+			TCPFlagsMask: TCPFlagFIN | TCPFlagSYN | TCPFlagRST | TCPFlagPSH | TCPFlagACK | TCPFlagURG,
+		},
+		Action: PolicyDrop,
+	}
+	if err := router.PolicyTable().Append(xmas); err != nil {
+		t.Fatal(err)
+	}
+	// the network header differs between the families, so a rule is
+	// compiled for each of them
+	voice := &Policy{Service: &Service{Protocol: 17, LengthMax: 256, TTLMin: 2, TTLMax: 255, DSCP: &expedited}}
+	if err := router.PolicyTable().Append(voice); err != nil {
+		t.Fatal(err)
+	}
+	if compiled, err := router.PolicyTable().Compiled(voice.ID); err != nil || len(compiled) != 2 {
+		t.Fatalf("test assert error: compiled %v with %v (expecting 2 rules)", compiled, err)
+	}
+
+	verifications, err := router.VerifyEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, verification := range verifications {
+		if !verification.OK {
+			t.Fatalf("test assert error: %+v does not match the kernel", verification)
+		}
+	}
+
+	invalid := &Policy{Service: &Service{Protocol: 17, TCPFlags: TCPFlagSYN}}
+	if err := router.PolicyTable().Append(invalid); !errors.Is(err, ErrServiceInvalid) {
+		t.Fatalf("test assert error: invalid service appended with %v", err)
+	}
+}
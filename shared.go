@@ -0,0 +1,200 @@
+package yafw
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables"
+)
+
+// A named set of constant elements, shared by every entry with the same
+// immediate addresses. Anonymous sets cannot be shared, since the kernel binds
+// each of them to a single rule, so immediate addresses are kept in named
+// sets which are deleted once no entry owns them.
+type sharedSet struct {
+	set  *nftables.Set
+	key  string
+	refs int
+}
+
+// Get the shared set holding elements, creating it on the first use. The key
+// identifies the elements along with their type. The set has to be given back
+// by releaseSharedSets once the owner is done with it.
+func (r *Router) acquireSharedSet(key string, keyType nftables.SetDatatype, interval bool, elements []nftables.SetElement) (*nftables.Set, error) {
+	if shared, ok := r.shared[key]; ok {
+		shared.refs++
+		r.acquired = append(r.acquired, shared.set)
+		return shared.set, nil
+	}
+
+	r.sharedCounter++
+	set := &nftables.Set{
+		Table:    r.table,
+		Name:     fmt.Sprintf("immediate-%d", r.sharedCounter),
+		Constant: true,
+		Interval: interval,
+		KeyType:  keyType,
+	}
+	if err := r.nft.AddSet(set, nil); err != nil {
+		return nil, err
+	}
+	if err := r.setAddElements(set, elements); err != nil {
+		return nil, err
+	}
+
+	shared := &sharedSet{
+		set:  set,
+		key:  key,
+		refs: 1,
+	}
+	r.shared[key] = shared
+	r.sharedNames[set.Name] = shared
+	r.acquired = append(r.acquired, set)
+
+	return set, nil
+}
+
+// A dynamic IPSet tracked for the addresses of entries, e.g. those of a
+// domain name, which is deleted once no entry refers to it.
+type trackedSet struct {
+	ipset *IPSet
+	refs  int
+	// stops the tracking by the table of the addresses
+	untrack func()
+}
+
+// Take a reference to a tracked IPSet, which is given back along with the
+// shared sets by releaseSharedSets. Once the last one is given back, untrack
+// is called and the IPSet is deleted.
+func (r *Router) acquireTrackedSet(ipset *IPSet, untrack func()) {
+	// the IPSet is known by its IPv4 set, the IPv6 one is left out when the
+	// sets are given back
+	name := ipset.set.V4.Name
+	tracked, ok := r.tracked[name]
+	if !ok {
+		tracked = &trackedSet{ipset: ipset, untrack: untrack}
+		r.tracked[name] = tracked
+	}
+	tracked.refs++
+	r.acquired = append(r.acquired, ipset.set.V4)
+}
+
+// Delete a tracked IPSet no entry refers to, unless other IPSets still do.
+func (r *Router) releaseTrackedSet(tracked *trackedSet) {
+	ipset := tracked.ipset
+	if len(r.ipSetParents(ipset.name)) > 0 {
+		return
+	}
+
+	tracked.untrack()
+	r.nft.DelSet(ipset.set.V4)
+	r.nft.DelSet(ipset.set.V6)
+	delete(r.ipsets, ipset.name)
+}
+
+// Give back shared sets, deleting those no longer owned by any entry, along
+// with the tracked IPSets, see acquireTrackedSet. The sets of other IPSets
+// are ignored. The deletion goes into the pending batch, after the rules
+// using the sets are deleted.
+func (r *Router) releaseSharedSets(sets ...*nftables.Set) {
+	for _, set := range sets {
+		if set == nil {
+			continue
+		}
+		if tracked, ok := r.tracked[set.Name]; ok {
+			tracked.refs--
+			if tracked.refs == 0 {
+				delete(r.tracked, set.Name)
+				r.releaseTrackedSet(tracked)
+			}
+			continue
+		}
+		shared, ok := r.sharedNames[set.Name]
+		if !ok {
+			continue
+		}
+
+		shared.refs--
+		if shared.refs == 0 {
+			r.nft.DelSet(shared.set)
+			delete(r.shared, shared.key)
+			delete(r.sharedNames, set.Name)
+		}
+	}
+}
+
+// Counts of the sets of the router, telling whether stale kernel objects
+// build up.
+type SetStats struct {
+	// sets in the kernel table, including anonymous ones
+	Kernel    int `json:"kernel"`
+	Anonymous int `json:"anonymous"`
+
+	IPSets  int `json:"ipsets"`
+	MACSets int `json:"macsets"`
+	Zones   int `json:"zones"`
+
+	// shared sets of immediate addresses, and the number of their owners
+	Shared      int `json:"shared"`
+	SharedOwned int `json:"shared_owned"`
+	// dynamic sets of source addresses owned by the limits of policies
+	Meters int `json:"meters"`
+
+	// named kernel sets which yafw does not know of
+	Stale []string `json:"stale"`
+}
+
+func (r *Router) SetStats() (*SetStats, error) {
+	sets, err := r.query.GetSets(r.table)
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{}
+	for _, ipset := range r.ipsets {
+		if ipset.set != nil {
+			known[ipset.set.V4.Name] = true
+			known[ipset.set.V6.Name] = true
+		}
+	}
+	for _, macset := range r.macsets {
+		if macset.set != nil {
+			known[macset.set.Name] = true
+		}
+	}
+	for _, zone := range r.zones.All() {
+		if zone.set != nil {
+			known[zone.set.Name] = true
+		}
+	}
+	for name := range r.sharedNames {
+		known[name] = true
+	}
+
+	ret := &SetStats{
+		Kernel:  len(sets),
+		IPSets:  len(r.ipsets),
+		MACSets: len(r.macsets),
+		Zones:   len(r.zones.All()),
+		Stale:   []string{},
+	}
+	for _, shared := range r.shared {
+		if strings.HasPrefix(shared.key, "meter:") {
+			ret.Meters++
+			continue
+		}
+		ret.Shared++
+		ret.SharedOwned += shared.refs
+	}
+	for _, set := range sets {
+		if set.Anonymous || strings.HasPrefix(set.Name, "__set") {
+			ret.Anonymous++
+		} else if !known[set.Name] {
+			ret.Stale = append(ret.Stale, set.Name)
+		}
+	}
+	sort.Strings(ret.Stale)
+
+	return ret, nil
+}
@@ -0,0 +1,69 @@
+package yafw
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSharedImmediateSets(t *testing.T) {
+	router := newTestRouter()
+
+	immediate := func(ranges ...string) *Address {
+		return NewAddressImmediate(parseTestIPRanges(ranges...))
+	}
+
+	// the same addresses in another order share the sets
+	a := &Policy{Source: immediate("10.0.0.0/24", "fd00::/64")}
+	b := &Policy{Source: immediate("fd00::/64", "10.0.0.0/24")}
+	c := &Policy{
+		Destination: immediate("10.0.0.0/24"),
+		SourceMAC:   NewMACAddressImmediate([]net.HardwareAddr{mustParseMAC("00:11:22:33:44:55")}),
+	}
+	for _, policy := range []*Policy{a, b, c} {
+		if err := router.PolicyTable().Append(policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertStats := func(shared int, owned int) {
+		t.Helper()
+		stats, err := router.SetStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Shared != shared || stats.SharedOwned != owned || stats.Kernel != shared || len(stats.Stale) != 0 {
+			t.Fatalf("test assert error: stats %+v (expecting %d shared sets with %d owners)", stats, shared, owned)
+		}
+	}
+	assertStats(3, 6)
+
+	// updating an entry gives back the sets of its old artifact
+	b.Source = immediate("10.0.1.0/24")
+	if err := router.PolicyTable().Update(b, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertStats(4, 5)
+
+	// an update keeping the addresses keeps the sets
+	if err := router.PolicyTable().Update(&Policy{ID: a.ID, Source: immediate("10.0.0.0/24", "fd00::/64")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertStats(4, 5)
+
+	for _, policy := range []*Policy{a, b, c} {
+		if err := router.PolicyTable().Remove(policy.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertStats(0, 0)
+
+	// a failed build gives back the sets acquired so far
+	broken := &Policy{Source: immediate("10.0.0.0/24"), Destination: NewAddressIPSet("missing")}
+	if err := router.PolicyTable().Append(broken); err == nil {
+		t.Fatalf("test assert error: policy with a missing ipset appended")
+	}
+	if err := router.Update(); err != nil {
+		t.Fatal(err)
+	}
+	assertStats(0, 0)
+}
@@ -0,0 +1,314 @@
+package yafw
+
+import (
+	"errors"
+
+	"github.com/google/nftables"
+)
+
+var ErrTransactionDone = errors.New("transaction already committed or rolled back")
+
+// A Transaction groups changes to the entry tables and IPSets of a router,
+// which are sent to the kernel in a single netlink batch by Commit. Changes
+// are staged as they are made through the usual methods, e.g. Append,
+// Update, Remove or UpdateIPSet, while the transaction is open. Once the
+// kernel rejects the batch, or the transaction is rolled back, the entries,
+// IPSets and the sets they share are restored as they were before.
+//
+// Entries changed in place are restored along with their artifacts and
+// whether they are enabled, but not their other fields. Schedules are
+// restored as well. Changes to other objects, e.g. MAC sets or zones, are
+// sent in the batch but not restored.
+//
+// A transaction does not lock the router by itself. The caller holds the
+// lock of the router, see Router.Lock, from Begin until the transaction is
+// done.
+type Transaction struct {
+	r *Router
+	// joined a transaction opened before, which commits the changes
+	joined bool
+	done   bool
+
+	tables []*tableChange
+	// given back at commit, after the old rules using them are deleted
+	releases []func()
+
+	// state restored once the transaction is rolled back
+	shared        map[string]sharedSet
+	tracked       map[string]trackedSet
+	sharedCounter int
+	meterCounter  int
+	ipsetCounter  int
+	ipsets        map[string]*IPSet
+	ipsetStates   map[*IPSet]*IPSet
+	refs          *ReferenceIndex
+	quotas        *quotaSnapshot
+	// IPSets tracked by the tables of dynamic addresses, which may be added
+	// along with entries
+	fqdns   map[string]*FQDN
+	geo     map[string]*IPSet
+	ifaddrs map[string]*InterfaceAddress
+	feeds   map[string]*Feed
+	// schedules, whose states are replaced in place
+	schedules      map[string]*scheduleState
+	scheduleStates map[*scheduleState]scheduleState
+}
+
+// Changes staged to an entry table.
+type tableChange struct {
+	t *EntryTable
+
+	list      []Entry
+	counter   int
+	artifacts map[Entry]any
+	enabled   map[Entry]bool
+
+	// rules of the entries installed at commit, by their indexes
+	staged map[int][]*nftables.Rule
+	// entries whose kernel rules are deleted at commit
+	removed map[int]bool
+}
+
+// Open a transaction. If one is open already, the returned transaction joins
+// it, and its Commit and Rollback leave the changes to the one opened first.
+func (r *Router) Begin() *Transaction {
+	if r.tx != nil {
+		return &Transaction{r: r, joined: true}
+	}
+
+	tx := &Transaction{
+		r:              r,
+		shared:         make(map[string]sharedSet, len(r.shared)),
+		tracked:        make(map[string]trackedSet, len(r.tracked)),
+		sharedCounter:  r.sharedCounter,
+		meterCounter:   r.meterCounter,
+		ipsetCounter:   r.ipsetCounter,
+		ipsets:         make(map[string]*IPSet, len(r.ipsets)),
+		ipsetStates:    make(map[*IPSet]*IPSet),
+		refs:           r.refs.clone(),
+		quotas:         r.quotas.snapshot(),
+		fqdns:          make(map[string]*FQDN, len(r.fqdns.m)),
+		geo:            make(map[string]*IPSet, len(r.geo.m)),
+		ifaddrs:        make(map[string]*InterfaceAddress, len(r.ifaddrs.m)),
+		feeds:          make(map[string]*Feed, len(r.feeds.m)),
+		schedules:      make(map[string]*scheduleState, len(r.schedules.m)),
+		scheduleStates: make(map[*scheduleState]scheduleState, len(r.schedules.m)),
+	}
+	for key, shared := range r.shared {
+		tx.shared[key] = *shared
+	}
+	for name, tracked := range r.tracked {
+		tx.tracked[name] = *tracked
+	}
+	for name, ipset := range r.ipsets {
+		tx.ipsets[name] = ipset
+	}
+	for name, fqdn := range r.fqdns.m {
+		tx.fqdns[name] = fqdn
+	}
+	for country, ipset := range r.geo.m {
+		tx.geo[country] = ipset
+	}
+	for name, tracked := range r.ifaddrs.m {
+		tx.ifaddrs[name] = tracked
+	}
+	for name, feed := range r.feeds.m {
+		tx.feeds[name] = feed
+	}
+	for name, state := range r.schedules.m {
+		tx.schedules[name] = state
+		tx.scheduleStates[state] = *state
+	}
+	r.tx = tx
+
+	return tx
+}
+
+// Get the changes staged to a table, recording its state on the first
+// change.
+func (tx *Transaction) table(t *EntryTable) *tableChange {
+	for _, change := range tx.tables {
+		if change.t == t {
+			return change
+		}
+	}
+
+	change := &tableChange{
+		t:         t,
+		list:      append([]Entry(nil), t.list...),
+		counter:   t.counter,
+		artifacts: make(map[Entry]any, len(t.list)),
+		enabled:   make(map[Entry]bool, len(t.list)),
+		staged:    make(map[int][]*nftables.Rule),
+		removed:   make(map[int]bool),
+	}
+	for _, entry := range t.list {
+		change.artifacts[entry] = entry.artifactState()
+		change.enabled[entry] = entry.Enabled()
+	}
+	tx.tables = append(tx.tables, change)
+
+	return change
+}
+
+// Record the state of an IPSet on its first change. The members and
+// references the caller changed before handing the IPSet over are pending,
+// so they are undone in the record.
+func (tx *Transaction) ipset(ipset *IPSet) {
+	if _, ok := tx.ipsetStates[ipset]; ok {
+		return
+	}
+
+	state := ipset.clone()
+	state.revertPending()
+	tx.ipsetStates[ipset] = state
+}
+
+// Send the staged changes to the kernel in a single batch. If the kernel
+// rejects it, the transaction is rolled back and the error is returned.
+func (tx *Transaction) Commit() error {
+	if tx.joined {
+		return nil
+	}
+	if tx.done {
+		return ErrTransactionDone
+	}
+	r := tx.r
+
+	err := func() error {
+		for _, change := range tx.tables {
+			if err := change.t.commitRules(change); err != nil {
+				return err
+			}
+		}
+		for _, release := range tx.releases {
+			release()
+		}
+		return r.flush()
+	}()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	tx.done = true
+	r.tx = nil
+
+	for _, change := range tx.tables {
+		if err := change.t.afterCommit(change); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Discard the staged changes, restoring the router as it was when the
+// transaction was opened.
+func (tx *Transaction) Rollback() {
+	if tx.joined || tx.done {
+		return
+	}
+	r := tx.r
+	tx.done = true
+	r.tx = nil
+
+	r.discardPending()
+
+	for _, change := range tx.tables {
+		change.t.list = change.list
+		change.t.counter = change.counter
+		for entry, state := range change.artifacts {
+			entry.restoreArtifact(state)
+		}
+		for entry, enabled := range change.enabled {
+			entry.SetEnabled(enabled)
+		}
+	}
+
+	r.shared = make(map[string]*sharedSet, len(tx.shared))
+	r.sharedNames = make(map[string]*sharedSet, len(tx.shared))
+	for key, shared := range tx.shared {
+		shared := shared
+		r.shared[key] = &shared
+		r.sharedNames[shared.set.Name] = &shared
+	}
+	r.tracked = make(map[string]*trackedSet, len(tx.tracked))
+	for name, tracked := range tx.tracked {
+		tracked := tracked
+		r.tracked[name] = &tracked
+	}
+	r.sharedCounter = tx.sharedCounter
+	r.meterCounter = tx.meterCounter
+	r.ipsetCounter = tx.ipsetCounter
+
+	r.ipsets = tx.ipsets
+	for ipset, state := range tx.ipsetStates {
+		*ipset = *state
+	}
+	r.refs = tx.refs
+	r.quotas.restore(tx.quotas)
+	// the IPSets tracked since are gone along with r.ipsets
+	r.fqdns.m = tx.fqdns
+	r.geo.m = tx.geo
+	r.ifaddrs.m = tx.ifaddrs
+	r.feeds.m = tx.feeds
+	r.schedules.m = tx.schedules
+	for state, previous := range tx.scheduleStates {
+		*state = previous
+	}
+}
+
+// Delete the kernel rules of the entries staged or removed, and add the rules
+// staged in place, before the rules of the following entry left as it is.
+func (t *EntryTable) commitRules(change *tableChange) error {
+	// the counts of the old rules are kept before they are deleted
+	if err := t.sampleCounters(); err != nil {
+		return err
+	}
+
+	for index, rules := range t.ruleMap {
+		if _, ok := change.staged[index]; ok || change.removed[index] {
+			if err := t.removeRules(rules); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, entry := range t.list {
+		if rules, ok := change.staged[entry.Index()]; ok {
+			t.addRules(entry.Index(), t.handleAfter(i, change.staged), rules)
+		}
+	}
+
+	return nil
+}
+
+// Find the handles of the rules added by a committed transaction.
+func (t *EntryTable) afterCommit(change *tableChange) error {
+	for index := range change.removed {
+		delete(t.ruleMap, index)
+		delete(t.counters, index)
+	}
+
+	rules, err := t.rulesByTag()
+	if err != nil {
+		return err
+	}
+	for index := range change.staged {
+		t.ruleMap[index] = rules[index]
+		counter := t.entryCounter(index)
+		counter.kernelPackets, counter.kernelBytes = 0, 0
+	}
+
+	return nil
+}
+
+// Give back the kernel objects of an entry at commit, after its old rules
+// are deleted.
+func (tx *Transaction) release(entry Entry) {
+	sets := entry.artifactSets()
+	tx.releases = append(tx.releases, func() {
+		tx.r.releaseSharedSets(sets...)
+	})
+}
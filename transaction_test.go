@@ -0,0 +1,184 @@
+package yafw
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+// Get the entries of the kernel rules of a table in their order.
+func kernelEntryOrder(t *testing.T, table *EntryTable) []int {
+	rules, err := table.r.query.GetRules(table.r.table, table.chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := []int{}
+	for _, rule := range rules {
+		if id, ok := ruleTag(rule); ok && (len(ret) == 0 || ret[len(ret)-1] != id) {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+func entryOrder(table *EntryTable) []int {
+	ret := []int{}
+	for _, entry := range table.All() {
+		ret = append(ret, entry.Index())
+	}
+	return ret
+}
+
+// Check the order of the enabled entries of a table, and their kernel rules.
+func assertEntryOrder(t *testing.T, table *EntryTable, expected ...int) {
+	list, kernel := []int{}, kernelEntryOrder(t, table)
+	for _, entry := range table.All() {
+		if entry.Enabled() {
+			list = append(list, entry.Index())
+		}
+	}
+	if len(list) != len(expected) || len(kernel) != len(expected) {
+		t.Fatalf("test assert error: entries %v in the kernel as %v (expecting %v)", list, kernel, expected)
+	}
+	for i := range expected {
+		if list[i] != expected[i] || kernel[i] != expected[i] {
+			t.Fatalf("test assert error: entries %v in the kernel as %v (expecting %v)", list, kernel, expected)
+		}
+	}
+}
+
+func assertConsistent(t *testing.T, router *Router) {
+	verifications, err := router.VerifyEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, verification := range verifications {
+		if !verification.OK {
+			t.Fatalf("test assert error: %+v does not match the kernel", verification)
+		}
+	}
+	stats, err := router.SetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Stale) != 0 {
+		t.Fatalf("test assert error: stale sets %v", stats.Stale)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	router := newTestRouter()
+	policies := router.PolicyTable()
+
+	first := &Policy{Source: NewAddressImmediate(parseTestIPRanges("10.0.0.0/24"))}
+	if err := policies.Append(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// an IPSet and the entries referring to it in a single batch
+	tx := router.Begin()
+	lan := router.NewIPSet("lan").AddIPRange(NewIPRangeString("192.168.1.0/24"))
+	if err := router.UpdateIPSet(lan); err != nil {
+		t.Fatal(err)
+	}
+	second := &Policy{Source: NewAddressIPSet("lan")}
+	if err := policies.Append(second); err != nil {
+		t.Fatal(err)
+	}
+	top := &Policy{Destination: NewAddressImmediate(parseTestIPRanges("10.0.1.0/24")), Action: PolicyDrop}
+	if err := policies.InsertBefore(top, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	snat := &SNATRule{Source: NewAddressIPSet("lan")}
+	if err := router.SNATRuleTable().Append(snat); err != nil {
+		t.Fatal(err)
+	}
+	if rules := kernelEntryOrder(t, policies); len(rules) != 1 {
+		t.Fatalf("test assert error: entries %v in the kernel before commit", rules)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	assertEntryOrder(t, policies, top.ID, first.ID, second.ID)
+	assertConsistent(t, router)
+	if err := tx.Commit(); err != ErrTransactionDone {
+		t.Fatalf("test assert error: committed twice with %v", err)
+	}
+
+	// staged changes are dropped by a rollback
+	tx = router.Begin()
+	if err := policies.Remove(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := policies.Update(&Policy{ID: second.ID, Source: NewAddressImmediate(parseTestIPRanges("10.0.2.0/24"))}, &top.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := policies.Append(&Policy{Source: NewAddressIPSet("lan")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.ipsetStates) != 0 {
+		t.Fatalf("test assert error: %d ipsets recorded without being changed", len(tx.ipsetStates))
+	}
+	tx.Rollback()
+	assertEntryOrder(t, policies, top.ID, first.ID, second.ID)
+	assertConsistent(t, router)
+	if refs := router.IPSetReferences("lan"); len(refs) != 2 {
+		t.Fatalf("test assert error: references %v after rollback", refs)
+	}
+
+	// and so are they once the kernel rejects the batch
+	tx = router.Begin()
+	if err := policies.Update(&Policy{ID: top.ID, Destination: top.Destination}, &second.ID); err != nil {
+		t.Fatal(err)
+	}
+	guest := router.NewIPSet("guest").AddIPRange(NewIPRangeString("192.168.2.0/24"))
+	if err := router.UpdateIPSet(guest); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.UpdateIPSet(lan.AddIPRange(NewIPRangeString("192.168.3.0/24"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.SNATRuleTable().Remove(snat.ID); err != nil {
+		t.Fatal(err)
+	}
+	router.nft.DelTable(&nftables.Table{Name: "missing", Family: nftables.TableFamilyINet})
+	if err := tx.Commit(); err == nil {
+		t.Fatalf("test assert error: rejected batch committed")
+	}
+	assertEntryOrder(t, policies, top.ID, first.ID, second.ID)
+	assertEntryOrder(t, router.SNATRuleTable(), snat.ID)
+	assertConsistent(t, router)
+	if router.FindIPSet("guest") != nil || len(lan.Members()) != 1 {
+		t.Fatalf("test assert error: ipsets %v after the rejected batch", router.IPSets())
+	}
+
+	// a failed update leaves the table as it was
+	invalid := &Policy{Service: &Service{Protocol: 6, ICMPType: new(uint8)}}
+	if err := policies.InsertBefore(invalid, first.ID); !errors.Is(err, ErrServiceInvalid) {
+		t.Fatalf("test assert error: invalid policy inserted with %v", err)
+	}
+	assertEntryOrder(t, policies, top.ID, first.ID, second.ID)
+	assertConsistent(t, router)
+
+	// the table goes on from the kernel rules left by the rejected batch
+	if err := policies.Update(first, &top.ID); err != nil {
+		t.Fatal(err)
+	}
+	assertEntryOrder(t, policies, first.ID, top.ID, second.ID)
+	assertConsistent(t, router)
+
+	// the domain name of a failed update is not tracked, and is tracked
+	// again later
+	tracking := &Policy{Source: NewAddressFQDN("a.example.com"), Destination: NewAddressIPSet("missing")}
+	if err := policies.Append(tracking); !errors.Is(err, ErrIPSetNotFound) {
+		t.Fatalf("test assert error: policy of a missing ipset appended with %v", err)
+	}
+	if router.FQDNTable().Find("a.example.com") != nil {
+		t.Fatalf("test assert error: domain name tracked after the failed update")
+	}
+	if err := policies.Append(&Policy{Source: NewAddressFQDN("a.example.com")}); err != nil {
+		t.Fatal(err)
+	}
+	assertConsistent(t, router)
+}
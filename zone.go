@@ -1,12 +1,19 @@
 package yafw
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"sort"
 
 	"github.com/google/nftables"
 )
 
+var (
+	ErrZoneNotFound = errors.New("zone not found")
+	ErrZoneReferred = errors.New("zone is referred")
+)
+
 type Zone struct {
 	Name        string `json:"name"`
 	Description string `json:"description"`
@@ -130,16 +137,21 @@ func (t *ZoneTable) FindZone(name string) *Zone {
 	}
 }
 
+// Get all zones ordered by name.
 func (r *ZoneTable) All() []*Zone {
 	ret := []*Zone{}
 	for _, z := range r.zoneMap {
 		ret = append(ret, z)
-		return ret
 	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
 	return ret
 }
 
 func (t *ZoneTable) AssignInterfaceToZone(iface *net.Interface, zone string) error {
+	if _, ok := t.zoneMap[zone]; !ok {
+		return fmt.Errorf("%w: %s", ErrZoneNotFound, zone)
+	}
+
 	if oldZone, ok := t.interfaceMap[iface.Name]; ok {
 		if oldZone != zone {
 			t.zoneMap[oldZone].RemoveInterface(iface)
@@ -154,14 +166,44 @@ func (t *ZoneTable) AssignInterfaceToZone(iface *net.Interface, zone string) err
 	return nil
 }
 
-func (t *ZoneTable) DeleteZone(name string) {
-	if zone, ok := t.zoneMap[name]; ok {
-		for _, iface := range zone.Members() {
-			delete(t.interfaceMap, iface.Name)
+// Delete a zone along with its kernel set. It is refused while entries still
+// refer to it, see DeleteZoneCascade.
+func (t *ZoneTable) DeleteZone(name string) error {
+	zone, ok := t.zoneMap[name]
+	if !ok {
+		return ErrZoneNotFound
+	}
+	if refs := t.r.ZoneReferences(name); len(refs) > 0 {
+		return fmt.Errorf("%w: used by %s", ErrZoneReferred, describeReferences(refs))
+	}
+
+	if zone.set != nil {
+		t.r.nft.DelSet(zone.set)
+		if err := t.r.Update(); err != nil {
+			return err
 		}
+	}
 
-		delete(t.zoneMap, name)
+	for _, iface := range zone.Members() {
+		delete(t.interfaceMap, iface.Name)
 	}
+
+	delete(t.zoneMap, name)
+
+	return nil
+}
+
+// Delete a zone, removing the entries referring to it first.
+func (t *ZoneTable) DeleteZoneCascade(name string) error {
+	if _, ok := t.zoneMap[name]; !ok {
+		return ErrZoneNotFound
+	}
+
+	if err := t.r.removeReferences(t.r.ZoneReferences(name)); err != nil {
+		return err
+	}
+
+	return t.DeleteZone(name)
 }
 
 func (t *ZoneTable) AddZone(name string) *Zone {
@@ -1,9 +1,12 @@
 package yafw
 
 import (
+	"errors"
 	"net"
 	"os/exec"
 	"testing"
+
+	"github.com/google/nftables/expr"
 )
 
 func TestZone(t *testing.T) {
@@ -27,9 +30,47 @@ func TestZone(t *testing.T) {
 
 	router.zones.Update(zone)
 
-	out, err := exec.Command("nft", "-j", "list", "set", "ip", "yafw", zone.set.Name).CombinedOutput()
+	out, err := exec.Command("nft", "-j", "list", "set", "inet", "yafw", zone.set.Name).CombinedOutput()
 	t.Logf("NFT Output:\n%s\n", out)
 	if err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestZonePolicy(t *testing.T) {
+	router := newTestRouter()
+
+	iface, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone := router.zones.AddZone("trust").AddInterface(iface)
+	if err := router.zones.Update(zone); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := router.PolicyTable().Append(&Policy{SourceZone: "untrust"}); !errors.Is(err, ErrZoneNotFound) {
+		t.Fatalf("test assert error: policy of a missing zone appended with %v", err)
+	}
+
+	policy := &Policy{SourceZone: "trust", DestinationZone: "trust"}
+	if err := router.PolicyTable().Append(policy); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := policy.ToRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range rules {
+		lookups := 0
+		for _, e := range rule.Exprs {
+			if lookup, ok := e.(*expr.Lookup); ok && lookup.SetName == zone.set.Name {
+				lookups++
+			}
+		}
+		if lookups != 2 {
+			t.Fatalf("test assert error: %d lookups of the zone (expecting 2)", lookups)
+		}
+	}
+	assertConsistent(t, router)
+}